@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+
+	"cmitsakis/llm-api/internal/llm/conversation"
+	"cmitsakis/llm-api/internal/llm/jinja"
+	"cmitsakis/llm-api/internal/llm/predictor"
+)
+
+// chatMessage is a message of /chat with an explicit role.
+type chatMessage struct {
+	Role       string         `json:"role"`
+	Content    string         `json:"content"`
+	ToolCallID string         `json:"toolCallId"`
+	ToolCalls  []chatToolCall `json:"toolCalls"`
+}
+
+// maximum size of a JSON body, the same as the maximum size of a form body
+const maxJSONBodySize = 10 << 20
+
+// reports whether the body of the request is JSON.
+func hasJSONBody(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// reads the JSON object of the body of a /chat request. The field messages is returned,
+// and the other fields are added to the form, so they are handled like the parameters of a form:
+// strings and arrays of strings are added as they are, null is ignored, and other values are added as JSON (e.g. the number 0.7 as "0.7").
+func readJSONChatBody(r *http.Request) ([]chatMessage, error) {
+	var body map[string]json.RawMessage
+	err := json.NewDecoder(io.LimitReader(r.Body, maxJSONBodySize)).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+	var messages []chatMessage
+	for key, value := range body {
+		if key == "messages" {
+			dec := json.NewDecoder(bytes.NewReader(value))
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&messages)
+			if err != nil {
+				return nil, fmt.Errorf("messages: %s", err)
+			}
+			if messages == nil {
+				// an explicit empty array is still messages with explicit roles
+				messages = []chatMessage{}
+			}
+			continue
+		}
+		var str string
+		var strs []string
+		switch {
+		case string(value) == "null":
+		case json.Unmarshal(value, &str) == nil:
+			r.Form[key] = []string{str}
+		case json.Unmarshal(value, &strs) == nil:
+			r.Form[key] = strs
+		default:
+			r.Form[key] = []string{string(value)}
+		}
+	}
+	return messages, nil
+}
+
+var messageFieldPattern = regexp.MustCompile(`^messages\[([0-9]+)\]\[([a-zA-Z]+)\]$`)
+
+// parses the messages of the parameters messages[n][field] of the form, where field is
+// role, content, toolCallId or toolCalls (a JSON array). Returns nil if the form has no such parameters.
+func parseFormChatMessages(form url.Values) ([]chatMessage, error) {
+	messages := make(map[int]*chatMessage)
+	for key, values := range form {
+		if !strings.HasPrefix(key, "messages[") {
+			continue
+		}
+		match := messageFieldPattern.FindStringSubmatch(key)
+		if match == nil {
+			return nil, fmt.Errorf("invalid parameter '%s': expecting messages[n][role], messages[n][content], messages[n][toolCallId] or messages[n][toolCalls]", key)
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("%s is set %d times", key, len(values))
+		}
+		i, err := strconv.Atoi(match[1])
+		if err != nil || i >= maxFormMessages {
+			return nil, fmt.Errorf("invalid parameter '%s': the index must be less than %d", key, maxFormMessages)
+		}
+		if messages[i] == nil {
+			messages[i] = &chatMessage{}
+		}
+		value := values[0]
+		switch match[2] {
+		case "role":
+			messages[i].Role = value
+		case "content":
+			messages[i].Content = value
+		case "toolCallId":
+			messages[i].ToolCallID = value
+		case "toolCalls":
+			err := json.Unmarshal([]byte(value), &messages[i].ToolCalls)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid parameter '%s': unknown field '%s'", key, match[2])
+		}
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	list := make([]chatMessage, len(messages))
+	for i := range list {
+		if messages[i] == nil {
+			return nil, fmt.Errorf("messages[%d] is missing: the messages must be numbered from 0 without gaps", i)
+		}
+		list[i] = *messages[i]
+	}
+	return list, nil
+}
+
+// maximum number of messages of the parameters messages[n][field]
+const maxFormMessages = 10000
+
+// returns the merge policy of the parameter mergeMessages.
+func parseMergePolicy(value string) (conversation.MergePolicy, error) {
+	switch value {
+	case "", "false", "0":
+		return conversation.MergeNever, nil
+	case "true", "1":
+		return conversation.MergeConsecutive, nil
+	}
+	return 0, errors.New("mergeMessages must be true or false")
+}
+
+// returns the conversation of the messages with explicit roles.
+// If there are system messages, they replace the system prompt.
+// The last message must be a message of the user or the result of a tool call, so the assistant replies to it.
+func newChatConversation(messages []chatMessage, systemPrompt string, policy conversation.MergePolicy) (conversation.Conversation, error) {
+	if slices.ContainsFunc(messages, func(m chatMessage) bool { return conversation.Role(m.Role) == conversation.RoleSystem }) {
+		systemPrompt = ""
+	}
+	conv := conversation.NewConversation(systemPrompt)
+	for i, m := range messages {
+		if m.Role == "" {
+			return conv, fmt.Errorf("messages[%d]: the role is not set", i)
+		}
+		message := conversation.Message{Role: conversation.Role(m.Role), Text: m.Content, ToolCallID: m.ToolCallID}
+		for _, call := range m.ToolCalls {
+			message.ToolCalls = append(message.ToolCalls, conversation.ToolCall{ID: call.ID, Name: call.Name, Arguments: call.Arguments})
+		}
+		err := conv.Append(message, policy)
+		if err != nil {
+			return conv, fmt.Errorf("messages[%d]: %s", i, err)
+		}
+	}
+	messagesWithoutSystemPrompt := conv.MessagesWithoutSystemPrompt()
+	if len(messagesWithoutSystemPrompt) == 0 {
+		return conv, errors.New("messages: there are no user messages")
+	}
+	switch messagesWithoutSystemPrompt[len(messagesWithoutSystemPrompt)-1].Role {
+	case conversation.RoleUser, conversation.RoleTool:
+	default:
+		return conv, errors.New("messages: the last message must be a user or tool message")
+	}
+	return conv, nil
+}
+
+// returns the HTTP status code of an error of GeneratePrompt().
+// Jinja chat templates raise exceptions if they don't support the conversation, e.g. if the roles don't alternate,
+// which is an error of the client.
+func generatePromptErrorStatus(err error) int {
+	var exception *jinja.Exception
+	if errors.As(err, &exception) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// chatPrompt is the conversation of a /chat request, from which handlePrediction generates the prompt.
+type chatPrompt struct {
+	conv conversation.Conversation
+	// text appended to the prompt, so the reply of the assistant starts with it
+	replyPrefix string
+}
+
+// returns the prompt of the text the prompt template of the model generated.
+func (c *chatPrompt) prompt(model *Model, generated string) string {
+	prompt := generated
+	if model.AddsBOS {
+		prompt = model.PromptTemplate.TrimBOS(prompt)
+	}
+	if c.replyPrefix != "" {
+		if !strings.HasSuffix(prompt, "\n") {
+			prompt += " "
+		}
+		prompt += c.replyPrefix
+	}
+	return prompt
+}
+
+// generates the prompt with the prompt template of the model. The caller must have acquired the model.
+// The oldest messages are dropped if the prompt and the tokens to predict don't fit in the context of the model.
+func (c *chatPrompt) generate(model *Model, p predictor.Predictor, opts []llama.PredictOption) (generatedPrompt, error) {
+	dropped, tokens, err := model.fitConversation(p, &c.conv, opts, func(generated string) string {
+		return c.prompt(model, generated)
+	})
+	if err != nil {
+		return generatedPrompt{}, err
+	}
+	generated, err := c.conv.GeneratePrompt(model.PromptTemplate)
+	if err != nil {
+		return generatedPrompt{}, err
+	}
+	// fitConversation has counted the tokens of this prompt, so they are not counted again
+	return generatedPrompt{text: c.prompt(model, generated), tokens: tokens, droppedMessages: dropped}, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cmitsakis/llm-api/internal/llm/conversation"
+	llama "github.com/go-skynet/go-llama.cpp"
+)
+
+// promptLLM is a model that records the prompt it predicts from, so tests can check the prompt a request generated.
+type promptLLM struct {
+	fakeLLM
+	prompt *string
+}
+
+func (l promptLLM) Predict(text string, opts ...llama.PredictOption) (string, error) {
+	*l.prompt = text
+	return l.fakeLLM.Predict(text, opts...)
+}
+
+func TestReadJSONChatBody(t *testing.T) {
+	for _, test := range []struct {
+		body     string
+		messages []chatMessage
+		form     url.Values
+		err      string
+	}{
+		{`{"messages": [{"role": "user", "content": "hi"}], "temperature": 0.7, "stop": ["a", "b"], "seed": null}`,
+			[]chatMessage{{Role: "user", Content: "hi"}},
+			url.Values{"temperature": {"0.7"}, "stop": {"a", "b"}}, ""},
+		{`{"messages": [{"role": "tool", "content": "12:00", "toolCallId": "call_1"}]}`,
+			[]chatMessage{{Role: "tool", Content: "12:00", ToolCallID: "call_1"}}, url.Values{}, ""},
+		// an explicit empty array is not the same as no messages
+		{`{"messages": []}`, []chatMessage{}, url.Values{}, ""},
+		{`{"message": "hi"}`, nil, url.Values{"message": {"hi"}}, ""},
+		{`{"messages": [{"role": "user", "text": "hi"}]}`, nil, nil, `messages: json: unknown field "text"`},
+		{`{"messages": {"role": "user"}}`, nil, nil, "messages: json: cannot unmarshal object"},
+		{`{"messages": [`, nil, nil, "unexpected EOF"},
+	} {
+		r := httptest.NewRequest("POST", "/chat", strings.NewReader(test.body))
+		r.Form = url.Values{}
+		messages, err := readJSONChatBody(r)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				fmt.Printf("readJSONChatBody(%s) error = %v, expected %q\n", test.body, err, test.err)
+				t.Fail()
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Printf("readJSONChatBody(%s) failed: %s\n", test.body, err)
+			t.Fail()
+			continue
+		}
+		if !reflect.DeepEqual(messages, test.messages) {
+			fmt.Printf("readJSONChatBody(%s) = %#v, expected %#v\n", test.body, messages, test.messages)
+			t.Fail()
+		}
+		if !reflect.DeepEqual(r.Form, test.form) {
+			fmt.Printf("readJSONChatBody(%s) form = %v, expected %v\n", test.body, r.Form, test.form)
+			t.Fail()
+		}
+	}
+}
+
+func TestParseFormChatMessages(t *testing.T) {
+	for _, test := range []struct {
+		form     url.Values
+		messages []chatMessage
+		err      string
+	}{
+		{url.Values{"messages[0][role]": {"user"}, "messages[0][content]": {"hi"}, "messages[1][role]": {"assistant"}, "messages[1][toolCalls]": {`[{"id": "call_1", "name": "get_time", "arguments": "{}"}]`}},
+			[]chatMessage{{Role: "user", Content: "hi"}, {Role: "assistant", ToolCalls: []chatToolCall{{ID: "call_1", Name: "get_time", Arguments: "{}"}}}}, ""},
+		{url.Values{"messages[0][role]": {"tool"}, "messages[0][toolCallId]": {"call_1"}},
+			[]chatMessage{{Role: "tool", ToolCallID: "call_1"}}, ""},
+		// there are no messages with explicit roles
+		{url.Values{"message": {"hi"}}, nil, ""},
+		{url.Values{"messages[0][role]": {"user"}, "messages[2][role]": {"user"}}, nil, "messages[1] is missing"},
+		{url.Values{"messages[1][role]": {"user"}}, nil, "messages[0] is missing"},
+		{url.Values{"messages[10000][role]": {"user"}}, nil, "the index must be less than 10000"},
+		{url.Values{"messages[99999999999999999999][role]": {"user"}}, nil, "the index must be less than 10000"},
+		{url.Values{"messages[0][role]": {"user", "assistant"}}, nil, "messages[0][role] is set 2 times"},
+		{url.Values{"messages[0][text]": {"hi"}}, nil, "unknown field 'text'"},
+		{url.Values{"messages[0]": {"hi"}}, nil, "invalid parameter 'messages[0]'"},
+		{url.Values{"messages[-1][role]": {"user"}}, nil, "invalid parameter 'messages[-1][role]'"},
+		{url.Values{"messages[0][toolCalls]": {"{}"}}, nil, "messages[0][toolCalls]: json: cannot unmarshal object"},
+	} {
+		messages, err := parseFormChatMessages(test.form)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				fmt.Printf("parseFormChatMessages(%v) error = %v, expected %q\n", test.form, err, test.err)
+				t.Fail()
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Printf("parseFormChatMessages(%v) failed: %s\n", test.form, err)
+			t.Fail()
+			continue
+		}
+		if !reflect.DeepEqual(messages, test.messages) {
+			fmt.Printf("parseFormChatMessages(%v) = %#v, expected %#v\n", test.form, messages, test.messages)
+			t.Fail()
+		}
+	}
+}
+
+func TestNewChatConversation(t *testing.T) {
+	for _, test := range []struct {
+		messages     []chatMessage
+		systemPrompt string
+		policy       conversation.MergePolicy
+		expected     []conversation.Message
+		err          string
+	}{
+		{[]chatMessage{{Role: "user", Content: "hi"}}, "be nice", conversation.MergeNever,
+			[]conversation.Message{{Role: conversation.RoleSystem, Text: "be nice"}, {Role: conversation.RoleUser, Text: "hi"}}, ""},
+		// system messages replace the system prompt
+		{[]chatMessage{{Role: "system", Content: "be brief"}, {Role: "user", Content: "hi"}}, "be nice", conversation.MergeNever,
+			[]conversation.Message{{Role: conversation.RoleSystem, Text: "be brief"}, {Role: conversation.RoleUser, Text: "hi"}}, ""},
+		{[]chatMessage{{Role: "user", Content: "hi"}, {Role: "assistant", ToolCalls: []chatToolCall{{ID: "call_1", Name: "get_time", Arguments: "{}"}}}, {Role: "tool", Content: "12:00", ToolCallID: "call_1"}}, "", conversation.MergeNever,
+			[]conversation.Message{{Role: conversation.RoleUser, Text: "hi"}, {Role: conversation.RoleAssistant, ToolCalls: []conversation.ToolCall{{ID: "call_1", Name: "get_time", Arguments: "{}"}}}, {Role: conversation.RoleTool, Text: "12:00", ToolCallID: "call_1"}}, ""},
+		{[]chatMessage{{Role: "user", Content: "hi"}, {Role: "user", Content: "there"}}, "", conversation.MergeConsecutive,
+			[]conversation.Message{{Role: conversation.RoleUser, Text: "hi\nthere"}}, ""},
+		{[]chatMessage{{Role: "user", Content: "hi"}, {Role: "user", Content: "there"}}, "", conversation.MergeNever, nil, "messages[1]:"},
+		{[]chatMessage{{Content: "hi"}}, "", conversation.MergeNever, nil, "messages[0]: the role is not set"},
+		{[]chatMessage{{Role: "robot", Content: "hi"}}, "", conversation.MergeNever, nil, "messages[0]:"},
+		{[]chatMessage{}, "be nice", conversation.MergeNever, nil, "there are no user messages"},
+		{[]chatMessage{{Role: "system", Content: "be brief"}}, "", conversation.MergeNever, nil, "there are no user messages"},
+		{[]chatMessage{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "hello"}}, "", conversation.MergeNever, nil, "the last message must be a user or tool message"},
+	} {
+		conv, err := newChatConversation(test.messages, test.systemPrompt, test.policy)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				fmt.Printf("newChatConversation(%v) error = %v, expected %q\n", test.messages, err, test.err)
+				t.Fail()
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Printf("newChatConversation(%v) failed: %s\n", test.messages, err)
+			t.Fail()
+			continue
+		}
+		if !reflect.DeepEqual(conv.Messages, test.expected) {
+			fmt.Printf("newChatConversation(%v) = %#v, expected %#v\n", test.messages, conv.Messages, test.expected)
+			t.Fail()
+		}
+	}
+}
+
+func TestChatHandlerMessages(t *testing.T) {
+	var prompt string
+	mm, model := newTestModelWithLLM(t, promptLLM{prompt: &prompt})
+	model.PromptTemplate = conversation.PromptTemplateChatML
+	const expectedPrompt = "<|im_start|>system\nbe nice<|im_end|>\n<|im_start|>user\nhi<|im_end|>\n<|im_start|>assistant\n"
+	for _, test := range []struct {
+		query      string
+		jsonBody   string
+		statusCode int
+		// the prompt if the request succeeds, or the error
+		expected string
+	}{
+		{"system=be+nice&messages=hi", "", http.StatusOK, expectedPrompt},
+		{"system=be+nice&messages[0][role]=user&messages[0][content]=hi", "", http.StatusOK, expectedPrompt},
+		{"", `{"messages": [{"role": "system", "content": "be nice"}, {"role": "user", "content": "hi"}]}`, http.StatusOK, expectedPrompt},
+		{"system=be+nice&mergeMessages=true&messages[0][role]=user&messages[0][content]=h&messages[1][role]=user&messages[1][content]=i", "", http.StatusOK,
+			"<|im_start|>system\nbe nice<|im_end|>\n<|im_start|>user\nh\ni<|im_end|>\n<|im_start|>assistant\n"},
+		{"messages=hi&messages[0][role]=user&messages[0][content]=hi", "", http.StatusBadRequest, "messages can't be set both with and without roles"},
+		{"system=be+nice", `{"messages": [{"role": "system", "content": "be nice"}, {"role": "user", "content": "hi"}]}`, http.StatusBadRequest, "the system prompt can't be set both with the parameter system and with system messages"},
+		{"mergeMessages=maybe&messages[0][role]=user&messages[0][content]=hi", "", http.StatusBadRequest, "mergeMessages must be true or false"},
+		{"messages[0][role]=user&messages[0][content]=hi&messages[1][role]=assistant&messages[1][content]=hello", "", http.StatusBadRequest, "messages: the last message must be a user or tool message"},
+		{"", `{"messages": [{"role": "user", "content": "hi"}], "messages[0][role]": "user"}`, http.StatusOK, "<|im_start|>user\nhi<|im_end|>\n<|im_start|>assistant\n"},
+		{"", `{"messages": []}`, http.StatusBadRequest, "messages: there are no user messages"},
+		{"", `{"messages": [{"role": "user", "content": "hi", "name": "me"}]}`, http.StatusBadRequest, `failed to parse JSON body: messages: json: unknown field "name"`},
+	} {
+		var r *http.Request
+		if test.jsonBody != "" {
+			r = httptest.NewRequest("POST", "/chat?"+test.query, strings.NewReader(test.jsonBody))
+			r.Header.Set("Content-Type", "application/json")
+		} else {
+			r = httptest.NewRequest("POST", "/chat", strings.NewReader(test.query))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		prompt = ""
+		w := httptest.NewRecorder()
+		ChatHandler{Manager: mm}.ServeHTTP(w, r)
+		got := w.Body.String()
+		if w.Code == http.StatusOK {
+			got = prompt
+		}
+		if w.Code != test.statusCode || got != test.expected {
+			fmt.Printf("%s %s: response = %d %q, expected %d %q\n", test.query, test.jsonBody, w.Code, got, test.statusCode, test.expected)
+			t.Fail()
+		}
+	}
+}
+
+// the beginning-of-sequence token is removed from the prompt only if the tokenizer of the model adds it.
+func TestChatPromptBOS(t *testing.T) {
+	conv := conversation.Conversation{Messages: []conversation.Message{{Role: conversation.RoleSystem, Text: "be nice"}, {Role: conversation.RoleUser, Text: "hi"}}}
+	generated, err := conv.GeneratePrompt(conversation.PromptTemplateLlama2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		addsBOS     bool
+		replyPrefix string
+		expected    string
+	}{
+		{true, "", "[INST] <<SYS>>\nbe nice\n<</SYS>>\n\nhi [/INST]"},
+		{false, "", "<s>[INST] <<SYS>>\nbe nice\n<</SYS>>\n\nhi [/INST]"},
+		{true, "Sure,", "[INST] <<SYS>>\nbe nice\n<</SYS>>\n\nhi [/INST] Sure,"},
+	} {
+		model := &Model{PromptTemplate: conversation.PromptTemplateLlama2, AddsBOS: test.addsBOS}
+		c := &chatPrompt{conv: conv, replyPrefix: test.replyPrefix}
+		if got := c.prompt(model, generated); got != test.expected {
+			fmt.Printf("prompt() with AddsBOS %t = %q, expected %q\n", test.addsBOS, got, test.expected)
+			t.Fail()
+		}
+	}
+}
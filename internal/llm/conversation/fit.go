@@ -0,0 +1,71 @@
+package conversation
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrConversationTooLong is returned by Fit if the prompt doesn't fit in the budget,
+// even after all the messages that can be dropped are dropped.
+var ErrConversationTooLong = errors.New("the conversation doesn't fit in the context")
+
+// drops the oldest turns of the conversation until the prompt that promptTemplate generates is at most budget tokens long.
+// A turn is a message of the user together with the messages that follow it up to the next message of the user,
+// so the remaining messages still begin with a message of the user.
+// The system prompt and the last turn, which begins with the last message of the user, are never dropped.
+// countTokens returns the number of tokens of a prompt, as the tokenizer of the model splits it.
+// It returns the number of dropped messages and the number of tokens of the prompt of the remaining messages.
+func (c *Conversation) Fit(promptTemplate PromptTemplate, budget int, countTokens func(prompt string) (int, error)) (int, int, error) {
+	start := 0
+	if len(c.Messages) > 0 && c.Messages[0].Role == RoleSystem {
+		start = 1
+	}
+	// the conversation can be cut at the messages of the user. cuts[i] is the index of the first message that is kept if i+1 turns are dropped.
+	var cuts []int
+	for i := start + 1; i < len(c.Messages); i++ {
+		if c.Messages[i].Role == RoleUser {
+			cuts = append(cuts, i)
+		}
+	}
+	// returns the number of tokens of the prompt if the messages before the cut are dropped
+	promptTokens := func(cut int) (int, error) {
+		dropped := *c
+		dropped.Messages = append(c.Messages[:start:start], c.Messages[cut:]...)
+		prompt, err := dropped.GeneratePrompt(promptTemplate)
+		if err != nil {
+			return 0, err
+		}
+		return countTokens(prompt)
+	}
+	n, err := promptTokens(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n <= budget {
+		return 0, n, nil
+	}
+	if len(cuts) == 0 {
+		return 0, 0, fmt.Errorf("%w: the prompt is %d tokens long and the budget is %d tokens", ErrConversationTooLong, n, budget)
+	}
+	// the prompt is shorter when more turns are dropped, so the fewest turns to drop are found with binary search.
+	// The number of tokens of every evaluated cut is kept, so the tokens of the chosen cut don't have to be counted again.
+	tokens := make([]int, len(cuts))
+	var searchErr error
+	i := sort.Search(len(cuts), func(i int) bool {
+		if searchErr != nil {
+			return true
+		}
+		tokens[i], searchErr = promptTokens(cuts[i])
+		return tokens[i] <= budget
+	})
+	if searchErr != nil {
+		return 0, 0, searchErr
+	}
+	if i == len(cuts) {
+		// the last evaluated cut is the last one, which keeps only the last turn
+		return 0, 0, fmt.Errorf("%w: the prompt is %d tokens long without the older messages, and the budget is %d tokens", ErrConversationTooLong, tokens[i-1], budget)
+	}
+	c.Messages = append(c.Messages[:start:start], c.Messages[cuts[i]:]...)
+	return cuts[i] - start, tokens[i], nil
+}
@@ -0,0 +1,98 @@
+package conversation
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// delimiter of the front matter of prompt templates
+const frontMatterDelimiter = "---"
+
+// parses the front matter at the beginning of a prompt template, and returns the prompt template with the metadata it sets,
+// and the rest of the template. If the template doesn't begin with front matter, the metadata are not set.
+//
+// The front matter is between two lines "---", and every line in it sets a key with the syntax "key: value", e.g.
+//
+//	---
+//	stop: ["</s>", "USER:"]
+//	bosToken: <s>
+//	systemRole: false
+//	---
+//
+// Values are JSON. Strings can also be written without quotes, if they don't begin or end with spaces.
+func parseFrontMatter(src string) (PromptTemplate, string, error) {
+	var promptTemplate PromptTemplate
+	rest, ok := cutLine(src, frontMatterDelimiter)
+	if !ok {
+		return promptTemplate, src, nil
+	}
+	for lineNumber := 2; ; lineNumber++ {
+		if rest == "" {
+			return PromptTemplate{}, "", fmt.Errorf("front matter: line %d: missing closing %s", lineNumber, frontMatterDelimiter)
+		}
+		line, after, _ := strings.Cut(rest, "\n")
+		rest = after
+		line = strings.TrimSuffix(line, "\r")
+		if line == frontMatterDelimiter {
+			return promptTemplate, rest, nil
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return PromptTemplate{}, "", fmt.Errorf("front matter: line %d: expecting key: value", lineNumber)
+		}
+		err := promptTemplate.setMetadata(strings.TrimSpace(key), strings.TrimSpace(value))
+		if err != nil {
+			return PromptTemplate{}, "", fmt.Errorf("front matter: line %d: %s", lineNumber, err)
+		}
+	}
+}
+
+// returns the text after the first line if the first line is equal to line.
+func cutLine(s string, line string) (string, bool) {
+	first, rest, _ := strings.Cut(s, "\n")
+	if strings.TrimSuffix(first, "\r") != line {
+		return s, false
+	}
+	return rest, true
+}
+
+// sets the metadata of the key of the front matter.
+func (t *PromptTemplate) setMetadata(key string, value string) error {
+	var err error
+	switch key {
+	case "stop":
+		err = json.Unmarshal([]byte(value), &t.Stop)
+	case "bosToken":
+		t.BOSToken, err = frontMatterString(value)
+	case "eosToken":
+		t.EOSToken, err = frontMatterString(value)
+	case "assistantPrefix":
+		t.AssistantPrefix, err = frontMatterString(value)
+	case "systemRole":
+		var systemRole bool
+		err = json.Unmarshal([]byte(value), &systemRole)
+		t.NoSystemRole = !systemRole
+	case "requiresSystemPrompt":
+		err = json.Unmarshal([]byte(value), &t.RequiresSystemPrompt)
+	default:
+		return fmt.Errorf("unknown key '%s'", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value of '%s': %s", key, err)
+	}
+	return nil
+}
+
+// returns the string of a value of the front matter, which is a JSON string or the text without quotes.
+func frontMatterString(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, nil
+	}
+	var s string
+	err := json.Unmarshal([]byte(value), &s)
+	return s, err
+}
@@ -0,0 +1,97 @@
+package conversation
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"cmitsakis/llm-api/internal/llm/jinja"
+)
+
+// creates a prompt template from a Jinja chat template, in the format of the chat_template of Hugging Face.
+// The template can begin with front matter that sets the metadata of the prompt template.
+func NewJinjaPromptTemplate(promptTemplateString string) (PromptTemplate, error) {
+	promptTemplate, body, err := parseFrontMatter(promptTemplateString)
+	if err != nil {
+		return PromptTemplate{}, err
+	}
+	promptTemplate.jinja, err = jinja.Parse(body)
+	if err != nil {
+		return PromptTemplate{}, fmt.Errorf("failed to parse Jinja prompt template: %w", err)
+	}
+	return promptTemplate, nil
+}
+
+// renders the Jinja template with the variables that chat templates expect:
+// messages, tools, add_generation_prompt, bos_token and eos_token.
+func (c Conversation) generatePromptJinja(promptTemplate PromptTemplate) (string, error) {
+	messages := make([]map[string]any, 0, len(c.Messages))
+	for _, m := range c.Messages {
+		message := map[string]any{"role": string(m.Role), "content": m.Text}
+		if len(m.ToolCalls) > 0 {
+			toolCalls := make([]any, 0, len(m.ToolCalls))
+			for _, call := range m.ToolCalls {
+				toolCalls = append(toolCalls, call.jinjaValue())
+			}
+			message["tool_calls"] = toolCalls
+		}
+		if m.Role == RoleTool {
+			message["tool_call_id"] = m.ToolCallID
+		}
+		messages = append(messages, message)
+	}
+	// like Hugging Face, tools is none if there are no tools
+	var tools any
+	if len(c.Tools) > 0 {
+		list := make([]any, 0, len(c.Tools))
+		for _, tool := range c.Tools {
+			list = append(list, tool.jinjaValue())
+		}
+		tools = list
+	}
+	vars := map[string]any{
+		"messages":              messages,
+		"tools":                 tools,
+		"add_generation_prompt": true,
+		"bos_token":             promptTemplate.BOSToken,
+		"eos_token":             promptTemplate.EOSToken,
+	}
+	prompt, err := promptTemplate.jinja.Render(vars)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute prompt template: %w", err)
+	}
+	return prompt, nil
+}
+
+// returns the tool in the format of OpenAI, which chat templates expect.
+// It's JSON, so the keys keep their order when the template renders it with the filter tojson.
+func (t Tool) jinjaValue() json.RawMessage {
+	type function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	}
+	b, _ := json.Marshal(struct {
+		Type     string   `json:"type"`
+		Function function `json:"function"`
+	}{"function", function{t.Name, t.Description, t.Parameters}})
+	return b
+}
+
+// returns the tool call in the format of OpenAI, which chat templates expect,
+// except that the arguments are an object instead of a string, like the arguments Hugging Face passes to chat templates.
+func (c ToolCall) jinjaValue() json.RawMessage {
+	arguments := json.RawMessage(c.Arguments)
+	if !json.Valid(arguments) {
+		arguments, _ = json.Marshal(c.Arguments)
+	}
+	type function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	b, _ := json.Marshal(struct {
+		ID       string   `json:"id"`
+		Type     string   `json:"type"`
+		Function function `json:"function"`
+	}{c.ID, "function", function{c.Name, arguments}})
+	return b
+}
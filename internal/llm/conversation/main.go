@@ -2,11 +2,15 @@ package conversation
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"text/template"
 	"unicode"
+
+	"cmitsakis/llm-api/internal/llm/jinja"
 )
 
 type Role string
@@ -15,16 +19,64 @@ const (
 	RoleSystem    Role = "system"
 	RoleUser      Role = "user"
 	RoleAssistant Role = "assistant"
+	// result of a tool call
+	RoleTool Role = "tool"
 )
 
 type Message struct {
 	Role Role
 	Text string
+	// tools the assistant calls, if Role is RoleAssistant
+	ToolCalls []ToolCall
+	// ID of the tool call this message is the result of, if Role is RoleTool
+	ToolCallID string
+}
+
+// Tool is a function the assistant can call.
+type Tool struct {
+	Name        string
+	Description string
+	// JSON Schema of the arguments
+	Parameters json.RawMessage
+}
+
+// returns the definition of the tool in JSON, as it's rendered in the prompt.
+func (t Tool) JSON() string {
+	b, _ := json.Marshal(struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	}{t.Name, t.Description, t.Parameters})
+	return string(b)
+}
+
+// ToolCall is a call of a tool by the assistant.
+type ToolCall struct {
+	ID   string
+	Name string
+	// JSON object
+	Arguments string
+}
+
+// returns the tool call in JSON, as the assistant generates it.
+func (c ToolCall) JSON() string {
+	arguments := json.RawMessage(c.Arguments)
+	if !json.Valid(arguments) {
+		// the arguments are rendered as a string, so the JSON is valid
+		arguments, _ = json.Marshal(c.Arguments)
+	}
+	b, _ := json.Marshal(struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}{c.Name, arguments})
+	return string(b)
 }
 
 type Conversation struct {
 	SystemPrompt string
 	Messages     []Message
+	// tools the assistant can call
+	Tools []Tool
 }
 
 func NewConversation(systemPrompt string) Conversation {
@@ -135,6 +187,144 @@ func (c *Conversation) SetLastMessageOfAssistant(text string) {
 	c.Messages = append(c.Messages, Message{Role: RoleAssistant, Text: text})
 }
 
+// adds tool calls to the last message of the assistant, or to a new message of the assistant.
+func (c *Conversation) AddToolCalls(calls []ToolCall) {
+	lastIndex := len(c.Messages) - 1
+	if lastIndex >= 0 && c.Messages[lastIndex].Role == RoleAssistant {
+		c.Messages[lastIndex].ToolCalls = append(c.Messages[lastIndex].ToolCalls, calls...)
+		return
+	}
+	c.Messages = append(c.Messages, Message{Role: RoleAssistant, ToolCalls: calls})
+}
+
+// adds the result of the tool call with the given ID.
+func (c *Conversation) AddMessageTool(toolCallID string, text string) {
+	c.Messages = append(c.Messages, Message{Role: RoleTool, Text: text, ToolCallID: toolCallID})
+}
+
+// MergePolicy decides what Append does with a message that has the same role as the previous message.
+type MergePolicy int
+
+const (
+	// the message is rejected
+	MergeNever MergePolicy = iota
+	// the message is merged into the previous message, separated by a newline
+	MergeConsecutive
+)
+
+// appends the message to the conversation, after validating it follows the previous messages.
+// Messages of the system must be at the beginning of the conversation, and they are joined into the system prompt.
+// Messages of tools must follow a message of the assistant with tool calls, or another message of a tool,
+// and their ToolCallID must be the ID of one of those calls, if it's set.
+// Consecutive messages of the user or of the assistant are handled according to policy.
+func (c *Conversation) Append(m Message, policy MergePolicy) error {
+	var previous *Message
+	if len(c.Messages) > 0 {
+		previous = &c.Messages[len(c.Messages)-1]
+	}
+	if len(m.ToolCalls) > 0 && m.Role != RoleAssistant {
+		return errors.New("only assistant messages can have tool calls")
+	}
+	if m.ToolCallID != "" && m.Role != RoleTool {
+		return errors.New("only tool messages can have a tool call ID")
+	}
+	switch m.Role {
+	case RoleSystem:
+		if previous != nil && previous.Role != RoleSystem {
+			return errors.New("system messages must be at the beginning of the conversation")
+		}
+		if previous != nil {
+			c.SetSystemPrompt(c.SystemPrompt + "\n" + m.Text)
+		} else {
+			c.SetSystemPrompt(m.Text)
+		}
+		return nil
+	case RoleUser, RoleAssistant:
+		if m.Text == "" && len(m.ToolCalls) == 0 {
+			return errors.New("the content is empty")
+		}
+		if previous == nil || previous.Role != m.Role {
+			c.Messages = append(c.Messages, m)
+			return nil
+		}
+		if policy != MergeConsecutive {
+			return fmt.Errorf("a %s message can't follow another %s message", m.Role, m.Role)
+		}
+		if previous.Text != "" && m.Text != "" {
+			previous.Text += "\n"
+		}
+		previous.Text += m.Text
+		previous.ToolCalls = append(previous.ToolCalls, m.ToolCalls...)
+		return nil
+	case RoleTool:
+		// the message of the assistant with the tool calls is before the results of the other calls
+		i := len(c.Messages) - 1
+		for i >= 0 && c.Messages[i].Role == RoleTool {
+			i--
+		}
+		if i < 0 || c.Messages[i].Role != RoleAssistant || len(c.Messages[i].ToolCalls) == 0 {
+			return errors.New("a tool message must follow an assistant message with tool calls")
+		}
+		if m.ToolCallID != "" && !slices.ContainsFunc(c.Messages[i].ToolCalls, func(call ToolCall) bool { return call.ID == m.ToolCallID }) {
+			return fmt.Errorf("the previous assistant message has no tool call with ID '%s'", m.ToolCallID)
+		}
+		c.Messages = append(c.Messages, m)
+		return nil
+	}
+	return fmt.Errorf("unknown role '%s'", m.Role)
+}
+
+var errUnterminatedToolCall = errors.New("<tool_call> without </tool_call>")
+
+// parses the tool calls of a message of the assistant.
+// The assistant calls a tool with a JSON object with the name and the arguments of the tool inside <tool_call></tool_call> tags,
+// as the prompt templates instruct it.
+// Returns the text outside the tags, and the tool calls, which have no ID.
+func ParseToolCalls(text string) (string, []ToolCall, error) {
+	var content strings.Builder
+	var calls []ToolCall
+	for {
+		start := strings.Index(text, "<tool_call>")
+		if start < 0 {
+			content.WriteString(text)
+			break
+		}
+		content.WriteString(text[:start])
+		text = text[start+len("<tool_call>"):]
+		end := strings.Index(text, "</tool_call>")
+		if end < 0 {
+			return "", nil, errUnterminatedToolCall
+		}
+		var call struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		err := json.Unmarshal([]byte(text[:end]), &call)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid tool call: %w", err)
+		}
+		if call.Name == "" {
+			return "", nil, errors.New("invalid tool call: no name")
+		}
+		arguments := "{}"
+		var str string
+		switch {
+		case len(call.Arguments) == 0 || string(call.Arguments) == "null":
+		case json.Unmarshal(call.Arguments, &str) == nil:
+			// some models generate the arguments as a JSON string
+			arguments = str
+		default:
+			compacted := &bytes.Buffer{}
+			// the arguments are valid JSON, because they were unmarshaled
+			json.Compact(compacted, call.Arguments)
+			arguments = compacted.String()
+		}
+		calls = append(calls, ToolCall{Name: call.Name, Arguments: arguments})
+		text = text[end+len("</tool_call>"):]
+	}
+	return strings.TrimSpace(content.String()), calls, nil
+}
+
 // left-trims space from the token if str is the empty string, and appends the possibly trimmed token to str.
 // This function typically is called repeatedly for several tokens on the same str string that accumulates the tokens.
 // The purpose of this function is to make sure str has no leading space characters.
@@ -158,48 +348,195 @@ func (c *Conversation) AppendTokenToLastMessageAssistant(token string) string {
 	return tokenTrimmed
 }
 
+// PromptTemplate is a Go template that defines the template "prompt", or a Jinja chat template,
+// together with the metadata of its prompt format.
 type PromptTemplate struct {
 	*template.Template
 	RequiresSystemPrompt bool
+	// Jinja template, if the prompt template is a Jinja chat template instead of a Go template
+	jinja *jinja.Template
+	// texts of the beginning-of-sequence and end-of-sequence tokens, which are the variables bos_token and eos_token of Jinja templates.
+	// If the tokenizer of the model adds the beginning-of-sequence token, TrimBOS removes its text from the beginning of the prompt.
+	// The end-of-sequence token is one of the stop sequences.
+	BOSToken string
+	EOSToken string
+	// stop sequences that end the turn of the assistant
+	Stop []string
+	// true if the format doesn't have a system role, so the system prompt is put at the beginning of the first message of the user
+	NoSystemRole bool
+	// text appended to the prompt, so the reply of the assistant starts with it
+	AssistantPrefix string
+}
+
+// returns true if the prompt template is not set.
+func (t PromptTemplate) IsZero() bool {
+	return t.Template == nil && t.jinja == nil
+}
+
+// returns true if the prompt template is a Jinja chat template.
+func (t PromptTemplate) IsJinja() bool {
+	return t.jinja != nil
+}
+
+// returns the stop sequences of the prompt format, including the end-of-sequence token.
+func (t PromptTemplate) StopSequences() []string {
+	if t.EOSToken == "" || slices.Contains(t.Stop, t.EOSToken) {
+		return t.Stop
+	}
+	return append(t.Stop[:len(t.Stop):len(t.Stop)], t.EOSToken)
+}
+
+// removes the beginning-of-sequence token from the beginning of the prompt.
+// It's used if the tokenizer adds the token, because its text would be tokenized as plain text after it.
+func (t PromptTemplate) TrimBOS(prompt string) string {
+	if t.BOSToken == "" {
+		return prompt
+	}
+	return strings.TrimPrefix(prompt, t.BOSToken)
+}
+
+// templates that render the tools, the tool calls and the results of the tool calls.
+// They are defined in every prompt template, so custom prompt templates can use them too:
+// "tools" with the conversation, "toolCalls" with a message of the assistant, and "toolResult" with a message of a tool.
+// "systemPrompt" renders the system prompt followed by the tools, and "userText" renders a message of the user or a tool.
+const promptTemplateStringTools = `
+{{define "tools" -}}
+You can call the following tools. To call a tool, respond with a JSON object with the name of the tool and its arguments inside <tool_call></tool_call> tags:
+<tool_call>
+{"name": "tool name", "arguments": {"argument name": "argument value"}}
+</tool_call>
+The results of the tool calls are returned inside <tool_response></tool_response> tags.
+Tools:
+{{- range .Tools}}
+{{.JSON}}
+{{- end}}
+{{- end}}
+{{define "toolCalls"}}{{range $i, $call := .ToolCalls}}{{if or $i $.Text}}
+{{end}}<tool_call>
+{{$call.JSON}}
+</tool_call>{{end}}{{end}}
+{{define "toolResult" -}}
+<tool_response>
+{{.Text}}
+</tool_response>
+{{- end}}
+{{define "systemPrompt"}}{{.SystemPrompt}}{{if .Tools}}{{if .SystemPrompt}}
+
+{{end}}{{template "tools" .}}{{end}}{{end}}
+{{define "userText"}}{{if eq .Role "tool"}}{{template "toolResult" .}}{{else}}{{.Text}}{{end}}{{end}}
+`
+
+// returns a new template with the given name, in which the tool templates are defined.
+func newTemplate(name string) *template.Template {
+	return template.Must(template.New(name).Parse(promptTemplateStringTools))
 }
 
+// creates a prompt template from a Go template that defines the template "prompt".
+// The template can begin with front matter that sets the metadata of the prompt template.
 func NewPromptTemplate(promptTemplateString string) (PromptTemplate, error) {
-	t, err := template.New("promptTemplate").Parse(promptTemplateString)
+	promptTemplate, body, err := parseFrontMatter(promptTemplateString)
+	if err != nil {
+		return PromptTemplate{}, err
+	}
+	promptTemplate.Template, err = newTemplate("promptTemplate").Parse(body)
 	if err != nil {
 		return PromptTemplate{}, fmt.Errorf("failed to parse prompt template: %w", err)
 	}
-	return PromptTemplate{t, false}, nil
+	return promptTemplate, nil
 }
 
 const promptTemplateStringLlama2 = `
 {{define "prompt" -}}
 <s>{{range $i, $m := .Messages}}{{if eq $m.Role "system"}}[INST] <<SYS>>
-{{$m.Text}}
+{{$m.Text}}{{if $.Tools}}
+
+{{template "tools" $}}{{end}}
 <</SYS>>
 
-{{else if eq $i 1 -}}
+{{else if and (eq $i 1) (eq $m.Role "user") -}}
 {{$m.Text}} [/INST]
-{{- else if eq $m.Role "assistant" }} {{$m.Text}} </s><s>
+{{- else if and (eq $i 1) (eq $m.Role "assistant") }} [/INST] {{$m.Text}}{{template "toolCalls" $m}} </s><s>
+{{- else if eq $m.Role "assistant" }} {{$m.Text}}{{template "toolCalls" $m}} </s><s>
 {{- else if eq $m.Role "user" -}}
 [INST] {{$m.Text}} [/INST]
+{{- else if eq $m.Role "tool" -}}
+[INST] {{template "toolResult" $m}} [/INST]
 {{- end}}
 {{- end}}
 {{- end}}
 `
 
-var PromptTemplateLlama2 = PromptTemplate{template.Must(template.New("llama-2").Parse(promptTemplateStringLlama2)), true}
+var PromptTemplateLlama2 = PromptTemplate{
+	Template:             template.Must(newTemplate("llama-2").Parse(promptTemplateStringLlama2)),
+	RequiresSystemPrompt: true,
+	BOSToken:             "<s>",
+	EOSToken:             "</s>",
+	Stop:                 []string{"[INST]"},
+}
 
 const promptTemplateStringVicunaV11 = `
-{{define "prompt"}}A chat between a curious user and an artificial intelligence assistant. The assistant gives helpful, detailed, and polite answers to the user's questions. {{range $i, $m := .MessagesWithoutSystemPrompt}}{{if eq $m.Role "user" }}{{if gt $i 1 }}</s>{{end}}USER: {{$m.Text}}{{else if eq $m.Role "assistant" }} ASSISTANT: {{$m.Text}}{{end}}{{end}} ASSISTANT:{{end}}
+{{define "prompt"}}A chat between a curious user and an artificial intelligence assistant. The assistant gives helpful, detailed, and polite answers to the user's questions. {{if .Tools}}{{template "tools" .}}
+
+{{end}}{{range $i, $m := .MessagesWithoutSystemPrompt}}{{if eq $m.Role "user" }}{{if gt $i 1 }}</s>{{end}}USER: {{$m.Text}}{{else if eq $m.Role "tool" }}{{if gt $i 1 }}</s>{{end}}USER: {{template "toolResult" $m}}{{else if eq $m.Role "assistant" }} ASSISTANT: {{$m.Text}}{{template "toolCalls" $m}}{{end}}{{end}} ASSISTANT:{{end}}
 `
 
-var PromptTemplateVicunaV11 = PromptTemplate{template.Must(template.New("vicuna_v1.1").Parse(promptTemplateStringVicunaV11)), false}
+var PromptTemplateVicunaV11 = PromptTemplate{
+	Template: template.Must(newTemplate("vicuna_v1.1").Parse(promptTemplateStringVicunaV11)),
+	EOSToken: "</s>",
+	Stop:     []string{"USER:"},
+}
 
 func (c Conversation) GeneratePrompt(promptTemplate PromptTemplate) (string, error) {
+	if promptTemplate.NoSystemRole {
+		var err error
+		c, err = c.withSystemPromptInFirstMessageOfUser(promptTemplate)
+		if err != nil {
+			return "", err
+		}
+	}
+	if promptTemplate.jinja != nil {
+		prompt, err := c.generatePromptJinja(promptTemplate)
+		if err != nil {
+			return "", err
+		}
+		return prompt + promptTemplate.AssistantPrefix, nil
+	}
 	buf := &bytes.Buffer{}
 	err := promptTemplate.ExecuteTemplate(buf, "prompt", c)
 	if err != nil {
 		return "", fmt.Errorf("failed to execute prompt template: %w", err)
 	}
-	return buf.String(), nil
+	return buf.String() + promptTemplate.AssistantPrefix, nil
+}
+
+// returns a copy of the conversation without system prompt, in which the system prompt is at the beginning of the first message of the user.
+// Go templates render the tools after the system prompt with the template "systemPrompt",
+// so the tools are rendered in the first message of the user too, and the copy has no tools.
+func (c Conversation) withSystemPromptInFirstMessageOfUser(promptTemplate PromptTemplate) (Conversation, error) {
+	systemPrompt := ""
+	if len(c.Messages) > 0 && c.Messages[0].Role == RoleSystem {
+		systemPrompt = c.Messages[0].Text
+	}
+	withoutSystemPrompt := Conversation{Messages: slices.Clone(c.MessagesWithoutSystemPrompt()), Tools: c.Tools}
+	if promptTemplate.jinja == nil {
+		buf := &bytes.Buffer{}
+		err := promptTemplate.ExecuteTemplate(buf, "systemPrompt", c)
+		if err != nil {
+			return Conversation{}, fmt.Errorf("failed to execute prompt template: %w", err)
+		}
+		systemPrompt = buf.String()
+		withoutSystemPrompt.Tools = nil
+	}
+	if systemPrompt == "" {
+		return withoutSystemPrompt, nil
+	}
+	messages := withoutSystemPrompt.Messages
+	i := slices.IndexFunc(messages, func(m Message) bool { return m.Role == RoleUser })
+	if i >= 0 {
+		messages[i].Text = systemPrompt + "\n\n" + messages[i].Text
+	} else {
+		messages = slices.Insert(messages, 0, Message{Role: RoleUser, Text: systemPrompt})
+	}
+	withoutSystemPrompt.Messages = messages
+	return withoutSystemPrompt, nil
 }
@@ -1,8 +1,11 @@
 package conversation
 
 import (
+	"errors"
 	"fmt"
 	"testing"
+
+	"cmitsakis/llm-api/internal/llm/jinja"
 )
 
 func TestAppendTokenToLastMessageAssistant(t *testing.T) {
@@ -82,3 +85,619 @@ func testPrompt(t *testing.T, c Conversation, promptTemplate PromptTemplate, exp
 		t.Fail()
 	}
 }
+
+func TestGeneratePromptTools(t *testing.T) {
+	c := NewConversation("{{ system_prompt }}")
+	c.Tools = []Tool{{Name: "get_weather", Description: "Get the weather of a city", Parameters: []byte(`{"type":"object","properties":{"city":{"type":"string"}}}`)}}
+	c.AddMessageUser("{{ user_msg_1 }}")
+	c.AddToolCalls([]ToolCall{{ID: "call_1", Name: "get_weather", Arguments: `{"city":"Athens"}`}})
+	c.AddMessageTool("call_1", "{{ tool_result_1 }}")
+	tools := `You can call the following tools. To call a tool, respond with a JSON object with the name of the tool and its arguments inside <tool_call></tool_call> tags:
+<tool_call>
+{"name": "tool name", "arguments": {"argument name": "argument value"}}
+</tool_call>
+The results of the tool calls are returned inside <tool_response></tool_response> tags.
+Tools:
+{"name":"get_weather","description":"Get the weather of a city","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}`
+	testPrompt(t, c, PromptTemplateLlama2, `<s>[INST] <<SYS>>
+{{ system_prompt }}
+
+`+tools+`
+<</SYS>>
+
+{{ user_msg_1 }} [/INST] <tool_call>
+{"name":"get_weather","arguments":{"city":"Athens"}}
+</tool_call> </s><s>[INST] <tool_response>
+{{ tool_result_1 }}
+</tool_response> [/INST]`)
+	testPrompt(t, c, PromptTemplateVicunaV11, `A chat between a curious user and an artificial intelligence assistant. The assistant gives helpful, detailed, and polite answers to the user's questions. `+tools+`
+
+USER: {{ user_msg_1 }} ASSISTANT: <tool_call>
+{"name":"get_weather","arguments":{"city":"Athens"}}
+</tool_call></s>USER: <tool_response>
+{{ tool_result_1 }}
+</tool_response> ASSISTANT:`)
+}
+
+func TestParseToolCalls(t *testing.T) {
+	text, calls, err := ParseToolCalls(`Let me check.
+<tool_call>
+{"name": "get_weather", "arguments": {"city": "Athens"}}
+</tool_call>
+<tool_call>{"name": "get_time", "arguments": "{\"zone\": \"UTC\"}"}</tool_call>`)
+	if err != nil {
+		fmt.Printf("ParseToolCalls() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	if text != "Let me check." {
+		fmt.Printf("text = %q\n", text)
+		t.Fail()
+	}
+	expected := []ToolCall{{Name: "get_weather", Arguments: `{"city":"Athens"}`}, {Name: "get_time", Arguments: `{"zone": "UTC"}`}}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		fmt.Printf("calls = %+v, expected %+v\n", calls, expected)
+		t.Fail()
+	}
+	for _, invalid := range []string{
+		`<tool_call>{"name": "get_weather"`,
+		`<tool_call>{"arguments": {}}</tool_call>`,
+		`<tool_call>get_weather()</tool_call>`,
+	} {
+		_, _, err := ParseToolCalls(invalid)
+		if err == nil {
+			fmt.Printf("ParseToolCalls(%q) succeeded\n", invalid)
+			t.Fail()
+		}
+	}
+	text, calls, err = ParseToolCalls(" no calls ")
+	if err != nil || text != "no calls" || calls != nil {
+		fmt.Printf("ParseToolCalls() = %q, %v, %v\n", text, calls, err)
+		t.Fail()
+	}
+}
+
+func TestAppend(t *testing.T) {
+	c := NewConversation("")
+	for _, m := range []Message{
+		{Role: RoleSystem, Text: "{{ system_prompt_1 }}"},
+		{Role: RoleSystem, Text: "{{ system_prompt_2 }}"},
+		{Role: RoleAssistant, Text: "{{ assistant_msg_1 }}"},
+		{Role: RoleUser, Text: "{{ user_msg_1 }}"},
+	} {
+		err := c.Append(m, MergeNever)
+		if err != nil {
+			fmt.Printf("Append(%+v) failed: %s\n", m, err)
+			t.Fail()
+			return
+		}
+	}
+	testPrompt(t, c, PromptTemplateLlama2, `<s>[INST] <<SYS>>
+{{ system_prompt_1 }}
+{{ system_prompt_2 }}
+<</SYS>>
+
+ [/INST] {{ assistant_msg_1 }} </s><s>[INST] {{ user_msg_1 }} [/INST]`)
+
+	for _, test := range []struct {
+		message Message
+		err     string
+	}{
+		{Message{Role: RoleUser, Text: "{{ user_msg_2 }}"}, "a user message can't follow another user message"},
+		{Message{Role: RoleSystem, Text: "{{ system_prompt_3 }}"}, "system messages must be at the beginning of the conversation"},
+		{Message{Role: RoleTool, Text: "{{ tool_result_1 }}"}, "a tool message must follow an assistant message with tool calls"},
+		{Message{Role: RoleUser, Text: "{{ user_msg_2 }}", ToolCallID: "call_1"}, "only tool messages can have a tool call ID"},
+		{Message{Role: "bot", Text: "{{ bot_msg_1 }}"}, "unknown role 'bot'"},
+		{Message{Role: RoleAssistant}, "the content is empty"},
+	} {
+		err := c.Append(test.message, MergeNever)
+		if err == nil || err.Error() != test.err {
+			fmt.Printf("Append(%+v) error = %v, expected %s\n", test.message, err, test.err)
+			t.Fail()
+		}
+	}
+
+	err := c.Append(Message{Role: RoleUser, Text: "{{ user_msg_2 }}"}, MergeConsecutive)
+	if err != nil || c.Messages[len(c.Messages)-1].Text != "{{ user_msg_1 }}\n{{ user_msg_2 }}" {
+		fmt.Printf("Append() with MergeConsecutive: %v, %+v\n", err, c.Messages)
+		t.Fail()
+	}
+
+	_ = c.Append(Message{Role: RoleAssistant, ToolCalls: []ToolCall{{ID: "call_1", Name: "f", Arguments: "{}"}}}, MergeNever)
+	err = c.Append(Message{Role: RoleTool, Text: "{{ tool_result_1 }}", ToolCallID: "call_2"}, MergeNever)
+	if err == nil || err.Error() != "the previous assistant message has no tool call with ID 'call_2'" {
+		fmt.Printf("Append() of tool message with unknown ID: %v\n", err)
+		t.Fail()
+	}
+	for _, id := range []string{"call_1", ""} {
+		err = c.Append(Message{Role: RoleTool, Text: "{{ tool_result_1 }}", ToolCallID: id}, MergeNever)
+		if err != nil {
+			fmt.Printf("Append() of tool message failed: %s\n", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestGeneratePromptBuiltin(t *testing.T) {
+	c := NewConversation("{{ system_prompt }}")
+	c.AddMessageUser("{{ user_msg_1 }}")
+	c.AddMessageAssistant("{{ assistant_msg_1 }}")
+	c.AddMessageUser("{{ user_msg_2 }}")
+	for _, test := range []struct {
+		name   string
+		prompt string
+	}{
+		{"chatml", `<|im_start|>system
+{{ system_prompt }}<|im_end|>
+<|im_start|>user
+{{ user_msg_1 }}<|im_end|>
+<|im_start|>assistant
+{{ assistant_msg_1 }}<|im_end|>
+<|im_start|>user
+{{ user_msg_2 }}<|im_end|>
+<|im_start|>assistant
+`},
+		{"mistral", `<s>[INST] {{ system_prompt }}
+
+{{ user_msg_1 }} [/INST] {{ assistant_msg_1 }}</s>[INST] {{ user_msg_2 }} [/INST]`},
+		{"zephyr", `<|system|>
+{{ system_prompt }}</s>
+<|user|>
+{{ user_msg_1 }}</s>
+<|assistant|>
+{{ assistant_msg_1 }}</s>
+<|user|>
+{{ user_msg_2 }}</s>
+<|assistant|>
+`},
+		{"alpaca", `{{ system_prompt }}
+
+### Instruction:
+{{ user_msg_1 }}
+
+### Response:
+{{ assistant_msg_1 }}
+
+### Instruction:
+{{ user_msg_2 }}
+
+### Response:
+`},
+		{"openchat", `<s>GPT4 Correct System: {{ system_prompt }}<|end_of_turn|>GPT4 Correct User: {{ user_msg_1 }}<|end_of_turn|>GPT4 Correct Assistant: {{ assistant_msg_1 }}<|end_of_turn|>GPT4 Correct User: {{ user_msg_2 }}<|end_of_turn|>GPT4 Correct Assistant:`},
+		{"orca", `### System:
+{{ system_prompt }}
+
+### User:
+{{ user_msg_1 }}
+
+### Assistant:
+{{ assistant_msg_1 }}
+
+### User:
+{{ user_msg_2 }}
+
+### Assistant:
+`},
+		{"phi-3", `<|system|>
+{{ system_prompt }}<|end|>
+<|user|>
+{{ user_msg_1 }}<|end|>
+<|assistant|>
+{{ assistant_msg_1 }}<|end|>
+<|user|>
+{{ user_msg_2 }}<|end|>
+<|assistant|>
+`},
+		{"gemma", `<bos><start_of_turn>user
+{{ system_prompt }}
+
+{{ user_msg_1 }}<end_of_turn>
+<start_of_turn>model
+{{ assistant_msg_1 }}<end_of_turn>
+<start_of_turn>user
+{{ user_msg_2 }}<end_of_turn>
+<start_of_turn>model
+`},
+		{"llama-3", `<|begin_of_text|><|start_header_id|>system<|end_header_id|>
+
+{{ system_prompt }}<|eot_id|><|start_header_id|>user<|end_header_id|>
+
+{{ user_msg_1 }}<|eot_id|><|start_header_id|>assistant<|end_header_id|>
+
+{{ assistant_msg_1 }}<|eot_id|><|start_header_id|>user<|end_header_id|>
+
+{{ user_msg_2 }}<|eot_id|><|start_header_id|>assistant<|end_header_id|>
+
+`},
+	} {
+		promptTemplate, ok := LookupPromptTemplate(test.name)
+		if !ok {
+			fmt.Printf("prompt template %s not found\n", test.name)
+			t.Fail()
+			continue
+		}
+		testPrompt(t, c, promptTemplate, test.prompt)
+	}
+}
+
+func TestGeneratePromptBuiltinWithoutSystemPrompt(t *testing.T) {
+	c := NewConversation("")
+	c.AddMessageUser("{{ user_msg_1 }}")
+	testPrompt(t, c, PromptTemplateChatML, `<|im_start|>user
+{{ user_msg_1 }}<|im_end|>
+<|im_start|>assistant
+`)
+	testPrompt(t, c, PromptTemplateMistral, `<s>[INST] {{ user_msg_1 }} [/INST]`)
+	testPrompt(t, c, PromptTemplateAlpaca, `Below is an instruction that describes a task. Write a response that appropriately completes the request.
+
+### Instruction:
+{{ user_msg_1 }}
+
+### Response:
+`)
+}
+
+// formats without a system role put the system prompt in the first message of the user, even if the conversation starts with a message of the assistant
+func TestGeneratePromptBuiltinStartsWithAssistant(t *testing.T) {
+	c := NewConversation("{{ system_prompt }}")
+	c.AddMessageAssistant("{{ assistant_msg_1 }}")
+	c.AddMessageUser("{{ user_msg_1 }}")
+	testPrompt(t, c, PromptTemplateMistral, `<s> {{ assistant_msg_1 }}</s>[INST] {{ system_prompt }}
+
+{{ user_msg_1 }} [/INST]`)
+	testPrompt(t, c, PromptTemplateGemma, `<bos><start_of_turn>model
+{{ assistant_msg_1 }}<end_of_turn>
+<start_of_turn>user
+{{ system_prompt }}
+
+{{ user_msg_1 }}<end_of_turn>
+<start_of_turn>model
+`)
+	c = NewConversation("{{ system_prompt }}")
+	c.AddMessageAssistant("{{ assistant_msg_1 }}")
+	testPrompt(t, c, PromptTemplateMistral, `<s>[INST] {{ system_prompt }} [/INST] {{ assistant_msg_1 }}</s>`)
+	testPrompt(t, c, PromptTemplateGemma, `<bos><start_of_turn>user
+{{ system_prompt }}<end_of_turn>
+<start_of_turn>model
+{{ assistant_msg_1 }}<end_of_turn>
+<start_of_turn>model
+`)
+}
+
+func TestGeneratePromptBuiltinTools(t *testing.T) {
+	c := NewConversation("")
+	c.Tools = []Tool{{Name: "get_time"}}
+	c.AddMessageUser("{{ user_msg_1 }}")
+	c.AddToolCalls([]ToolCall{{ID: "call_1", Name: "get_time", Arguments: `{}`}})
+	c.AddMessageTool("call_1", "{{ tool_result_1 }}")
+	testPrompt(t, c, PromptTemplateChatML, `<|im_start|>system
+You can call the following tools. To call a tool, respond with a JSON object with the name of the tool and its arguments inside <tool_call></tool_call> tags:
+<tool_call>
+{"name": "tool name", "arguments": {"argument name": "argument value"}}
+</tool_call>
+The results of the tool calls are returned inside <tool_response></tool_response> tags.
+Tools:
+{"name":"get_time"}<|im_end|>
+<|im_start|>user
+{{ user_msg_1 }}<|im_end|>
+<|im_start|>assistant
+<tool_call>
+{"name":"get_time","arguments":{}}
+</tool_call><|im_end|>
+<|im_start|>tool
+<tool_response>
+{{ tool_result_1 }}
+</tool_response><|im_end|>
+<|im_start|>assistant
+`)
+	// formats without a system role render the tools in the first message of the user
+	testPrompt(t, c, PromptTemplateMistral, `<s>[INST] You can call the following tools. To call a tool, respond with a JSON object with the name of the tool and its arguments inside <tool_call></tool_call> tags:
+<tool_call>
+{"name": "tool name", "arguments": {"argument name": "argument value"}}
+</tool_call>
+The results of the tool calls are returned inside <tool_response></tool_response> tags.
+Tools:
+{"name":"get_time"}
+
+{{ user_msg_1 }} [/INST] <tool_call>
+{"name":"get_time","arguments":{}}
+</tool_call></s>[INST] <tool_response>
+{{ tool_result_1 }}
+</tool_response> [/INST]`)
+}
+
+func TestPromptTemplateNames(t *testing.T) {
+	expected := "alpaca chatml gemma llama-2 llama-3 mistral openchat orca phi-3 vicuna_v1.1 zephyr"
+	if names := fmt.Sprint(PromptTemplateNames()); names != "["+expected+"]" {
+		fmt.Printf("PromptTemplateNames() = %s\n", names)
+		t.Fail()
+	}
+}
+
+func TestDetectPromptTemplate(t *testing.T) {
+	for _, test := range []struct {
+		chatTemplate string
+		architecture string
+		name         string
+	}{
+		// chat templates of published models
+		{"{% set loop_messages = messages %}{% for message in loop_messages %}{% set content = '<|start_header_id|>' + message['role'] + '<|end_header_id|>\n\n'+ message['content'] | trim + '<|eot_id|>' %}{% if loop.index0 == 0 %}{% set content = bos_token + content %}{% endif %}{{ content }}{% endfor %}{% if add_generation_prompt %}{{ '<|start_header_id|>assistant<|end_header_id|>\n\n' }}{% endif %}", "llama", "llama-3"},
+		{"{% for message in messages %}{{'<|im_start|>' + message['role'] + '\n' + message['content'] + '<|im_end|>' + '\n'}}{% endfor %}{% if add_generation_prompt %}{{ '<|im_start|>assistant\n' }}{% endif %}", "qwen2", "chatml"},
+		{"{{ bos_token }}{% if messages[0]['role'] == 'system' %}{{ raise_exception('System role not supported') }}{% endif %}{% for message in messages %}{% if (message['role'] == 'assistant') %}{% set role = 'model' %}{% else %}{% set role = message['role'] %}{% endif %}{{ '<start_of_turn>' + role + '\n' + message['content'] | trim + '<end_of_turn>\n' }}{% endfor %}{% if add_generation_prompt %}{{'<start_of_turn>model\n'}}{% endif %}", "gemma", "gemma"},
+		{"{{ bos_token }}{% for message in messages %}{{ 'GPT4 Correct ' + message['role'].title() + ': ' + message['content'] + '<|end_of_turn|>'}}{% endfor %}{% if add_generation_prompt %}{{ 'GPT4 Correct Assistant:' }}{% endif %}", "llama", "openchat"},
+		{"{% for message in messages %}{% if message['role'] == 'system' %}{{'<|system|>\n' + message['content'] + '<|end|>\n'}}{% elif message['role'] == 'user' %}{{'<|user|>\n' + message['content'] + '<|end|>\n'}}{% elif message['role'] == 'assistant' %}{{'<|assistant|>\n' + message['content'] + '<|end|>\n'}}{% endif %}{% endfor %}{% if add_generation_prompt %}{{ '<|assistant|>\n' }}{% else %}{{ eos_token }}{% endif %}", "phi3", "phi-3"},
+		{"{% for message in messages %}\n{% if message['role'] == 'user' %}\n{{ '<|user|>\n' + message['content'] + eos_token }}\n{% elif message['role'] == 'system' %}\n{{ '<|system|>\n' + message['content'] + eos_token }}\n{% elif message['role'] == 'assistant' %}\n{{ '<|assistant|>\n'  + message['content'] + eos_token }}\n{% endif %}\n{% if loop.last and add_generation_prompt %}\n{{ '<|assistant|>' }}\n{% endif %}\n{% endfor %}", "llama", "zephyr"},
+		{"{% if messages[0]['role'] == 'system' %}{% set loop_messages = messages[1:] %}{% set system_message = messages[0]['content'] %}{% else %}{% set loop_messages = messages %}{% set system_message = false %}{% endif %}{% for message in loop_messages %}{% if loop.index0 == 0 and system_message != false %}{% set content = '<<SYS>>\\n' + system_message + '\\n<</SYS>>\\n\\n' + message['content'] %}{% else %}{% set content = message['content'] %}{% endif %}{% if message['role'] == 'user' %}{{ bos_token + '[INST] ' + content.strip() + ' [/INST]' }}{% elif message['role'] == 'assistant' %}{{ ' '  + content.strip() + ' ' + eos_token }}{% endif %}{% endfor %}", "llama", "llama-2"},
+		{"{{ bos_token }}{% for message in messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if message['role'] == 'user' %}{{ '[INST] ' + message['content'] + ' [/INST]' }}{% elif message['role'] == 'assistant' %}{{ message['content'] + eos_token}}{% else %}{{ raise_exception('Only user and assistant roles are supported!') }}{% endif %}{% endfor %}", "llama", "mistral"},
+		{"{% for message in messages %}{% if message['role'] == 'user' %}{{ 'USER: ' + message['content'] + '\n' }}{% elif message['role'] == 'assistant' %}{{ 'ASSISTANT: ' + message['content'] + eos_token + '\n' }}{% endif %}{% endfor %}{% if add_generation_prompt %}{{ 'ASSISTANT:' }}{% endif %}", "llama", "vicuna_v1.1"},
+		// no chat template, or an unknown one
+		{"", "phi3", "phi-3"},
+		{"", "gemma2", "gemma"},
+		{"{{ messages }}", "gemma", "gemma"},
+		{"{{ messages }}", "llama", ""},
+		{"", "llama", ""},
+	} {
+		name, ok := DetectPromptTemplate(test.chatTemplate, test.architecture)
+		if name != test.name || ok != (test.name != "") {
+			fmt.Printf("DetectPromptTemplate(%q, %s) = %s, %v, expected %s\n", test.chatTemplate, test.architecture, name, ok, test.name)
+			t.Fail()
+		}
+		if _, found := LookupPromptTemplate(name); ok && !found {
+			fmt.Printf("DetectPromptTemplate() returned unknown template '%s'\n", name)
+			t.Fail()
+		}
+	}
+}
+
+func TestGeneratePromptJinja(t *testing.T) {
+	c := NewConversation("{{ system_prompt }}")
+	c.AddMessageUser("{{ user_msg_1 }}")
+	c.AddMessageAssistant("{{ assistant_msg_1 }}")
+	c.AddMessageUser("{{ user_msg_2 }}")
+	// the chat template of ChatML models generates the same prompt as the built-in template
+	chatML, err := NewJinjaPromptTemplate("{% for message in messages %}{{'<|im_start|>' + message['role'] + '\n' + message['content'] + '<|im_end|>' + '\n'}}{% endfor %}{% if add_generation_prompt %}{{ '<|im_start|>assistant\n' }}{% endif %}")
+	if err != nil {
+		fmt.Printf("NewJinjaPromptTemplate() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	if !chatML.IsJinja() || chatML.IsZero() {
+		fmt.Printf("IsJinja() = %t, IsZero() = %t\n", chatML.IsJinja(), chatML.IsZero())
+		t.Fail()
+	}
+	expected, err := c.GeneratePrompt(PromptTemplateChatML)
+	if err != nil {
+		fmt.Printf("c.GeneratePrompt() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	testPrompt(t, c, chatML, expected)
+
+	llama2, err := NewJinjaPromptTemplate(`{% if messages[0]['role'] == 'system' %}{% set loop_messages = messages[1:] %}{% set system_message = messages[0]['content'] %}{% else %}{% set loop_messages = messages %}{% set system_message = false %}{% endif %}{% for message in loop_messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if loop.index0 == 0 and system_message != false %}{% set content = '<<SYS>>\n' + system_message + '\n<</SYS>>\n\n' + message['content'] %}{% else %}{% set content = message['content'] %}{% endif %}{% if message['role'] == 'user' %}{{ bos_token + '[INST] ' + content.strip() + ' [/INST]' }}{% elif message['role'] == 'assistant' %}{{ ' '  + content.strip() + ' ' + eos_token }}{% endif %}{% endfor %}`)
+	if err != nil {
+		fmt.Printf("NewJinjaPromptTemplate() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	llama2.BOSToken, llama2.EOSToken = "<s>", "</s>"
+	testPrompt(t, c, llama2, `<s>[INST] <<SYS>>
+{{ system_prompt }}
+<</SYS>>
+
+{{ user_msg_1 }} [/INST] {{ assistant_msg_1 }} </s><s>[INST] {{ user_msg_2 }} [/INST]`)
+
+	// the template raises an exception, because the roles don't alternate
+	c.AddToolCalls([]ToolCall{{ID: "call_1", Name: "get_time", Arguments: "{}"}})
+	c.AddMessageTool("call_1", "{{ tool_result_1 }}")
+	_, err = c.GeneratePrompt(llama2)
+	var exception *jinja.Exception
+	if !errors.As(err, &exception) {
+		fmt.Printf("c.GeneratePrompt() error = %v, expected exception\n", err)
+		t.Fail()
+	}
+
+	if _, err := NewJinjaPromptTemplate("{% if %}"); err == nil {
+		fmt.Printf("NewJinjaPromptTemplate() of invalid template succeeded\n")
+		t.Fail()
+	}
+}
+
+func TestGeneratePromptJinjaTools(t *testing.T) {
+	c := NewConversation("")
+	c.Tools = []Tool{{Name: "get_weather", Description: "Get the weather of a city", Parameters: []byte(`{"type":"object","properties":{"city":{"type":"string"}}}`)}}
+	c.AddMessageUser("{{ user_msg_1 }}")
+	c.AddToolCalls([]ToolCall{{ID: "call_1", Name: "get_weather", Arguments: `{"city":"Athens"}`}})
+	c.AddMessageTool("call_1", "{{ tool_result_1 }}")
+	promptTemplate, err := NewJinjaPromptTemplate(`{% if tools %}{% for tool in tools %}{{ tool | tojson }}
+{% endfor %}{% endif %}
+{% for message in messages %}
+{% if message.tool_calls %}{% for call in message.tool_calls %}{{ call.id }} {{ call.function.name }} {{ call.function.arguments | tojson }}
+{% endfor %}{% elif message.role == 'tool' %}{{ message.tool_call_id }}: {{ message.content }}
+{% else %}{{ message.role }}: {{ message.content }}
+{% endif %}
+{% endfor %}`)
+	if err != nil {
+		fmt.Printf("NewJinjaPromptTemplate() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	testPrompt(t, c, promptTemplate, `{"type": "function", "function": {"name": "get_weather", "description": "Get the weather of a city", "parameters": {"type": "object", "properties": {"city": {"type": "string"}}}}}
+user: {{ user_msg_1 }}
+call_1 get_weather {"city": "Athens"}
+call_1: {{ tool_result_1 }}
+`)
+	// tools is none if there are no tools
+	c.Tools = nil
+	promptTemplate, _ = NewJinjaPromptTemplate("{{ tools is none }}")
+	testPrompt(t, c, promptTemplate, "True")
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	promptTemplate, err := NewPromptTemplate(`---
+# metadata of the format
+stop: ["</s>", "USER:"]
+bosToken: <s>
+eosToken: "</s>"
+systemRole: false
+assistantPrefix: " Sure,"
+requiresSystemPrompt: true
+---
+{{define "prompt"}}<s>{{range .Messages}}{{.Role}}: {{.Text}}
+{{end}}ASSISTANT:{{end}}`)
+	if err != nil {
+		fmt.Printf("NewPromptTemplate() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	if got := fmt.Sprintf("%q %q %q %t %q %t", promptTemplate.Stop, promptTemplate.BOSToken, promptTemplate.EOSToken, promptTemplate.NoSystemRole, promptTemplate.AssistantPrefix, promptTemplate.RequiresSystemPrompt); got != `["</s>" "USER:"] "<s>" "</s>" true " Sure," true` {
+		fmt.Printf("metadata = %s\n", got)
+		t.Fail()
+	}
+	// the system prompt is put in the first message of the user, and the prompt ends with the assistant prefix
+	c := NewConversation("{{ system_prompt }}")
+	c.AddMessageUser("{{ user_msg_1 }}")
+	testPrompt(t, c, promptTemplate, `<s>user: {{ system_prompt }}
+
+{{ user_msg_1 }}
+ASSISTANT: Sure,`)
+	if len(c.Messages) != 2 || c.Messages[1].Text != "{{ user_msg_1 }}" {
+		fmt.Printf("GeneratePrompt() changed the conversation: %v\n", c.Messages)
+		t.Fail()
+	}
+
+	// the front matter of Jinja templates
+	promptTemplate, err = NewJinjaPromptTemplate("---\r\nstop: [\"<|im_end|>\"]\r\n---\r\n{{ messages | length }}")
+	if err != nil {
+		fmt.Printf("NewJinjaPromptTemplate() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	testPrompt(t, c, promptTemplate, "2")
+	if got := fmt.Sprint(promptTemplate.Stop); got != "[<|im_end|>]" {
+		fmt.Printf("stop = %s\n", got)
+		t.Fail()
+	}
+
+	// templates without front matter
+	promptTemplate, err = NewPromptTemplate(`{{define "prompt"}}---{{end}}`)
+	if err != nil || promptTemplate.Stop != nil {
+		fmt.Printf("NewPromptTemplate() = %v, %v\n", promptTemplate.Stop, err)
+		t.Fail()
+	}
+
+	for _, src := range []string{
+		"---\nstop: [\"</s>\"]\n",
+		"---\nstop: </s>\n---\n",
+		"---\nsystemRole: no\n---\n",
+		"---\nunknown: 1\n---\n",
+		"---\nstop\n---\n",
+	} {
+		if _, err := NewPromptTemplate(src); err == nil {
+			fmt.Printf("NewPromptTemplate() of invalid front matter succeeded: %q\n", src)
+			t.Fail()
+		}
+	}
+}
+
+func TestPromptTemplateMetadata(t *testing.T) {
+	if got := fmt.Sprint(PromptTemplateLlama2.StopSequences()); got != "[[INST] </s>]" {
+		fmt.Printf("StopSequences() = %s\n", got)
+		t.Fail()
+	}
+	if got := fmt.Sprint(PromptTemplateChatML.StopSequences()); got != "[<|im_end|>]" {
+		fmt.Printf("StopSequences() = %s\n", got)
+		t.Fail()
+	}
+	if got := PromptTemplateLlama2.TrimBOS("<s>[INST] Hi [/INST]"); got != "[INST] Hi [/INST]" {
+		fmt.Printf("TrimBOS() = %s\n", got)
+		t.Fail()
+	}
+	if got := PromptTemplateChatML.TrimBOS("<s>Hi"); got != "<s>Hi" {
+		fmt.Printf("TrimBOS() without BOS token = %s\n", got)
+		t.Fail()
+	}
+	// every built-in prompt template has stop sequences
+	for _, name := range PromptTemplateNames() {
+		promptTemplate, _ := LookupPromptTemplate(name)
+		if len(promptTemplate.StopSequences()) == 0 {
+			fmt.Printf("prompt template '%s' has no stop sequences\n", name)
+			t.Fail()
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	newConversation := func() Conversation {
+		c := NewConversation("system")
+		c.AddMessageUser("user 1")
+		c.AddMessageAssistant("assistant 1")
+		c.AddMessageUser("user 2")
+		c.AddToolCalls([]ToolCall{{ID: "call_1", Name: "get_time", Arguments: "{}"}})
+		c.AddMessageTool("call_1", "tool 1")
+		c.AddMessageAssistant("assistant 2")
+		c.AddMessageUser("user 3")
+		return c
+	}
+	// the tokens are counted as the bytes of the prompt
+	countTokens := func(prompt string) (int, error) {
+		return len(prompt), nil
+	}
+	tokens := func(c Conversation) int {
+		prompt, _ := c.GeneratePrompt(PromptTemplateChatML)
+		return len(prompt)
+	}
+	full := newConversation()
+	lastTurn := NewConversation("system")
+	lastTurn.AddMessageUser("user 3")
+	withoutFirstTurn := newConversation()
+	withoutFirstTurn.Messages = append(withoutFirstTurn.Messages[:1], withoutFirstTurn.Messages[3:]...)
+	for _, test := range []struct {
+		budget   int
+		dropped  int
+		messages []Message
+	}{
+		{tokens(full), 0, full.Messages},
+		{tokens(full) - 1, 2, withoutFirstTurn.Messages},
+		{tokens(withoutFirstTurn), 2, withoutFirstTurn.Messages},
+		{tokens(withoutFirstTurn) - 1, 6, lastTurn.Messages},
+		{tokens(lastTurn), 6, lastTurn.Messages},
+	} {
+		c := newConversation()
+		dropped, n, err := c.Fit(PromptTemplateChatML, test.budget, countTokens)
+		if err != nil {
+			fmt.Printf("Fit(%d) failed: %s\n", test.budget, err)
+			t.Fail()
+			continue
+		}
+		if dropped != test.dropped || fmt.Sprint(c.Messages) != fmt.Sprint(test.messages) {
+			fmt.Printf("Fit(%d) = %d, messages: %v\nexpected: %d, messages: %v\n", test.budget, dropped, c.Messages, test.dropped, test.messages)
+			t.Fail()
+		}
+		// the tokens of the prompt of the remaining messages are returned
+		if n != tokens(c) {
+			fmt.Printf("Fit(%d) tokens = %d, expected %d\n", test.budget, n, tokens(c))
+			t.Fail()
+		}
+	}
+
+	// the system prompt and the last message of the user are never dropped
+	c := newConversation()
+	dropped, _, err := c.Fit(PromptTemplateChatML, tokens(lastTurn)-1, countTokens)
+	if !errors.Is(err, ErrConversationTooLong) || dropped != 0 || len(c.Messages) != len(full.Messages) {
+		fmt.Printf("Fit() of too long conversation = %d, %v, expected error %s\n", dropped, err, ErrConversationTooLong)
+		t.Fail()
+	}
+	c = lastTurn
+	if _, _, err := c.Fit(PromptTemplateChatML, 1, countTokens); !errors.Is(err, ErrConversationTooLong) {
+		fmt.Printf("Fit() of one message = %v, expected error %s\n", err, ErrConversationTooLong)
+		t.Fail()
+	}
+
+	// errors of countTokens are returned
+	c = newConversation()
+	countErr := errors.New("count failed")
+	if _, _, err := c.Fit(PromptTemplateChatML, 1, func(string) (int, error) { return 0, countErr }); err != countErr {
+		fmt.Printf("Fit() = %v, expected error %s\n", err, countErr)
+		t.Fail()
+	}
+}
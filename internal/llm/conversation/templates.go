@@ -0,0 +1,248 @@
+package conversation
+
+import (
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// The built-in prompt templates for the prompt formats of popular model families.
+// Formats without a system role put the system prompt in the first message of the user,
+// and formats without a tool role render the results of tool calls as messages of the user.
+
+const promptTemplateStringChatML = `
+{{define "prompt" -}}
+{{if or .SystemPrompt .Tools}}<|im_start|>system
+{{template "systemPrompt" .}}<|im_end|>
+{{end}}
+{{- range .MessagesWithoutSystemPrompt}}<|im_start|>{{.Role}}
+{{if eq .Role "tool"}}{{template "toolResult" .}}{{else}}{{.Text}}{{template "toolCalls" .}}{{end}}<|im_end|>
+{{end}}<|im_start|>assistant
+{{end}}
+`
+
+var PromptTemplateChatML = PromptTemplate{
+	Template: template.Must(newTemplate("chatml").Parse(promptTemplateStringChatML)),
+	Stop:     []string{"<|im_end|>"},
+}
+
+const promptTemplateStringMistral = `
+{{define "prompt" -}}
+<s>{{range $i, $m := .MessagesWithoutSystemPrompt}}
+{{- if eq $m.Role "assistant"}} {{$m.Text}}{{template "toolCalls" $m}}</s>
+{{- else}}[INST] {{template "userText" $m}} [/INST]
+{{- end}}
+{{- end}}
+{{- end}}
+`
+
+var PromptTemplateMistral = PromptTemplate{
+	Template:     template.Must(newTemplate("mistral").Parse(promptTemplateStringMistral)),
+	BOSToken:     "<s>",
+	EOSToken:     "</s>",
+	Stop:         []string{"[INST]"},
+	NoSystemRole: true,
+}
+
+const promptTemplateStringZephyr = `
+{{define "prompt" -}}
+{{if or .SystemPrompt .Tools}}<|system|>
+{{template "systemPrompt" .}}</s>
+{{end}}
+{{- range .MessagesWithoutSystemPrompt}}{{if eq .Role "assistant"}}<|assistant|>
+{{.Text}}{{template "toolCalls" .}}</s>
+{{else}}<|user|>
+{{template "userText" .}}</s>
+{{end}}{{end}}<|assistant|>
+{{end}}
+`
+
+var PromptTemplateZephyr = PromptTemplate{
+	Template: template.Must(newTemplate("zephyr").Parse(promptTemplateStringZephyr)),
+	EOSToken: "</s>",
+	Stop:     []string{"<|user|>"},
+}
+
+const promptTemplateStringAlpaca = `
+{{define "prompt" -}}
+{{if or .SystemPrompt .Tools}}{{template "systemPrompt" .}}{{else}}Below is an instruction that describes a task. Write a response that appropriately completes the request.{{end}}
+
+{{range .MessagesWithoutSystemPrompt}}{{if eq .Role "assistant"}}### Response:
+{{.Text}}{{template "toolCalls" .}}
+
+{{else}}### Instruction:
+{{template "userText" .}}
+
+{{end}}{{end}}### Response:
+{{end}}
+`
+
+var PromptTemplateAlpaca = PromptTemplate{
+	Template: template.Must(newTemplate("alpaca").Parse(promptTemplateStringAlpaca)),
+	Stop:     []string{"### Instruction:"},
+}
+
+const promptTemplateStringOpenChat = `
+{{define "prompt" -}}
+<s>{{if or .SystemPrompt .Tools}}GPT4 Correct System: {{template "systemPrompt" .}}<|end_of_turn|>{{end}}
+{{- range .MessagesWithoutSystemPrompt}}{{if eq .Role "assistant"}}GPT4 Correct Assistant: {{.Text}}{{template "toolCalls" .}}<|end_of_turn|>
+{{- else}}GPT4 Correct User: {{template "userText" .}}<|end_of_turn|>
+{{- end}}{{end}}GPT4 Correct Assistant:{{end}}
+`
+
+var PromptTemplateOpenChat = PromptTemplate{
+	Template: template.Must(newTemplate("openchat").Parse(promptTemplateStringOpenChat)),
+	BOSToken: "<s>",
+	Stop:     []string{"<|end_of_turn|>"},
+}
+
+const promptTemplateStringOrca = `
+{{define "prompt" -}}
+{{if or .SystemPrompt .Tools}}### System:
+{{template "systemPrompt" .}}
+
+{{end}}
+{{- range .MessagesWithoutSystemPrompt}}{{if eq .Role "assistant"}}### Assistant:
+{{.Text}}{{template "toolCalls" .}}
+
+{{else}}### User:
+{{template "userText" .}}
+
+{{end}}{{end}}### Assistant:
+{{end}}
+`
+
+var PromptTemplateOrca = PromptTemplate{
+	Template: template.Must(newTemplate("orca").Parse(promptTemplateStringOrca)),
+	Stop:     []string{"### User:"},
+}
+
+const promptTemplateStringPhi3 = `
+{{define "prompt" -}}
+{{if or .SystemPrompt .Tools}}<|system|>
+{{template "systemPrompt" .}}<|end|>
+{{end}}
+{{- range .MessagesWithoutSystemPrompt}}{{if eq .Role "assistant"}}<|assistant|>
+{{.Text}}{{template "toolCalls" .}}<|end|>
+{{else}}<|user|>
+{{template "userText" .}}<|end|>
+{{end}}{{end}}<|assistant|>
+{{end}}
+`
+
+var PromptTemplatePhi3 = PromptTemplate{
+	Template: template.Must(newTemplate("phi-3").Parse(promptTemplateStringPhi3)),
+	Stop:     []string{"<|end|>", "<|user|>"},
+}
+
+const promptTemplateStringGemma = `
+{{define "prompt" -}}
+<bos>{{range $i, $m := .MessagesWithoutSystemPrompt}}{{if eq $m.Role "assistant"}}<start_of_turn>model
+{{$m.Text}}{{template "toolCalls" $m}}<end_of_turn>
+{{else}}<start_of_turn>user
+{{template "userText" $m}}<end_of_turn>
+{{end}}{{end}}<start_of_turn>model
+{{end}}
+`
+
+var PromptTemplateGemma = PromptTemplate{
+	Template:     template.Must(newTemplate("gemma").Parse(promptTemplateStringGemma)),
+	BOSToken:     "<bos>",
+	EOSToken:     "<eos>",
+	Stop:         []string{"<end_of_turn>"},
+	NoSystemRole: true,
+}
+
+const promptTemplateStringLlama3 = `
+{{define "prompt" -}}
+<|begin_of_text|>{{if or .SystemPrompt .Tools}}<|start_header_id|>system<|end_header_id|>
+
+{{template "systemPrompt" .}}<|eot_id|>{{end}}
+{{- range .MessagesWithoutSystemPrompt}}{{if eq .Role "tool"}}<|start_header_id|>ipython<|end_header_id|>
+
+{{template "toolResult" .}}<|eot_id|>
+{{- else}}<|start_header_id|>{{.Role}}<|end_header_id|>
+
+{{.Text}}{{template "toolCalls" .}}<|eot_id|>
+{{- end}}{{end}}<|start_header_id|>assistant<|end_header_id|>
+
+{{end}}
+`
+
+var PromptTemplateLlama3 = PromptTemplate{
+	Template: template.Must(newTemplate("llama-3").Parse(promptTemplateStringLlama3)),
+	BOSToken: "<|begin_of_text|>",
+	EOSToken: "<|end_of_text|>",
+	Stop:     []string{"<|eot_id|>"},
+}
+
+// the built-in prompt templates by name
+var promptTemplates = map[string]PromptTemplate{
+	"llama-2":     PromptTemplateLlama2,
+	"vicuna_v1.1": PromptTemplateVicunaV11,
+	"chatml":      PromptTemplateChatML,
+	"mistral":     PromptTemplateMistral,
+	"zephyr":      PromptTemplateZephyr,
+	"alpaca":      PromptTemplateAlpaca,
+	"openchat":    PromptTemplateOpenChat,
+	"orca":        PromptTemplateOrca,
+	"phi-3":       PromptTemplatePhi3,
+	"gemma":       PromptTemplateGemma,
+	"llama-3":     PromptTemplateLlama3,
+}
+
+// returns the built-in prompt template with the given name.
+func LookupPromptTemplate(name string) (PromptTemplate, bool) {
+	promptTemplate, ok := promptTemplates[name]
+	return promptTemplate, ok
+}
+
+// returns the names of the built-in prompt templates in alphabetical order.
+func PromptTemplateNames() []string {
+	names := make([]string, 0, len(promptTemplates))
+	for name := range promptTemplates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// markers of the chat templates of model files (Jinja templates), and the built-in prompt template of each format.
+// The markers are checked in order, so more specific markers come first.
+var chatTemplateMarkers = []struct {
+	markers []string
+	name    string
+}{
+	{[]string{"<|start_header_id|>"}, "llama-3"},
+	{[]string{"<|im_start|>"}, "chatml"},
+	{[]string{"<start_of_turn>"}, "gemma"},
+	{[]string{"GPT4 Correct"}, "openchat"},
+	{[]string{"<|assistant|>", "<|end|>"}, "phi-3"},
+	{[]string{"<|assistant|>"}, "zephyr"},
+	{[]string{"[INST]", "<<SYS>>"}, "llama-2"},
+	{[]string{"[INST]"}, "mistral"},
+	{[]string{"### Instruction"}, "alpaca"},
+	{[]string{"### User"}, "orca"},
+	{[]string{"USER:", "ASSISTANT:"}, "vicuna_v1.1"},
+}
+
+// architectures of models that always use the same prompt format
+var architecturePromptTemplates = map[string]string{
+	"gemma":  "gemma",
+	"gemma2": "gemma",
+	"phi3":   "phi-3",
+}
+
+// returns the name of the built-in prompt template that matches the chat template (a Jinja template) of a model file,
+// or, if the chat template doesn't match any, the architecture of the model.
+func DetectPromptTemplate(chatTemplate string, architecture string) (string, bool) {
+	if chatTemplate != "" {
+		for _, m := range chatTemplateMarkers {
+			if !slices.ContainsFunc(m.markers, func(marker string) bool { return !strings.Contains(chatTemplate, marker) }) {
+				return m.name, true
+			}
+		}
+	}
+	name, ok := architecturePromptTemplates[architecture]
+	return name, ok
+}
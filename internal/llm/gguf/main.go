@@ -0,0 +1,341 @@
+// Package gguf reads the metadata of model files in the GGUF format of llama.cpp,
+// without reading the tensors.
+// See https://github.com/ggerganov/ggml/blob/master/docs/gguf.md
+package gguf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Metadata are the key-value pairs of the header of a GGUF file.
+// Integers are stored as uint8, int8, uint16, int16, uint32, int32, uint64 or int64, floats as float32 or float64,
+// and booleans and strings as bool and string. Arrays are skipped, except the tokens of the vocabulary, which are []string.
+type Metadata map[string]any
+
+// key of the tokens of the vocabulary
+const tokensKey = "tokenizer.ggml.tokens"
+
+// returns the string value of the key, or an empty string if the key doesn't exist or its value is not a string.
+func (m Metadata) String(key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+// returns the architecture of the model, e.g. "llama".
+func (m Metadata) Architecture() string {
+	return m.String("general.architecture")
+}
+
+// returns the chat template of the model, which is a Jinja template, or an empty string if the model doesn't have one.
+func (m Metadata) ChatTemplate() string {
+	return m.String("tokenizer.chat_template")
+}
+
+// returns the text of the beginning-of-sequence token, or an empty string if it's not known.
+func (m Metadata) BOSToken() string {
+	return m.token("tokenizer.ggml.bos_token_id")
+}
+
+// returns the text of the end-of-sequence token, or an empty string if it's not known.
+func (m Metadata) EOSToken() string {
+	return m.token("tokenizer.ggml.eos_token_id")
+}
+
+// returns true if the tokenizer adds the beginning-of-sequence token to the beginning of the text.
+// If the metadata don't say, llama.cpp adds it for SentencePiece tokenizers ("llama") but not for BPE tokenizers ("gpt2").
+func (m Metadata) AddsBOS() bool {
+	if addBOS, ok := m["tokenizer.ggml.add_bos_token"].(bool); ok {
+		return addBOS
+	}
+	return m.String("tokenizer.ggml.model") == "llama"
+}
+
+// returns the text of the token whose ID is the value of the key.
+func (m Metadata) token(key string) string {
+	tokens, _ := m[tokensKey].([]string)
+	var id uint64
+	switch v := m[key].(type) {
+	case uint32:
+		id = uint64(v)
+	case int32:
+		id = uint64(v)
+	case uint64:
+		id = v
+	case int64:
+		id = uint64(v)
+	default:
+		return ""
+	}
+	if id >= uint64(len(tokens)) {
+		return ""
+	}
+	return tokens[id]
+}
+
+var ErrNotGGUF = errors.New("not a GGUF file")
+
+const magic = "GGUF"
+
+// types of values
+const (
+	typeUint8   = 0
+	typeInt8    = 1
+	typeUint16  = 2
+	typeInt16   = 3
+	typeUint32  = 4
+	typeInt32   = 5
+	typeFloat32 = 6
+	typeBool    = 7
+	typeString  = 8
+	typeArray   = 9
+	typeUint64  = 10
+	typeInt64   = 11
+	typeFloat64 = 12
+)
+
+// size in bytes of the values of fixed size types
+var typeSizes = map[uint32]int64{
+	typeUint8: 1, typeInt8: 1, typeBool: 1,
+	typeUint16: 2, typeInt16: 2,
+	typeUint32: 4, typeInt32: 4, typeFloat32: 4,
+	typeUint64: 8, typeInt64: 8, typeFloat64: 8,
+}
+
+// maximum length of strings that are read in memory, so corrupted files don't cause huge allocations
+const maxStringLength = 16 << 20
+
+type reader struct {
+	r *bufio.Reader
+	// version 1 uses 32-bit lengths and counts, the later versions 64-bit
+	version uint32
+}
+
+// reads the metadata of the GGUF file.
+func ReadFile(path string) (Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// reads the metadata of a GGUF file from r. It reads r up to the end of the metadata.
+func Read(r io.Reader) (Metadata, error) {
+	gr := &reader{r: bufio.NewReader(r)}
+	header := make([]byte, len(magic))
+	_, err := io.ReadFull(gr.r, header)
+	if err != nil || string(header) != magic {
+		return nil, ErrNotGGUF
+	}
+	gr.version, err = gr.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if gr.version < 1 || gr.version > 3 {
+		return nil, fmt.Errorf("unsupported GGUF version %d", gr.version)
+	}
+	// number of tensors
+	_, err = gr.count()
+	if err != nil {
+		return nil, err
+	}
+	n, err := gr.count()
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(Metadata)
+	for i := uint64(0); i < n; i++ {
+		key, err := gr.string()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %d: %w", i, err)
+		}
+		valueType, err := gr.uint32()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read type of '%s': %w", key, err)
+		}
+		if valueType == typeArray && key == tokensKey {
+			metadata[key], err = gr.stringArray()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read value of '%s': %w", key, err)
+			}
+			continue
+		}
+		if valueType == typeArray {
+			err = gr.skipArray()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read value of '%s': %w", key, err)
+			}
+			continue
+		}
+		value, err := gr.value(valueType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read value of '%s': %w", key, err)
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+func (gr *reader) uint32() (uint32, error) {
+	var v uint32
+	err := binary.Read(gr.r, binary.LittleEndian, &v)
+	return v, unexpectedEOF(err)
+}
+
+// reads a length or a count, which is 32-bit in version 1 and 64-bit in the later versions.
+func (gr *reader) count() (uint64, error) {
+	if gr.version == 1 {
+		v, err := gr.uint32()
+		return uint64(v), err
+	}
+	var v uint64
+	err := binary.Read(gr.r, binary.LittleEndian, &v)
+	return v, unexpectedEOF(err)
+}
+
+func (gr *reader) string() (string, error) {
+	n, err := gr.count()
+	if err != nil {
+		return "", err
+	}
+	if n > maxStringLength {
+		return "", fmt.Errorf("string of %d bytes is too long", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(gr.r, b)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return string(b), nil
+}
+
+func (gr *reader) value(valueType uint32) (any, error) {
+	if valueType == typeString {
+		return gr.string()
+	}
+	size, ok := typeSizes[valueType]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %d", valueType)
+	}
+	b := make([]byte, size)
+	_, err := io.ReadFull(gr.r, b)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	le := binary.LittleEndian
+	switch valueType {
+	case typeUint8:
+		return b[0], nil
+	case typeInt8:
+		return int8(b[0]), nil
+	case typeBool:
+		return b[0] != 0, nil
+	case typeUint16:
+		return le.Uint16(b), nil
+	case typeInt16:
+		return int16(le.Uint16(b)), nil
+	case typeUint32:
+		return le.Uint32(b), nil
+	case typeInt32:
+		return int32(le.Uint32(b)), nil
+	case typeFloat32:
+		return math.Float32frombits(le.Uint32(b)), nil
+	case typeUint64:
+		return le.Uint64(b), nil
+	case typeInt64:
+		return int64(le.Uint64(b)), nil
+	default:
+		return math.Float64frombits(le.Uint64(b)), nil
+	}
+}
+
+// reads an array of strings.
+func (gr *reader) stringArray() ([]string, error) {
+	elemType, err := gr.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if elemType != typeString {
+		return nil, fmt.Errorf("expecting array of strings, found array of type %d", elemType)
+	}
+	n, err := gr.count()
+	if err != nil {
+		return nil, err
+	}
+	// the count is not trusted for the allocation, because the file can be corrupted
+	strs := make([]string, 0, min(n, 1<<20))
+	for i := uint64(0); i < n; i++ {
+		s, err := gr.string()
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// skips an array without reading its elements in memory.
+// Arrays can be large, e.g. the tokens of the vocabulary.
+func (gr *reader) skipArray() error {
+	elemType, err := gr.uint32()
+	if err != nil {
+		return err
+	}
+	n, err := gr.count()
+	if err != nil {
+		return err
+	}
+	if size, ok := typeSizes[elemType]; ok {
+		if n > math.MaxInt64/uint64(size) {
+			return fmt.Errorf("array of %d elements is too long", n)
+		}
+		return gr.discard(int64(n) * size)
+	}
+	for i := uint64(0); i < n; i++ {
+		switch elemType {
+		case typeString:
+			length, err := gr.count()
+			if err != nil {
+				return err
+			}
+			if length > math.MaxInt64 {
+				return fmt.Errorf("string of %d bytes is too long", length)
+			}
+			err = gr.discard(int64(length))
+			if err != nil {
+				return err
+			}
+		case typeArray:
+			err := gr.skipArray()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown type %d", elemType)
+		}
+	}
+	return nil
+}
+
+func (gr *reader) discard(n int64) error {
+	copied, err := io.CopyN(io.Discard, gr.r, n)
+	if copied < n {
+		return unexpectedEOF(err)
+	}
+	return nil
+}
+
+// the file ended before the end of the metadata
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
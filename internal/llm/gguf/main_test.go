@@ -0,0 +1,183 @@
+package gguf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// writes GGUF files of version 3
+type writer struct {
+	bytes.Buffer
+}
+
+func (w *writer) write(v any) {
+	binary.Write(&w.Buffer, binary.LittleEndian, v)
+}
+
+func (w *writer) string(s string) {
+	w.write(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *writer) header(kvCount int) {
+	w.WriteString("GGUF")
+	w.write(uint32(3))
+	// number of tensors
+	w.write(uint64(0))
+	w.write(uint64(kvCount))
+}
+
+func (w *writer) key(key string, valueType uint32) {
+	w.string(key)
+	w.write(valueType)
+}
+
+func testFile() []byte {
+	w := &writer{}
+	w.header(9)
+	w.key("general.architecture", typeString)
+	w.string("llama")
+	w.key("llama.context_length", typeUint32)
+	w.write(uint32(4096))
+	w.key("tokenizer.ggml.tokens", typeArray)
+	w.write(uint32(typeString))
+	w.write(uint64(3))
+	for _, token := range []string{"<s>", "</s>", "hello"} {
+		w.string(token)
+	}
+	w.key("tokenizer.ggml.scores", typeArray)
+	w.write(uint32(typeFloat32))
+	w.write(uint64(3))
+	w.write([]float32{0, 0, -1})
+	w.key("tokenizer.ggml.bos_token_id", typeUint32)
+	w.write(uint32(0))
+	w.key("tokenizer.ggml.eos_token_id", typeUint32)
+	w.write(uint32(1))
+	w.key("tokenizer.ggml.add_bos_token", typeBool)
+	w.write(uint8(1))
+	w.key("general.file_type", typeInt64)
+	w.write(int64(-7))
+	w.key("tokenizer.chat_template", typeString)
+	w.string("{% for message in messages %}{{ message['content'] }}{% endfor %}")
+	return w.Bytes()
+}
+
+func TestRead(t *testing.T) {
+	metadata, err := Read(bytes.NewReader(testFile()))
+	if err != nil {
+		fmt.Printf("Read() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	expected := Metadata{
+		"general.architecture":         "llama",
+		"llama.context_length":         uint32(4096),
+		"tokenizer.ggml.bos_token_id":  uint32(0),
+		"tokenizer.ggml.eos_token_id":  uint32(1),
+		"tokenizer.ggml.add_bos_token": true,
+		"general.file_type":            int64(-7),
+		"tokenizer.chat_template":      "{% for message in messages %}{{ message['content'] }}{% endfor %}",
+	}
+	if len(metadata) != len(expected)+1 {
+		fmt.Printf("Read() = %v\nexpected: %v\n", metadata, expected)
+		t.Fail()
+	}
+	for key, value := range expected {
+		if metadata[key] != value {
+			fmt.Printf("metadata[%s] = %#v, expected %#v\n", key, metadata[key], value)
+			t.Fail()
+		}
+	}
+	if got := metadata.Architecture(); got != "llama" {
+		fmt.Printf("Architecture() = %s, expected llama\n", got)
+		t.Fail()
+	}
+	if got := metadata.ChatTemplate(); got != expected["tokenizer.chat_template"] {
+		fmt.Printf("ChatTemplate() = %s\n", got)
+		t.Fail()
+	}
+	if got := fmt.Sprint(metadata["tokenizer.ggml.tokens"]); got != "[<s> </s> hello]" {
+		fmt.Printf("tokens = %s\n", got)
+		t.Fail()
+	}
+	if bos, eos := metadata.BOSToken(), metadata.EOSToken(); bos != "<s>" || eos != "</s>" {
+		fmt.Printf("BOSToken(), EOSToken() = %s, %s, expected <s>, </s>\n", bos, eos)
+		t.Fail()
+	}
+	if got := metadata.String("llama.context_length"); got != "" {
+		fmt.Printf("String() of a number = %s, expected empty string\n", got)
+		t.Fail()
+	}
+}
+
+func TestReadVersion1(t *testing.T) {
+	w := &writer{}
+	w.WriteString("GGUF")
+	w.write(uint32(1))
+	w.write(uint32(0))
+	w.write(uint32(1))
+	w.write(uint32(len("general.architecture")))
+	w.WriteString("general.architecture")
+	w.write(uint32(typeString))
+	w.write(uint32(len("falcon")))
+	w.WriteString("falcon")
+	metadata, err := Read(&w.Buffer)
+	if err != nil {
+		fmt.Printf("Read() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	if got := metadata.Architecture(); got != "falcon" {
+		fmt.Printf("Architecture() = %s, expected falcon\n", got)
+		t.Fail()
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	file := testFile()
+	if _, err := Read(bytes.NewReader([]byte("GGML\x01\x00\x00\x00"))); !errors.Is(err, ErrNotGGUF) {
+		fmt.Printf("Read() of a file with another magic number: error = %v, expected %s\n", err, ErrNotGGUF)
+		t.Fail()
+	}
+	// every truncated file is an error
+	for n := 0; n < len(file); n++ {
+		_, err := Read(bytes.NewReader(file[:n]))
+		if err == nil {
+			fmt.Printf("Read() of the first %d bytes succeeded\n", n)
+			t.Fail()
+		}
+		if n > 8 && !errors.Is(err, io.ErrUnexpectedEOF) {
+			fmt.Printf("Read() of the first %d bytes: error = %s, expected %s\n", n, err, io.ErrUnexpectedEOF)
+			t.Fail()
+		}
+	}
+	w := &writer{}
+	w.header(1)
+	w.key("general.architecture", 13)
+	if _, err := Read(&w.Buffer); err == nil || err.Error() != "failed to read value of 'general.architecture': unknown type 13" {
+		fmt.Printf("Read() of unknown type: error = %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestAddsBOS(t *testing.T) {
+	for _, test := range []struct {
+		metadata Metadata
+		expected bool
+	}{
+		{Metadata{"tokenizer.ggml.model": "llama"}, true},
+		{Metadata{"tokenizer.ggml.model": "gpt2"}, false},
+		{Metadata{"tokenizer.ggml.model": "llama", "tokenizer.ggml.add_bos_token": false}, false},
+		{Metadata{"tokenizer.ggml.model": "gpt2", "tokenizer.ggml.add_bos_token": true}, true},
+		{Metadata{}, false},
+	} {
+		if got := test.metadata.AddsBOS(); got != test.expected {
+			fmt.Printf("AddsBOS() of %v = %t, expected %t\n", test.metadata, got, test.expected)
+			t.Fail()
+		}
+	}
+}
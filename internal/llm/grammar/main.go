@@ -0,0 +1,321 @@
+// Package grammar parses grammars in the GBNF format of llama.cpp,
+// so invalid grammars are rejected with a descriptive error before they are passed to llama.cpp.
+// See https://github.com/ggerganov/llama.cpp/blob/master/grammars/README.md
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Grammar is a parsed GBNF grammar.
+type Grammar struct {
+	// names of the rules in the order they are defined
+	Rules []string
+}
+
+// SyntaxError is an error in a grammar.
+type SyntaxError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+var ErrNoRoot = errors.New("grammar does not define rule 'root'")
+
+type parser struct {
+	src string
+	pos int
+	// rules that are defined
+	defined map[string]bool
+	// rules that are referenced, with the position of their first reference
+	referenced map[string]int
+	grammar    *Grammar
+}
+
+// parses a grammar in the GBNF format.
+func Parse(src string) (*Grammar, error) {
+	p := &parser{
+		src:        src,
+		defined:    make(map[string]bool),
+		referenced: make(map[string]int),
+		grammar:    &Grammar{},
+	}
+	err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return p.grammar, nil
+}
+
+func (p *parser) errorAt(pos int, format string, args ...any) error {
+	line := 1 + strings.Count(p.src[:pos], "\n")
+	column := 1 + utf8.RuneCountInString(p.src[strings.LastIndex(p.src[:pos], "\n")+1:pos])
+	return &SyntaxError{Line: line, Column: column, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// skips spaces and comments, and newlines if newlineOK is true.
+func (p *parser) skipSpace(newlineOK bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' && p.peek() != '\r' {
+				p.pos++
+			}
+		case newlineOK && (c == '\n' || c == '\r'):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+}
+
+func (p *parser) parseName() string {
+	start := p.pos
+	for !p.eof() && isWordChar(p.peek()) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *parser) parse() error {
+	p.skipSpace(true)
+	for !p.eof() {
+		err := p.parseRule()
+		if err != nil {
+			return err
+		}
+	}
+	if !p.defined["root"] {
+		return ErrNoRoot
+	}
+	for _, name := range p.grammar.Rules {
+		delete(p.referenced, name)
+	}
+	// report the first undefined rule in the grammar
+	undefined, undefinedPos := "", len(p.src)
+	for name, pos := range p.referenced {
+		if pos < undefinedPos {
+			undefined, undefinedPos = name, pos
+		}
+	}
+	if undefined != "" {
+		return p.errorAt(undefinedPos, "undefined rule '%s'", undefined)
+	}
+	return nil
+}
+
+func (p *parser) parseRule() error {
+	namePos := p.pos
+	name := p.parseName()
+	if name == "" {
+		return p.errorAt(p.pos, "expecting rule name")
+	}
+	if p.defined[name] {
+		return p.errorAt(namePos, "rule '%s' is defined more than once", name)
+	}
+	p.defined[name] = true
+	p.grammar.Rules = append(p.grammar.Rules, name)
+	p.skipSpace(false)
+	if !strings.HasPrefix(p.src[p.pos:], "::=") {
+		return p.errorAt(p.pos, "expecting '::=' after rule name '%s'", name)
+	}
+	p.pos += 3
+	p.skipSpace(true)
+	err := p.parseAlternatives(false)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "\r\n"):
+		p.pos += 2
+	case p.peek() == '\n' || p.peek() == '\r':
+		p.pos++
+	case !p.eof():
+		return p.errorAt(p.pos, "expecting newline or end of input, found %q", p.src[p.pos:p.pos+1])
+	}
+	p.skipSpace(true)
+	return nil
+}
+
+// parses alternatives separated by '|'. Newlines are allowed only inside parentheses (nested is true).
+func (p *parser) parseAlternatives(nested bool) error {
+	err := p.parseSequence(nested)
+	if err != nil {
+		return err
+	}
+	for p.peek() == '|' {
+		p.pos++
+		p.skipSpace(true)
+		err = p.parseSequence(nested)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseSequence(nested bool) error {
+	hasItem := false
+	for !p.eof() {
+		c := p.peek()
+		switch {
+		case c == '"':
+			err := p.parseLiteral()
+			if err != nil {
+				return err
+			}
+		case c == '[':
+			err := p.parseCharClass()
+			if err != nil {
+				return err
+			}
+		case isWordChar(c):
+			pos := p.pos
+			name := p.parseName()
+			if _, ok := p.referenced[name]; !ok {
+				p.referenced[name] = pos
+			}
+		case c == '(':
+			p.pos++
+			p.skipSpace(true)
+			err := p.parseAlternatives(true)
+			if err != nil {
+				return err
+			}
+			if p.peek() != ')' {
+				return p.errorAt(p.pos, "expecting ')'")
+			}
+			p.pos++
+		case c == '*' || c == '+' || c == '?':
+			if !hasItem {
+				return p.errorAt(p.pos, "expecting preceding item to '%c'", c)
+			}
+			p.pos++
+		case c == '{':
+			return p.errorAt(p.pos, "repetition with braces is not supported, use '*', '+' or '?'")
+		default:
+			return nil
+		}
+		hasItem = true
+		p.skipSpace(nested)
+	}
+	return nil
+}
+
+func (p *parser) parseLiteral() error {
+	start := p.pos
+	p.pos++
+	for !p.eof() && p.peek() != '"' {
+		if p.peek() == '\n' || p.peek() == '\r' {
+			return p.errorAt(p.pos, "newline in string literal, use \\n")
+		}
+		_, err := p.parseChar()
+		if err != nil {
+			return err
+		}
+	}
+	if p.eof() {
+		return p.errorAt(start, "unterminated string literal")
+	}
+	p.pos++
+	return nil
+}
+
+func (p *parser) parseCharClass() error {
+	start := p.pos
+	p.pos++
+	if p.peek() == '^' {
+		p.pos++
+	}
+	for !p.eof() && p.peek() != ']' {
+		rangePos := p.pos
+		first, err := p.parseChar()
+		if err != nil {
+			return err
+		}
+		if p.peek() == '-' && p.pos+1 < len(p.src) && p.src[p.pos+1] != ']' {
+			p.pos++
+			last, err := p.parseChar()
+			if err != nil {
+				return err
+			}
+			if last < first {
+				return p.errorAt(rangePos, "invalid character range: the end is before the start")
+			}
+		}
+	}
+	if p.eof() {
+		return p.errorAt(start, "unterminated character class")
+	}
+	p.pos++
+	return nil
+}
+
+// parses a character of a string literal or a character class, which can be an escape sequence.
+func (p *parser) parseChar() (rune, error) {
+	if p.eof() {
+		return 0, p.errorAt(p.pos, "unexpected end of input")
+	}
+	if p.peek() != '\\' {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		if r == utf8.RuneError && size == 1 {
+			return 0, p.errorAt(p.pos, "invalid UTF-8")
+		}
+		p.pos += size
+		return r, nil
+	}
+	escapePos := p.pos
+	p.pos++
+	if p.eof() {
+		return 0, p.errorAt(escapePos, "unexpected end of input")
+	}
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'x', 'u', 'U':
+		digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+		if p.pos+digits > len(p.src) {
+			return 0, p.errorAt(escapePos, "expecting %d hex digits after '\\%c'", digits, c)
+		}
+		v, err := strconv.ParseUint(p.src[p.pos:p.pos+digits], 16, 32)
+		if err != nil {
+			return 0, p.errorAt(escapePos, "expecting %d hex digits after '\\%c'", digits, c)
+		}
+		p.pos += digits
+		return rune(v), nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case '"', '[', ']', '\\':
+		return rune(c), nil
+	}
+	return 0, p.errorAt(escapePos, "unknown escape sequence '\\%c'", c)
+}
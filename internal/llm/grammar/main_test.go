@@ -0,0 +1,104 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// the JSON grammar of llama.cpp
+const grammarJSON = `root   ::= object
+value  ::= object | array | string | number | ("true" | "false" | "null") ws
+
+object ::=
+  "{" ws (
+            string ":" ws value
+    ("," ws string ":" ws value)*
+  )? "}" ws
+
+array  ::=
+  "[" ws (
+            value
+    ("," ws value)*
+  )? "]" ws
+
+string ::=
+  "\"" (
+    [^"\\] |
+    "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]) # escapes
+  )* "\"" ws
+
+number ::= ("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? ws
+
+# Optional space: by convention, applied in this grammar after literal chars when allowed
+ws ::= ([ \t\n] ws)?
+`
+
+func TestParseValid(t *testing.T) {
+	for _, src := range []string{
+		grammarJSON,
+		`root ::= "yes" | "no"`,
+		"root ::= answer\r\nanswer ::= [a-z]+ \"\\x41\\u00e9\\U0001F600\"\r\n",
+		`root ::= ( "a" | ) "b"?`,
+		"# comment\n\nroot ::= [^\\]\\[] # trailing comment\n",
+	} {
+		_, err := Parse(src)
+		if err != nil {
+			fmt.Printf("Parse(%q) failed: %s\n", src, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	g, err := Parse(grammarJSON)
+	if err != nil {
+		fmt.Printf("Parse() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	expected := "root value object array string number ws"
+	if got := strings.Join(g.Rules, " "); got != expected {
+		fmt.Printf("rules = %s, expected %s\n", got, expected)
+		t.Fail()
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, test := range []struct {
+		src     string
+		message string
+	}{
+		{`answer ::= "yes"`, ErrNoRoot.Error()},
+		{`root ::= answer`, "line 1, column 10: undefined rule 'answer'"},
+		{`root = "yes"`, "line 1, column 6: expecting '::=' after rule name 'root'"},
+		{"root ::= \"yes", "line 1, column 10: unterminated string literal"},
+		{"root ::= [a-z", "line 1, column 10: unterminated character class"},
+		{"root ::= [z-a]", "line 1, column 11: invalid character range: the end is before the start"},
+		{"root ::= (\"a\"\n", "line 2, column 1: expecting ')'"},
+		{"root ::= * \"a\"", "line 1, column 10: expecting preceding item to '*'"},
+		{"root ::= \"\\q\"", "line 1, column 11: unknown escape sequence '\\q'"},
+		{"root ::= \"\\x4\"", "line 1, column 11: expecting 2 hex digits after '\\x'"},
+		{"root ::= \"a\" )", "line 1, column 14: expecting newline or end of input, found \")\""},
+		{"root ::= \"a\"\nroot ::= \"b\"", "line 2, column 1: rule 'root' is defined more than once"},
+		{"root ::= \"a\"{2}", "line 1, column 13: repetition with braces is not supported, use '*', '+' or '?'"},
+		{"root ::= \"a\"\n| \"b\"", "line 2, column 1: expecting rule name"},
+	} {
+		_, err := Parse(test.src)
+		if err == nil {
+			fmt.Printf("Parse(%q) succeeded, expected error: %s\n", test.src, test.message)
+			t.Fail()
+			continue
+		}
+		if err.Error() != test.message {
+			fmt.Printf("Parse(%q) error = %q, expected %q\n", test.src, err, test.message)
+			t.Fail()
+		}
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) && !errors.Is(err, ErrNoRoot) {
+			fmt.Printf("Parse(%q) error is not a SyntaxError\n", test.src)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,1782 @@
+package jinja
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Values of expressions are nil (none), bool, int64, float64, string, []any (list), *dict, *namespace,
+// undefined, method and function.
+
+// undefined is the value of variables, attributes and items that don't exist.
+// Like in Jinja, it's rendered as an empty string and it's false, but getting its attributes is an error.
+type undefined struct {
+	name string
+}
+
+// dict is a dict that keeps the order its keys are set, so tojson renders the keys in their original order.
+type dict struct {
+	keys   []string
+	values map[string]any
+}
+
+func newDict() *dict {
+	return &dict{values: make(map[string]any)}
+}
+
+func (d *dict) set(key string, value any) {
+	if _, ok := d.values[key]; !ok {
+		d.keys = append(d.keys, key)
+	}
+	d.values[key] = value
+}
+
+// namespace is the object namespace() returns, whose attributes can be set in loops.
+type namespace struct {
+	attrs *dict
+}
+
+// method is a method of a value, e.g. the strip of 'text'.strip().
+type method struct {
+	receiver any
+	name     string
+}
+
+type function func(a callArgs) (any, error)
+
+type callArgs struct {
+	positional []any
+	keywords   map[string]any
+}
+
+// returns the argument at position i, or the keyword argument name, or the default value if neither is set.
+func (a callArgs) get(i int, name string, defaultValue any) any {
+	if i < len(a.positional) {
+		return a.positional[i]
+	}
+	if v, ok := a.keywords[name]; ok {
+		return v
+	}
+	return defaultValue
+}
+
+// expr is an expression.
+type expr interface {
+	eval(s *state) (any, error)
+}
+
+type literal struct {
+	v any
+}
+
+type nameExpr string
+
+type listExpr []expr
+
+type dictExpr struct {
+	keys   []expr
+	values []expr
+}
+
+type attrExpr struct {
+	x    expr
+	name string
+}
+
+type itemExpr struct {
+	x     expr
+	index expr
+}
+
+type sliceExpr struct {
+	x                 expr
+	start, stop, step expr
+}
+
+type args struct {
+	positional []expr
+	keywords   []keywordArg
+}
+
+type keywordArg struct {
+	name  string
+	value expr
+}
+
+type callExpr struct {
+	fn   expr
+	args args
+}
+
+type filterExpr struct {
+	x    expr
+	name string
+	args args
+}
+
+type testExpr struct {
+	x       expr
+	name    string
+	args    args
+	negated bool
+}
+
+type binaryExpr struct {
+	op   string
+	a, b expr
+}
+
+type negExpr struct {
+	x expr
+}
+
+type notExpr struct {
+	x expr
+}
+
+type andExpr struct {
+	a, b expr
+}
+
+type orExpr struct {
+	a, b expr
+}
+
+// chained comparison: first ops[0] operands[0] ops[1] operands[1] ...
+type compareExpr struct {
+	first    expr
+	ops      []string
+	operands []expr
+}
+
+type condExpr struct {
+	cond      expr
+	then      expr
+	otherwise expr
+}
+
+func (e literal) eval(s *state) (any, error) {
+	return e.v, nil
+}
+
+func (e nameExpr) eval(s *state) (any, error) {
+	if v, ok := s.scope.lookup(string(e)); ok {
+		return v, nil
+	}
+	if f, ok := globals[string(e)]; ok {
+		return f, nil
+	}
+	return undefined{string(e)}, nil
+}
+
+func (e listExpr) eval(s *state) (any, error) {
+	list := make([]any, len(e))
+	for i, item := range e {
+		var err error
+		list[i], err = item.eval(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (e dictExpr) eval(s *state) (any, error) {
+	d := newDict()
+	for i := range e.keys {
+		key, err := e.keys[i].eval(s)
+		if err != nil {
+			return nil, err
+		}
+		value, err := e.values[i].eval(s)
+		if err != nil {
+			return nil, err
+		}
+		d.set(str(key), value)
+	}
+	return d, nil
+}
+
+func (e attrExpr) eval(s *state) (any, error) {
+	x, err := e.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	return getAttr(x, e.name)
+}
+
+func getAttr(x any, name string) (any, error) {
+	switch x := x.(type) {
+	case undefined:
+		return nil, fmt.Errorf("'%s' is undefined, so it has no attribute '%s'", x.name, name)
+	case *dict:
+		if slices.Contains(dictMethods, name) {
+			return method{x, name}, nil
+		}
+		if v, ok := x.values[name]; ok {
+			return v, nil
+		}
+	case *namespace:
+		if v, ok := x.attrs.values[name]; ok {
+			return v, nil
+		}
+	case string:
+		if slices.Contains(stringMethods, name) {
+			return method{x, name}, nil
+		}
+	}
+	return undefined{name}, nil
+}
+
+func (e itemExpr) eval(s *state) (any, error) {
+	x, err := e.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	index, err := e.index.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	return getItem(x, index)
+}
+
+func getItem(x any, index any) (any, error) {
+	switch x := x.(type) {
+	case undefined:
+		return nil, fmt.Errorf("'%s' is undefined, so it has no item %s", x.name, repr(index))
+	case *dict:
+		if key, ok := index.(string); ok {
+			if v, ok := x.values[key]; ok {
+				return v, nil
+			}
+			return undefined{key}, nil
+		}
+	case *namespace:
+		if key, ok := index.(string); ok {
+			if v, ok := x.attrs.values[key]; ok {
+				return v, nil
+			}
+			return undefined{key}, nil
+		}
+	case []any:
+		if i, ok := index.(int64); ok {
+			if i < 0 {
+				i += int64(len(x))
+			}
+			if i >= 0 && i < int64(len(x)) {
+				return x[i], nil
+			}
+		}
+	case string:
+		if i, ok := index.(int64); ok {
+			runes := []rune(x)
+			if i < 0 {
+				i += int64(len(runes))
+			}
+			if i >= 0 && i < int64(len(runes)) {
+				return string(runes[i]), nil
+			}
+		}
+	}
+	return undefined{str(index)}, nil
+}
+
+func (e sliceExpr) eval(s *state) (any, error) {
+	x, err := e.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	var bounds [3]*int64
+	for i, b := range []expr{e.start, e.stop, e.step} {
+		if b == nil {
+			continue
+		}
+		v, err := b.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		n, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("slice indices must be integers, found %s", typeName(v))
+		}
+		bounds[i] = &n
+	}
+	switch x := x.(type) {
+	case []any:
+		indexes, err := sliceIndexes(len(x), bounds)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]any, len(indexes))
+		for i, index := range indexes {
+			list[i] = x[index]
+		}
+		return list, nil
+	case string:
+		runes := []rune(x)
+		indexes, err := sliceIndexes(len(runes), bounds)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]rune, len(indexes))
+		for i, index := range indexes {
+			result[i] = runes[index]
+		}
+		return string(result), nil
+	case undefined:
+		return nil, fmt.Errorf("'%s' is undefined, so it can't be sliced", x.name)
+	}
+	return nil, fmt.Errorf("%s can't be sliced", typeName(x))
+}
+
+// returns the indexes of the slice [start:stop:step] of a sequence of length n, with the semantics of Python.
+func sliceIndexes(n int, bounds [3]*int64) ([]int, error) {
+	step := 1
+	if bounds[2] != nil {
+		step = int(*bounds[2])
+		if step == 0 {
+			return nil, errors.New("slice step can't be zero")
+		}
+	}
+	// clamps the index to [lower, upper]
+	bound := func(b *int64, defaultValue, lower, upper int) int {
+		if b == nil {
+			return defaultValue
+		}
+		i := int(*b)
+		if i < 0 {
+			i += n
+		}
+		return min(max(i, lower), upper)
+	}
+	var indexes []int
+	if step > 0 {
+		start, stop := bound(bounds[0], 0, 0, n), bound(bounds[1], n, 0, n)
+		for i := start; i < stop; i += step {
+			indexes = append(indexes, i)
+		}
+	} else {
+		start, stop := bound(bounds[0], n-1, -1, n-1), bound(bounds[1], -1, -1, n-1)
+		for i := start; i > stop; i += step {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+func (a args) eval(s *state) (callArgs, error) {
+	ca := callArgs{positional: make([]any, len(a.positional)), keywords: make(map[string]any, len(a.keywords))}
+	for i, e := range a.positional {
+		var err error
+		ca.positional[i], err = e.eval(s)
+		if err != nil {
+			return ca, err
+		}
+	}
+	for _, kw := range a.keywords {
+		v, err := kw.value.eval(s)
+		if err != nil {
+			return ca, err
+		}
+		ca.keywords[kw.name] = v
+	}
+	return ca, nil
+}
+
+func (e callExpr) eval(s *state) (any, error) {
+	fn, err := e.fn.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	a, err := e.args.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch fn := fn.(type) {
+	case function:
+		return fn(a)
+	case method:
+		return callMethod(fn, a)
+	case undefined:
+		return nil, fmt.Errorf("'%s' is undefined, so it can't be called", fn.name)
+	}
+	return nil, fmt.Errorf("%s is not callable", typeName(fn))
+}
+
+func (e filterExpr) eval(s *state) (any, error) {
+	x, err := e.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	a, err := e.args.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	return applyFilter(e.name, x, a)
+}
+
+func applyFilter(name string, x any, a callArgs) (any, error) {
+	f, ok := filters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown filter '%s'", name)
+	}
+	v, err := f(x, a)
+	if err != nil {
+		return nil, fmt.Errorf("filter '%s': %w", name, err)
+	}
+	return v, nil
+}
+
+func (e testExpr) eval(s *state) (any, error) {
+	x, err := e.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	a, err := e.args.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	result, err := applyTest(e.name, x, a)
+	if err != nil {
+		return nil, err
+	}
+	return result != e.negated, nil
+}
+
+func applyTest(name string, x any, a callArgs) (bool, error) {
+	t, ok := tests[name]
+	if !ok {
+		return false, fmt.Errorf("unknown test '%s'", name)
+	}
+	return t(x, a)
+}
+
+func (e binaryExpr) eval(s *state) (any, error) {
+	a, err := e.a.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	b, err := e.b.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	return binaryOp(e.op, a, b)
+}
+
+// maximum length of the strings and lists that repetition and range() create, so templates can't use too much memory
+const maxLength = 1 << 20
+
+func binaryOp(op string, a, b any) (any, error) {
+	if op == "~" {
+		return str(a) + str(b), nil
+	}
+	switch op {
+	case "+":
+		switch a := a.(type) {
+		case string:
+			if b, ok := b.(string); ok {
+				return a + b, nil
+			}
+		case []any:
+			if b, ok := b.([]any); ok {
+				return append(a[:len(a):len(a)], b...), nil
+			}
+		}
+	case "*":
+		// repetition of strings and lists
+		if _, ok := a.(int64); ok {
+			a, b = b, a
+		}
+		if n, ok := b.(int64); ok {
+			n = max(n, 0)
+			switch a := a.(type) {
+			case string:
+				if len(a) > 0 && n > maxLength/int64(len(a)) {
+					return nil, fmt.Errorf("the repeated string is longer than %d bytes", maxLength)
+				}
+				return strings.Repeat(a, int(n)), nil
+			case []any:
+				if len(a) == 0 {
+					return []any{}, nil
+				}
+				if n > maxLength/int64(len(a)) {
+					return nil, fmt.Errorf("the repeated list is longer than %d items", maxLength)
+				}
+				var list []any
+				for i := int64(0); i < n; i++ {
+					list = append(list, a...)
+				}
+				return list, nil
+			}
+		}
+	}
+	x, xInt, okA := number(a)
+	y, yInt, okB := number(b)
+	if !okA || !okB {
+		return nil, fmt.Errorf("unsupported operand types for %s: %s and %s", op, typeName(a), typeName(b))
+	}
+	if xInt && yInt {
+		i, j := a.(int64), b.(int64)
+		switch op {
+		case "+":
+			sum := i + j
+			if (j > 0 && sum < i) || (j < 0 && sum > i) {
+				return nil, tooLargeError(op)
+			}
+			return sum, nil
+		case "-":
+			difference := i - j
+			if (j < 0 && difference < i) || (j > 0 && difference > i) {
+				return nil, tooLargeError(op)
+			}
+			return difference, nil
+		case "*":
+			product, ok := multiply(i, j)
+			if !ok {
+				return nil, tooLargeError(op)
+			}
+			return product, nil
+		case "//", "%":
+			if j == 0 {
+				return nil, errors.New("integer division or modulo by zero")
+			}
+			if op == "//" && i == math.MinInt64 && j == -1 {
+				return nil, tooLargeError(op)
+			}
+			// the result is rounded towards negative infinity, like in Python
+			q, r := i/j, i%j
+			if r != 0 && (r < 0) != (j < 0) {
+				q--
+				r += j
+			}
+			if op == "//" {
+				return q, nil
+			}
+			return r, nil
+		case "**":
+			if j >= 0 {
+				return power(i, j)
+			}
+		}
+	}
+	switch op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return x / y, nil
+	case "//":
+		if y == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Floor(x / y), nil
+	case "%":
+		if y == 0 {
+			return nil, errors.New("modulo by zero")
+		}
+		return x - math.Floor(x/y)*y, nil
+	case "**":
+		result := math.Pow(x, y)
+		if math.IsInf(result, 0) && !math.IsInf(x, 0) && !math.IsInf(y, 0) {
+			return nil, tooLargeError(op)
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+// returns the error of an arithmetic operation whose result overflows.
+// Integers are 64-bit instead of arbitrary-precision like in Python, so the error is returned instead of a wrong result.
+func tooLargeError(op string) error {
+	return fmt.Errorf("the result of %s is too large", op)
+}
+
+// returns base**exponent, or an error if it overflows, since integers are 64-bit instead of arbitrary-precision like in Python.
+// exponent must not be negative.
+func power(base, exponent int64) (int64, error) {
+	result := int64(1)
+	for exponent > 0 {
+		var ok bool
+		if exponent&1 == 1 {
+			result, ok = multiply(result, base)
+			if !ok {
+				return 0, tooLargeError("**")
+			}
+		}
+		exponent >>= 1
+		if exponent > 0 {
+			base, ok = multiply(base, base)
+			if !ok {
+				return 0, tooLargeError("**")
+			}
+		}
+	}
+	return result, nil
+}
+
+// returns a*b, and false if it overflows.
+func multiply(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	result := a * b
+	if result/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return result, true
+}
+
+// returns the value of a number as float64, whether it's an integer, and whether it's a number.
+func number(v any) (float64, bool, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true, true
+	case float64:
+		return v, false, true
+	}
+	return 0, false, false
+}
+
+func (e negExpr) eval(s *state) (any, error) {
+	x, err := e.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case int64:
+		if x == math.MinInt64 {
+			return nil, tooLargeError("-")
+		}
+		return -x, nil
+	case float64:
+		return -x, nil
+	}
+	return nil, fmt.Errorf("bad operand type for unary -: %s", typeName(x))
+}
+
+func (e notExpr) eval(s *state) (any, error) {
+	x, err := e.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	return !truth(x), nil
+}
+
+// like in Python, and and or return one of their operands
+func (e andExpr) eval(s *state) (any, error) {
+	a, err := e.a.eval(s)
+	if err != nil || !truth(a) {
+		return a, err
+	}
+	return e.b.eval(s)
+}
+
+func (e orExpr) eval(s *state) (any, error) {
+	a, err := e.a.eval(s)
+	if err != nil || truth(a) {
+		return a, err
+	}
+	return e.b.eval(s)
+}
+
+func (e compareExpr) eval(s *state) (any, error) {
+	a, err := e.first.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range e.ops {
+		b, err := e.operands[i].eval(s)
+		if err != nil {
+			return nil, err
+		}
+		result, err := compare(op, a, b)
+		if err != nil {
+			return nil, err
+		}
+		if !result {
+			return false, nil
+		}
+		a = b
+	}
+	return true, nil
+}
+
+func compare(op string, a, b any) (bool, error) {
+	switch op {
+	case "==":
+		return equal(a, b), nil
+	case "!=":
+		return !equal(a, b), nil
+	case "in", "not in":
+		found, err := in(a, b)
+		return found == (op == "in"), err
+	}
+	var c int
+	x, _, okA := number(a)
+	y, _, okB := number(b)
+	switch {
+	case okA && okB:
+		c = cmpFloat(x, y)
+	default:
+		s, okA := a.(string)
+		t, okB := b.(string)
+		if !okA || !okB {
+			return false, fmt.Errorf("'%s' not supported between %s and %s", op, typeName(a), typeName(b))
+		}
+		c = strings.Compare(s, t)
+	}
+	switch op {
+	case "<":
+		return c < 0, nil
+	case ">":
+		return c > 0, nil
+	case "<=":
+		return c <= 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func cmpFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// reports whether a is in b: a substring of a string, an item of a list, or a key of a dict.
+func in(a, b any) (bool, error) {
+	switch b := b.(type) {
+	case string:
+		s, ok := a.(string)
+		if !ok {
+			return false, fmt.Errorf("'in <string>' requires string as left operand, not %s", typeName(a))
+		}
+		return strings.Contains(b, s), nil
+	case []any:
+		return slices.ContainsFunc(b, func(item any) bool { return equal(a, item) }), nil
+	case *dict:
+		s, ok := a.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := b.values[s]
+		return found, nil
+	case undefined:
+		return false, fmt.Errorf("'%s' is undefined, so it can't contain values", b.name)
+	}
+	return false, fmt.Errorf("argument of type %s is not iterable", typeName(b))
+}
+
+func equal(a, b any) bool {
+	if x, _, ok := number(a); ok {
+		y, _, ok := number(b)
+		return ok && x == y
+	}
+	switch a := a.(type) {
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, equal)
+	case *dict:
+		b, ok := b.(*dict)
+		if !ok || len(a.keys) != len(b.keys) {
+			return false
+		}
+		for key, value := range a.values {
+			other, ok := b.values[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case undefined:
+		_, ok := b.(undefined)
+		return ok
+	case nil, bool, string:
+		return a == b
+	}
+	return false
+}
+
+func (e condExpr) eval(s *state) (any, error) {
+	cond, err := e.cond.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	if truth(cond) {
+		return e.then.eval(s)
+	}
+	return e.otherwise.eval(s)
+}
+
+// returns whether the value is true, with the semantics of Python.
+func truth(v any) bool {
+	switch v := v.(type) {
+	case undefined, nil:
+		return false
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []any:
+		return len(v) > 0
+	case *dict:
+		return len(v.keys) > 0
+	}
+	return true
+}
+
+// returns the items of a list, the keys of a dict, or the characters of a string.
+func iterate(v any) ([]any, error) {
+	switch v := v.(type) {
+	case []any:
+		return v, nil
+	case *dict:
+		keys := make([]any, len(v.keys))
+		for i, key := range v.keys {
+			keys[i] = key
+		}
+		return keys, nil
+	case string:
+		var chars []any
+		for _, r := range v {
+			chars = append(chars, string(r))
+		}
+		return chars, nil
+	case undefined:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%s is not iterable", typeName(v))
+}
+
+func length(v any) (int, error) {
+	switch v := v.(type) {
+	case string:
+		return utf8.RuneCountInString(v), nil
+	case []any:
+		return len(v), nil
+	case *dict:
+		return len(v.keys), nil
+	case undefined:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%s has no length", typeName(v))
+}
+
+// returns the name of the type of the value in error messages.
+func typeName(v any) string {
+	switch v.(type) {
+	case undefined:
+		return "undefined"
+	case nil:
+		return "none"
+	case bool:
+		return "boolean"
+	case int64:
+		return "integer"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case *dict:
+		return "dict"
+	case *namespace:
+		return "namespace"
+	case method, function:
+		return "function"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// returns the value as a string, like str() in Python.
+func str(v any) string {
+	switch v := v.(type) {
+	case undefined:
+		return ""
+	case string:
+		return v
+	case *namespace:
+		return "<Namespace " + str(v.attrs) + ">"
+	case method, function:
+		return "<function>"
+	}
+	return repr(v)
+}
+
+// returns the value as a string, like repr() in Python.
+func repr(v any) string {
+	switch v := v.(type) {
+	case undefined:
+		return ""
+	case nil:
+		return "None"
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return formatFloat(v)
+	case string:
+		quote := "'"
+		if strings.Contains(v, "'") && !strings.Contains(v, `"`) {
+			quote = `"`
+		}
+		var b strings.Builder
+		b.WriteString(quote)
+		for _, r := range v {
+			switch {
+			case r == '\\':
+				b.WriteString(`\\`)
+			case string(r) == quote:
+				b.WriteString(`\` + quote)
+			case r == '\n':
+				b.WriteString(`\n`)
+			case r == '\r':
+				b.WriteString(`\r`)
+			case r == '\t':
+				b.WriteString(`\t`)
+			case r < 0x20 || r == 0x7f:
+				fmt.Fprintf(&b, `\x%02x`, r)
+			default:
+				b.WriteRune(r)
+			}
+		}
+		b.WriteString(quote)
+		return b.String()
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = repr(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case *dict:
+		items := make([]string, len(v.keys))
+		for i, key := range v.keys {
+			items[i] = repr(key) + ": " + repr(v.values[key])
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+	return str(v)
+}
+
+// formats a float like Python: the shortest representation, with .0 if it's an integer.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// converts a value of the variables of Render to the values of expressions.
+func convert(v any) any {
+	switch v := v.(type) {
+	case nil, bool, string, int64, float64, *dict:
+		return v
+	case int:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case json.RawMessage:
+		decoded, err := decodeJSON(v)
+		if err != nil {
+			return string(v)
+		}
+		return decoded
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = convert(item)
+		}
+		return list
+	case []string:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = item
+		}
+		return list
+	case []map[string]any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = convert(item)
+		}
+		return list
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		d := newDict()
+		for _, key := range keys {
+			d.set(key, convert(v[key]))
+		}
+		return d
+	}
+	return fmt.Sprint(v)
+}
+
+// decodes JSON, keeping the order of the keys of objects.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return decodeJSONValue(dec)
+}
+
+func decodeJSONValue(dec *json.Decoder) (any, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := t.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			d := newDict()
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				d.set(key.(string), value)
+			}
+			_, err := dec.Token()
+			return d, err
+		case '[':
+			list := []any{}
+			for dec.More() {
+				value, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, value)
+			}
+			_, err := dec.Token()
+			return list, err
+		}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	}
+	return t, nil
+}
+
+// returns the value in JSON, like json.dumps() in Python, which the tojson filter of Hugging Face uses.
+// Without indent, items are separated by ", " and keys from values by ": ". Non-ASCII characters are not escaped.
+func toJSON(v any, indent string) (string, error) {
+	var b strings.Builder
+	err := writeJSON(&b, v, indent, 0)
+	return b.String(), err
+}
+
+func writeJSON(b *strings.Builder, v any, indent string, depth int) error {
+	separator := ", "
+	newline := ""
+	if indent != "" {
+		separator = ","
+		newline = "\n" + strings.Repeat(indent, depth+1)
+	}
+	closing := ""
+	if indent != "" {
+		closing = "\n" + strings.Repeat(indent, depth)
+	}
+	switch v := v.(type) {
+	case undefined, nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case int64:
+		b.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return fmt.Errorf("%s is not valid JSON", formatFloat(v))
+		}
+		b.WriteString(formatFloat(v))
+	case string:
+		writeJSONString(b, v)
+	case []any:
+		if len(v) == 0 {
+			b.WriteString("[]")
+			return nil
+		}
+		b.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(separator)
+			}
+			b.WriteString(newline)
+			err := writeJSON(b, item, indent, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		b.WriteString(closing + "]")
+	case *dict:
+		if len(v.keys) == 0 {
+			b.WriteString("{}")
+			return nil
+		}
+		b.WriteString("{")
+		for i, key := range v.keys {
+			if i > 0 {
+				b.WriteString(separator)
+			}
+			b.WriteString(newline)
+			writeJSONString(b, key)
+			b.WriteString(": ")
+			err := writeJSON(b, v.values[key], indent, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		b.WriteString(closing + "}")
+	case *namespace:
+		return writeJSON(b, v.attrs, indent, depth)
+	default:
+		return fmt.Errorf("%s can't be converted to JSON", typeName(v))
+	}
+	return nil
+}
+
+func writeJSONString(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+var globals = map[string]any{
+	"raise_exception": function(func(a callArgs) (any, error) {
+		return nil, &Exception{str(a.get(0, "message", ""))}
+	}),
+	"namespace": function(func(a callArgs) (any, error) {
+		ns := &namespace{newDict()}
+		if len(a.positional) > 0 {
+			d, ok := a.positional[0].(*dict)
+			if !ok {
+				return nil, fmt.Errorf("namespace() expects a dict, found %s", typeName(a.positional[0]))
+			}
+			for _, key := range d.keys {
+				ns.attrs.set(key, d.values[key])
+			}
+		}
+		keys := make([]string, 0, len(a.keywords))
+		for key := range a.keywords {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			ns.attrs.set(key, a.keywords[key])
+		}
+		return ns, nil
+	}),
+	"range": function(func(a callArgs) (any, error) {
+		var bounds []int64
+		for _, v := range a.positional {
+			n, ok := v.(int64)
+			if !ok {
+				return nil, fmt.Errorf("range() expects integers, found %s", typeName(v))
+			}
+			bounds = append(bounds, n)
+		}
+		start, stop, step := int64(0), int64(0), int64(1)
+		switch len(bounds) {
+		case 1:
+			stop = bounds[0]
+		case 2:
+			start, stop = bounds[0], bounds[1]
+		case 3:
+			start, stop, step = bounds[0], bounds[1], bounds[2]
+		default:
+			return nil, fmt.Errorf("range() expects 1 to 3 arguments, found %d", len(bounds))
+		}
+		if step == 0 {
+			return nil, errors.New("range() step can't be zero")
+		}
+		list := []any{}
+		for i := start; step > 0 && i < stop || step < 0 && i > stop; i += step {
+			if len(list) == maxLength {
+				return nil, fmt.Errorf("range() is longer than %d items", maxLength)
+			}
+			list = append(list, i)
+		}
+		return list, nil
+	}),
+}
+
+var stringMethods = []string{"strip", "lstrip", "rstrip", "upper", "lower", "title", "capitalize", "startswith", "endswith", "split", "replace", "join"}
+
+var dictMethods = []string{"items", "keys", "values", "get"}
+
+func callMethod(m method, a callArgs) (any, error) {
+	switch receiver := m.receiver.(type) {
+	case string:
+		return callStringMethod(receiver, m.name, a)
+	case *dict:
+		switch m.name {
+		case "items":
+			items := make([]any, len(receiver.keys))
+			for i, key := range receiver.keys {
+				items[i] = []any{key, receiver.values[key]}
+			}
+			return items, nil
+		case "keys":
+			return iterate(receiver)
+		case "values":
+			values := make([]any, len(receiver.keys))
+			for i, key := range receiver.keys {
+				values[i] = receiver.values[key]
+			}
+			return values, nil
+		case "get":
+			key, ok := a.get(0, "key", nil).(string)
+			if ok {
+				if v, ok := receiver.values[key]; ok {
+					return v, nil
+				}
+			}
+			return a.get(1, "default", nil), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown method '%s'", m.name)
+}
+
+func callStringMethod(s string, name string, a callArgs) (any, error) {
+	switch name {
+	case "strip", "lstrip", "rstrip":
+		cutset, _ := a.get(0, "chars", nil).(string)
+		trim := func(r rune) bool { return unicode.IsSpace(r) }
+		if a.get(0, "chars", nil) != nil {
+			trim = func(r rune) bool { return strings.ContainsRune(cutset, r) }
+		}
+		switch name {
+		case "strip":
+			return strings.TrimFunc(s, trim), nil
+		case "lstrip":
+			return strings.TrimLeftFunc(s, trim), nil
+		default:
+			return strings.TrimRightFunc(s, trim), nil
+		}
+	case "upper":
+		return strings.ToUpper(s), nil
+	case "lower":
+		return strings.ToLower(s), nil
+	case "title":
+		return title(s), nil
+	case "capitalize":
+		return capitalize(s), nil
+	case "startswith", "endswith":
+		has := strings.HasPrefix
+		if name == "endswith" {
+			has = strings.HasSuffix
+		}
+		switch affix := a.get(0, "prefix", nil).(type) {
+		case string:
+			return has(s, affix), nil
+		case []any:
+			// a tuple of prefixes or suffixes
+			return slices.ContainsFunc(affix, func(v any) bool {
+				affix, ok := v.(string)
+				return ok && has(s, affix)
+			}), nil
+		}
+		return nil, fmt.Errorf("%s() expects a string", name)
+	case "split":
+		n := -1
+		if maxsplit, ok := a.get(1, "maxsplit", int64(-1)).(int64); ok && maxsplit >= 0 {
+			n = int(maxsplit) + 1
+		}
+		var parts []string
+		if sep, ok := a.get(0, "sep", nil).(string); ok {
+			if sep == "" {
+				return nil, errors.New("split() separator is empty")
+			}
+			parts = strings.SplitN(s, sep, n)
+		} else if n < 0 {
+			parts = strings.Fields(s)
+		} else {
+			parts = splitFieldsN(s, n)
+		}
+		list := make([]any, len(parts))
+		for i, part := range parts {
+			list[i] = part
+		}
+		return list, nil
+	case "replace":
+		old, ok1 := a.get(0, "old", nil).(string)
+		replacement, ok2 := a.get(1, "new", nil).(string)
+		if !ok1 || !ok2 {
+			return nil, errors.New("replace() expects strings")
+		}
+		count, _ := a.get(2, "count", int64(-1)).(int64)
+		return strings.Replace(s, old, replacement, int(count)), nil
+	case "join":
+		items, err := iterate(a.get(0, "iterable", nil))
+		if err != nil {
+			return nil, err
+		}
+		parts := make([]string, len(items))
+		for i, item := range items {
+			parts[i] = str(item)
+		}
+		return strings.Join(parts, s), nil
+	}
+	return nil, fmt.Errorf("unknown method '%s'", name)
+}
+
+// splits the string at whitespace into at most n fields, like split(None, n-1) in Python.
+func splitFieldsN(s string, n int) []string {
+	var parts []string
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	for s != "" {
+		if len(parts) == n-1 {
+			return append(parts, s)
+		}
+		i := strings.IndexFunc(s, unicode.IsSpace)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+	}
+	return parts
+}
+
+// returns the string with the first letter of each word uppercase and the other letters lowercase, like title() in Python.
+func title(s string) string {
+	var b strings.Builder
+	previousIsLetter := false
+	for _, r := range s {
+		if previousIsLetter {
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		previousIsLetter = unicode.IsLetter(r)
+	}
+	return b.String()
+}
+
+// returns the string with the first character uppercase and the others lowercase.
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + strings.ToLower(s[size:])
+}
+
+var filters map[string]func(x any, a callArgs) (any, error)
+
+var tests map[string]func(x any, a callArgs) (bool, error)
+
+func init() {
+	filters = map[string]func(x any, a callArgs) (any, error){
+		"trim": func(x any, a callArgs) (any, error) {
+			return callStringMethod(str(x), "strip", a)
+		},
+		"upper": func(x any, a callArgs) (any, error) {
+			return strings.ToUpper(str(x)), nil
+		},
+		"lower": func(x any, a callArgs) (any, error) {
+			return strings.ToLower(str(x)), nil
+		},
+		"title": func(x any, a callArgs) (any, error) {
+			return title(str(x)), nil
+		},
+		"capitalize": func(x any, a callArgs) (any, error) {
+			return capitalize(str(x)), nil
+		},
+		"length": func(x any, a callArgs) (any, error) {
+			n, err := length(x)
+			return int64(n), err
+		},
+		"string": func(x any, a callArgs) (any, error) {
+			return str(x), nil
+		},
+		"safe": func(x any, a callArgs) (any, error) {
+			return x, nil
+		},
+		"int": func(x any, a callArgs) (any, error) {
+			switch x := x.(type) {
+			case int64:
+				return x, nil
+			case float64:
+				return int64(x), nil
+			case bool:
+				if x {
+					return int64(1), nil
+				}
+				return int64(0), nil
+			case string:
+				if i, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64); err == nil {
+					return i, nil
+				}
+				if f, err := strconv.ParseFloat(strings.TrimSpace(x), 64); err == nil {
+					return int64(f), nil
+				}
+			}
+			return a.get(0, "default", int64(0)), nil
+		},
+		"float": func(x any, a callArgs) (any, error) {
+			switch x := x.(type) {
+			case int64:
+				return float64(x), nil
+			case float64:
+				return x, nil
+			case string:
+				if f, err := strconv.ParseFloat(strings.TrimSpace(x), 64); err == nil {
+					return f, nil
+				}
+			}
+			return a.get(0, "default", 0.0), nil
+		},
+		"tojson": func(x any, a callArgs) (any, error) {
+			var indent string
+			switch n := a.get(0, "indent", nil).(type) {
+			case int64:
+				if n < 0 || n > maxLength {
+					return nil, fmt.Errorf("indent must be between 0 and %d", maxLength)
+				}
+				indent = strings.Repeat(" ", int(n))
+			case string:
+				indent = n
+			}
+			return toJSON(x, indent)
+		},
+		"join": func(x any, a callArgs) (any, error) {
+			items, err := iterate(x)
+			if err != nil {
+				return nil, err
+			}
+			attribute, hasAttribute := a.get(1, "attribute", nil).(string)
+			parts := make([]string, len(items))
+			for i, item := range items {
+				if hasAttribute {
+					item, err = getAttr(item, attribute)
+					if err != nil {
+						return nil, err
+					}
+				}
+				parts[i] = str(item)
+			}
+			return strings.Join(parts, str(a.get(0, "d", ""))), nil
+		},
+		"first": func(x any, a callArgs) (any, error) {
+			items, err := iterate(x)
+			if err != nil || len(items) == 0 {
+				return undefined{"first"}, err
+			}
+			return items[0], nil
+		},
+		"last": func(x any, a callArgs) (any, error) {
+			items, err := iterate(x)
+			if err != nil || len(items) == 0 {
+				return undefined{"last"}, err
+			}
+			return items[len(items)-1], nil
+		},
+		"reverse": func(x any, a callArgs) (any, error) {
+			if s, ok := x.(string); ok {
+				runes := []rune(s)
+				slices.Reverse(runes)
+				return string(runes), nil
+			}
+			items, err := iterate(x)
+			if err != nil {
+				return nil, err
+			}
+			items = slices.Clone(items)
+			slices.Reverse(items)
+			return items, nil
+		},
+		"list": func(x any, a callArgs) (any, error) {
+			items, err := iterate(x)
+			return slices.Clone(items), err
+		},
+		"items": func(x any, a callArgs) (any, error) {
+			if _, ok := x.(undefined); ok {
+				return []any{}, nil
+			}
+			d, ok := x.(*dict)
+			if !ok {
+				return nil, fmt.Errorf("expecting dict, found %s", typeName(x))
+			}
+			return callMethod(method{d, "items"}, a)
+		},
+		"default": func(x any, a callArgs) (any, error) {
+			_, isUndefined := x.(undefined)
+			if isUndefined || truth(a.get(1, "boolean", false)) && !truth(x) {
+				return a.get(0, "default_value", ""), nil
+			}
+			return x, nil
+		},
+		"replace": func(x any, a callArgs) (any, error) {
+			return callStringMethod(str(x), "replace", a)
+		},
+		"abs": func(x any, a callArgs) (any, error) {
+			switch x := x.(type) {
+			case int64:
+				return max(x, -x), nil
+			case float64:
+				return math.Abs(x), nil
+			}
+			return nil, fmt.Errorf("expecting number, found %s", typeName(x))
+		},
+		"selectattr": func(x any, a callArgs) (any, error) {
+			return selectAttr(x, a, true)
+		},
+		"rejectattr": func(x any, a callArgs) (any, error) {
+			return selectAttr(x, a, false)
+		},
+		"map": func(x any, a callArgs) (any, error) {
+			items, err := iterate(x)
+			if err != nil {
+				return nil, err
+			}
+			mapped := make([]any, len(items))
+			attribute, hasAttribute := a.keywords["attribute"].(string)
+			for i, item := range items {
+				if hasAttribute {
+					mapped[i], err = getAttr(item, attribute)
+					if defaultValue, ok := a.keywords["default"]; ok && err == nil {
+						if _, ok := mapped[i].(undefined); ok {
+							mapped[i] = defaultValue
+						}
+					}
+				} else {
+					name, ok := a.get(0, "filter", nil).(string)
+					if !ok {
+						return nil, errors.New("map() expects the name of a filter or an attribute")
+					}
+					mapped[i], err = applyFilter(name, item, callArgs{positional: a.positional[1:]})
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			return mapped, nil
+		},
+	}
+	filters["d"] = filters["default"]
+	filters["count"] = filters["length"]
+
+	tests = map[string]func(x any, a callArgs) (bool, error){
+		"defined": func(x any, a callArgs) (bool, error) {
+			_, ok := x.(undefined)
+			return !ok, nil
+		},
+		"undefined": func(x any, a callArgs) (bool, error) {
+			_, ok := x.(undefined)
+			return ok, nil
+		},
+		"none": func(x any, a callArgs) (bool, error) {
+			return x == nil, nil
+		},
+		"boolean": func(x any, a callArgs) (bool, error) {
+			_, ok := x.(bool)
+			return ok, nil
+		},
+		"true": func(x any, a callArgs) (bool, error) {
+			return x == true, nil
+		},
+		"false": func(x any, a callArgs) (bool, error) {
+			return x == false, nil
+		},
+		"string": func(x any, a callArgs) (bool, error) {
+			_, ok := x.(string)
+			return ok, nil
+		},
+		"number": func(x any, a callArgs) (bool, error) {
+			_, _, ok := number(x)
+			return ok, nil
+		},
+		"integer": func(x any, a callArgs) (bool, error) {
+			_, ok := x.(int64)
+			return ok, nil
+		},
+		"float": func(x any, a callArgs) (bool, error) {
+			_, ok := x.(float64)
+			return ok, nil
+		},
+		"mapping": func(x any, a callArgs) (bool, error) {
+			_, ok := x.(*dict)
+			return ok, nil
+		},
+		"sequence": func(x any, a callArgs) (bool, error) {
+			switch x.(type) {
+			case []any, string, *dict:
+				return true, nil
+			}
+			return false, nil
+		},
+		"iterable": func(x any, a callArgs) (bool, error) {
+			switch x.(type) {
+			case []any, string, *dict:
+				return true, nil
+			}
+			return false, nil
+		},
+		"callable": func(x any, a callArgs) (bool, error) {
+			switch x.(type) {
+			case method, function:
+				return true, nil
+			}
+			return false, nil
+		},
+		"odd": func(x any, a callArgs) (bool, error) {
+			i, ok := x.(int64)
+			return ok && i%2 != 0, nil
+		},
+		"even": func(x any, a callArgs) (bool, error) {
+			i, ok := x.(int64)
+			return ok && i%2 == 0, nil
+		},
+		"divisibleby": func(x any, a callArgs) (bool, error) {
+			i, ok1 := x.(int64)
+			j, ok2 := a.get(0, "num", nil).(int64)
+			if !ok1 || !ok2 || j == 0 {
+				return false, errors.New("divisibleby expects non-zero integers")
+			}
+			return i%j == 0, nil
+		},
+		"eq": func(x any, a callArgs) (bool, error) {
+			return equal(x, a.get(0, "other", nil)), nil
+		},
+		"ne": func(x any, a callArgs) (bool, error) {
+			return !equal(x, a.get(0, "other", nil)), nil
+		},
+		"in": func(x any, a callArgs) (bool, error) {
+			return in(x, a.get(0, "seq", nil))
+		},
+		"lower": func(x any, a callArgs) (bool, error) {
+			s, ok := x.(string)
+			return ok && s == strings.ToLower(s), nil
+		},
+		"upper": func(x any, a callArgs) (bool, error) {
+			s, ok := x.(string)
+			return ok && s == strings.ToUpper(s), nil
+		},
+	}
+	for alias, name := range map[string]string{"equalto": "eq", "==": "eq", "sameas": "eq", "!=": "ne"} {
+		tests[alias] = tests[name]
+	}
+	for op, name := range map[string]string{"<": "lt", ">": "gt", "<=": "le", ">=": "ge"} {
+		op := op
+		test := func(x any, a callArgs) (bool, error) {
+			return compare(op, x, a.get(0, "other", nil))
+		}
+		tests[op] = test
+		tests[name] = test
+	}
+	tests["lessthan"] = tests["lt"]
+	tests["greaterthan"] = tests["gt"]
+}
+
+// reports whether the test has an argument, which can be written without parentheses, e.g. x is divisibleby 3
+func testTakesArgument(name string) bool {
+	switch name {
+	case "divisibleby", "eq", "equalto", "==", "sameas", "ne", "!=", "lt", "gt", "le", "ge", "<", ">", "<=", ">=", "lessthan", "greaterthan", "in":
+		return true
+	}
+	return false
+}
+
+// returns the items whose attribute passes the test (or is true, if the test is not set), or, if selected is false, the items that don't.
+func selectAttr(x any, a callArgs, selected bool) (any, error) {
+	items, err := iterate(x)
+	if err != nil {
+		return nil, err
+	}
+	attribute, ok := a.get(0, "attribute", nil).(string)
+	if !ok {
+		return nil, errors.New("expecting the name of an attribute")
+	}
+	result := []any{}
+	for _, item := range items {
+		v, err := getAttr(item, attribute)
+		if err != nil {
+			return nil, err
+		}
+		passed := truth(v)
+		if len(a.positional) > 1 {
+			name, ok := a.positional[1].(string)
+			if !ok {
+				return nil, errors.New("expecting the name of a test")
+			}
+			passed, err = applyTest(name, v, callArgs{positional: a.positional[2:]})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if passed == selected {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,257 @@
+// Package jinja renders chat templates in the Jinja format of Hugging Face (the chat_template of tokenizer_config.json),
+// which model publishers use to define the prompt format of their models.
+// It implements the subset of Jinja that chat templates use: the statements if, for and set,
+// expressions with the operators, filters and tests of Jinja, the methods of Python strings and dicts,
+// and the functions raise_exception, namespace and range.
+// Templates are rendered like Hugging Face renders them, with the options trim_blocks and lstrip_blocks enabled.
+package jinja
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template is a parsed Jinja template.
+type Template struct {
+	nodes []node
+}
+
+// SyntaxError is an error in a template.
+type SyntaxError struct {
+	Line    int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// Exception is the error a template raises with raise_exception(), usually because the input is not supported by the template,
+// e.g. the roles of the messages don't alternate.
+type Exception struct {
+	Message string
+}
+
+func (e *Exception) Error() string {
+	return e.Message
+}
+
+// parses a template.
+func Parse(src string) (*Template, error) {
+	parts, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{parts: parts}
+	nodes, _, err := p.parseBody()
+	if err != nil {
+		return nil, err
+	}
+	return &Template{nodes}, nil
+}
+
+// renders the template with the variables.
+// The values of the variables can be nil, bool, string, int, int64, float64, json.RawMessage (which is decoded),
+// and []any, []string, []map[string]any or map[string]any of these.
+func (t *Template) Render(vars map[string]any) (string, error) {
+	s := &state{scope: &scope{vars: make(map[string]any, len(vars))}}
+	for name, value := range vars {
+		s.scope.vars[name] = convert(value)
+	}
+	err := s.execute(t.nodes)
+	if err != nil {
+		return "", err
+	}
+	return s.out.String(), nil
+}
+
+// scope of variables. The body of a loop has its own scope, so variables set in a loop are not visible after the loop.
+type scope struct {
+	vars   map[string]any
+	parent *scope
+}
+
+func (sc *scope) lookup(name string) (any, bool) {
+	for ; sc != nil; sc = sc.parent {
+		if v, ok := sc.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// state of the rendering of a template.
+type state struct {
+	scope *scope
+	out   strings.Builder
+}
+
+// node is a part of a template that is executed: text, output of an expression, or a statement.
+type node interface {
+	execute(s *state) error
+}
+
+type textNode string
+
+type outputNode struct {
+	e expr
+}
+
+type ifNode struct {
+	conds    []expr
+	bodies   [][]node
+	elseBody []node
+}
+
+type forNode struct {
+	targets []string
+	iter    expr
+	// nil if the loop doesn't filter the items
+	filter   expr
+	body     []node
+	elseBody []node
+}
+
+type setNode struct {
+	// if set, the statement sets the attribute targets[0] of the namespace
+	namespace string
+	targets   []string
+	value     expr
+}
+
+func (s *state) execute(nodes []node) error {
+	for _, n := range nodes {
+		err := n.execute(s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n textNode) execute(s *state) error {
+	s.out.WriteString(string(n))
+	return nil
+}
+
+func (n outputNode) execute(s *state) error {
+	v, err := n.e.eval(s)
+	if err != nil {
+		return err
+	}
+	s.out.WriteString(str(v))
+	return nil
+}
+
+func (n *ifNode) execute(s *state) error {
+	for i, cond := range n.conds {
+		v, err := cond.eval(s)
+		if err != nil {
+			return err
+		}
+		if truth(v) {
+			return s.execute(n.bodies[i])
+		}
+	}
+	return s.execute(n.elseBody)
+}
+
+func (n *forNode) execute(s *state) error {
+	v, err := n.iter.eval(s)
+	if err != nil {
+		return err
+	}
+	items, err := iterate(v)
+	if err != nil {
+		return err
+	}
+	parent := s.scope
+	defer func() { s.scope = parent }()
+	if n.filter != nil {
+		var filtered []any
+		for _, item := range items {
+			s.scope = &scope{vars: make(map[string]any), parent: parent}
+			err := assign(s, n.targets, item)
+			if err != nil {
+				return err
+			}
+			keep, err := n.filter.eval(s)
+			if err != nil {
+				return err
+			}
+			if truth(keep) {
+				filtered = append(filtered, item)
+			}
+		}
+		items = filtered
+	}
+	if len(items) == 0 {
+		s.scope = &scope{vars: make(map[string]any), parent: parent}
+		return s.execute(n.elseBody)
+	}
+	for i, item := range items {
+		s.scope = &scope{vars: make(map[string]any), parent: parent}
+		loop := newDict()
+		loop.set("index", int64(i+1))
+		loop.set("index0", int64(i))
+		loop.set("revindex", int64(len(items)-i))
+		loop.set("revindex0", int64(len(items)-i-1))
+		loop.set("first", i == 0)
+		loop.set("last", i == len(items)-1)
+		loop.set("length", int64(len(items)))
+		loop.set("previtem", undefined{"previtem"})
+		if i > 0 {
+			loop.set("previtem", items[i-1])
+		}
+		loop.set("nextitem", undefined{"nextitem"})
+		if i < len(items)-1 {
+			loop.set("nextitem", items[i+1])
+		}
+		s.scope.vars["loop"] = loop
+		err := assign(s, n.targets, item)
+		if err != nil {
+			return err
+		}
+		err = s.execute(n.body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assigns the value to the variables of the current scope. If there are many variables, the value is unpacked.
+func assign(s *state, targets []string, value any) error {
+	if len(targets) == 1 {
+		s.scope.vars[targets[0]] = value
+		return nil
+	}
+	items, err := iterate(value)
+	if err != nil {
+		return err
+	}
+	if len(items) != len(targets) {
+		return fmt.Errorf("can't unpack %d values to %d variables", len(items), len(targets))
+	}
+	for i, target := range targets {
+		s.scope.vars[target] = items[i]
+	}
+	return nil
+}
+
+func (n *setNode) execute(s *state) error {
+	value, err := n.value.eval(s)
+	if err != nil {
+		return err
+	}
+	if n.namespace == "" {
+		return assign(s, n.targets, value)
+	}
+	v, _ := s.scope.lookup(n.namespace)
+	ns, ok := v.(*namespace)
+	if !ok {
+		return fmt.Errorf("can't set attribute of '%s', because it's not a namespace", n.namespace)
+	}
+	ns.attrs.set(n.targets[0], value)
+	return nil
+}
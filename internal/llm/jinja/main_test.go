@@ -0,0 +1,174 @@
+package jinja
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func render(t *testing.T, src string, vars map[string]any) (string, error) {
+	tmpl, err := Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("Parse() failed: %w", err)
+	}
+	return tmpl.Render(vars)
+}
+
+func TestRender(t *testing.T) {
+	vars := map[string]any{
+		"messages": []map[string]any{{"role": "user", "content": " Hi "}, {"role": "assistant", "content": "Hello"}},
+		"n":        7,
+		"params":   json.RawMessage(`{"b": 1, "a": [1.5, "x\"y", null, true]}`),
+	}
+	for _, test := range []struct {
+		src      string
+		expected string
+	}{
+		{"{{ 'a' + 'b' ~ 1 }} {{ n // 2 }} {{ -n // 2 }} {{ n % 3 }} {{ -n % 3 }} {{ n / 2 }} {{ 2 ** 3 }} {{ 1.0 }} {{ 3 * 'ab' }}", "ab1 3 -4 1 2 3.5 8 1.0 ababab"},
+		{"{{ 2 ** 62 }} {{ -2 ** 63 }} {{ (-1) ** 1000000000000 }} {{ 0 ** 0 }} {{ 'ab' * -1 }}|{{ [] * 1000000000000 }}", "4611686018427387904 -9223372036854775808 1 1 |[]"},
+		{"{{ 1 < 2 < 3 }} {{ 1 < 3 < 2 }} {{ 1 == 1.0 }} {{ 'b' in 'abc' }} {{ 'x' not in ['x'] }} {{ not 1 is none }}", "True False True True False True"},
+		{"{{ none }} {{ [1, 'a', none] }} {{ {'a': 1} }} {{ undefined_variable }}|{{ 'x' if false }}|{{ false or 'y' }} {{ 0 and 1 }}", "None [1, 'a', None] {'a': 1} ||y 0"},
+		{"{{ messages[0].content | trim }} {{ messages[-1]['role'] }} {{ messages[5] is defined }} {{ messages[0].name is defined }}", "Hi assistant False False"},
+		{"{{ 'abc'[1:] }} {{ 'abc'[::-1] }} {{ [1, 2, 3][:-1] }} {{ 'ab'[5:] }}|{{ 'abc'[-1] }}", "bc cba [1, 2] |c"},
+		{"{{ ' x '.strip() }}|{{ 'xxaxx'.strip('x') }}|{{ 'hello world'.title() }}|{{ 'a,b'.split(',') }}|{{ 'ab'.startswith(('x', 'a')) }}|{{ 'aa'.replace('a', 'b') }}|{{ '-'.join(['a', 'b']) }}", "x|a|Hello World|['a', 'b']|True|bb|a-b"},
+		{"{{ params | tojson }}", `{"b": 1, "a": [1.5, "x\"y", null, true]}`},
+		{"{{ params.a | tojson(indent=2) }}", "[\n  1.5,\n  \"x\\\"y\",\n  null,\n  true\n]"},
+		{"{{ messages | selectattr('role', 'equalto', 'user') | map(attribute='content') | join('|') }} {{ messages | rejectattr('role', 'eq', 'user') | list | length }}", " Hi  1"},
+		{"{{ x | default('d') }} {{ '' | default('d', true) }} {{ messages | first | tojson }} {{ range(1, 7, 2) | list }} {{ [3, 1] | reverse | list }}", `d d {"content": " Hi ", "role": "user"} [1, 3, 5] [1, 3]`},
+		{"{% for k, v in params.items() %}{{ k }}={{ v }};{% endfor %} {% for k in params %}{{ k }}{% endfor %}", "b=1;a=[1.5, 'x\"y', None, True]; ba"},
+		{"{% for m in messages if m.role == 'assistant' %}{{ loop.index }}/{{ loop.length }} {{ m.content }}{% else %}none{% endfor %}{% for m in [] %}x{% else %} empty{% endfor %}", "1/1 Hello empty"},
+		{"{% for m in messages %}{{ loop.index0 }}{{ loop.first }}{{ loop.last }}{{ loop.revindex }}{% if not loop.last %},{% endif %}{% endfor %}", "0TrueFalse2,1FalseTrue1"},
+		{"{% set x = 1 %}{% for m in messages %}{% set x = 2 %}{% endfor %}{{ x }} {% set ns = namespace(x=1) %}{% for m in messages %}{% set ns.x = ns.x + 1 %}{% endfor %}{{ ns.x }}", "1 3"},
+		{"{% set a, b = [1, 2] %}{{ b }}{{ a }}", "21"},
+		{"{% if n > 10 %}a{% elif n > 5 %}b{% else %}c{% endif %}{% if n is odd %}o{% endif %}{% if n is divisibleby 7 %}d{% endif %}", "bod"},
+		// whitespace control, trim_blocks and lstrip_blocks
+		{"a\n  {% if true %}\n  b\n  {% endif %}\nc", "a\n  b\nc"},
+		{"a  {%- if true -%}  b  {%- endif %}  c", "ab  c"},
+		{"a {# comment #}\nb\n    {# comment #}\n{{ 'c' }}\n", "a b\nc\n"},
+		{"{% if true +%}\n  {%+ if true %}x{% endif %}{% endif %}", "\n  x"},
+		{"{{ {'a': {'b': 1}} }}{{ '}}' }}", "{'a': {'b': 1}}}}"},
+		{"{% generation %}x{% endgeneration %}", "x"},
+	} {
+		got, err := render(t, test.src, vars)
+		if err != nil {
+			fmt.Printf("render(%q) failed: %s\n", test.src, err)
+			t.Fail()
+			continue
+		}
+		if got != test.expected {
+			fmt.Printf("render(%q) = %q, expected %q\n", test.src, got, test.expected)
+			t.Fail()
+		}
+	}
+}
+
+// conversation with a system prompt
+var messagesWithSystem = []map[string]any{
+	{"role": "system", "content": "{{ system_prompt }}"},
+	{"role": "user", "content": "{{ user_msg_1 }}"},
+	{"role": "assistant", "content": "{{ model_answer_1 }}"},
+	{"role": "user", "content": "{{ user_msg_2 }}"},
+}
+
+// published chat templates of models, and the prompts they generate for messagesWithSystem, or for the messages without the system prompt
+// if the template doesn't support it
+var publishedTemplates = []struct {
+	name           string
+	src            string
+	supportsSystem bool
+	expected       string
+}{
+	{"Llama 3 Instruct", "{% set loop_messages = messages %}{% for message in loop_messages %}{% set content = '<|start_header_id|>' + message['role'] + '<|end_header_id|>\n\n'+ message['content'] | trim + '<|eot_id|>' %}{% if loop.index0 == 0 %}{% set content = bos_token + content %}{% endif %}{{ content }}{% endfor %}{% if add_generation_prompt %}{{ '<|start_header_id|>assistant<|end_header_id|>\n\n' }}{% endif %}", true,
+		"<s><|start_header_id|>system<|end_header_id|>\n\n{{ system_prompt }}<|eot_id|><|start_header_id|>user<|end_header_id|>\n\n{{ user_msg_1 }}<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n{{ model_answer_1 }}<|eot_id|><|start_header_id|>user<|end_header_id|>\n\n{{ user_msg_2 }}<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n"},
+	{"Llama 2 Chat", "{% if messages[0]['role'] == 'system' %}{% set loop_messages = messages[1:] %}{% set system_message = messages[0]['content'] %}{% else %}{% set loop_messages = messages %}{% set system_message = false %}{% endif %}{% for message in loop_messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if loop.index0 == 0 and system_message != false %}{% set content = '<<SYS>>\\n' + system_message + '\\n<</SYS>>\\n\\n' + message['content'] %}{% else %}{% set content = message['content'] %}{% endif %}{% if message['role'] == 'user' %}{{ bos_token + '[INST] ' + content.strip() + ' [/INST]' }}{% elif message['role'] == 'assistant' %}{{ ' '  + content.strip() + ' ' + eos_token }}{% endif %}{% endfor %}", true,
+		"<s>[INST] <<SYS>>\n{{ system_prompt }}\n<</SYS>>\n\n{{ user_msg_1 }} [/INST] {{ model_answer_1 }} </s><s>[INST] {{ user_msg_2 }} [/INST]"},
+	{"Mistral Instruct", "{{ bos_token }}{% for message in messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if message['role'] == 'user' %}{{ '[INST] ' + message['content'] + ' [/INST]' }}{% elif message['role'] == 'assistant' %}{{ message['content'] + eos_token}}{% else %}{{ raise_exception('Only user and assistant roles are supported!') }}{% endif %}{% endfor %}", false,
+		"<s>[INST] {{ user_msg_1 }} [/INST]{{ model_answer_1 }}</s>[INST] {{ user_msg_2 }} [/INST]"},
+	{"Zephyr", "{% for message in messages %}\n{% if message['role'] == 'user' %}\n{{ '<|user|>\n' + message['content'] + eos_token }}\n{% elif message['role'] == 'system' %}\n{{ '<|system|>\n' + message['content'] + eos_token }}\n{% elif message['role'] == 'assistant' %}\n{{ '<|assistant|>\n'  + message['content'] + eos_token }}\n{% endif %}\n{% if loop.last and add_generation_prompt %}\n{{ '<|assistant|>' }}\n{% endif %}\n{% endfor %}", true,
+		"<|system|>\n{{ system_prompt }}</s>\n<|user|>\n{{ user_msg_1 }}</s>\n<|assistant|>\n{{ model_answer_1 }}</s>\n<|user|>\n{{ user_msg_2 }}</s>\n<|assistant|>\n"},
+	{"ChatML", "{% for message in messages %}{{'<|im_start|>' + message['role'] + '\n' + message['content'] + '<|im_end|>' + '\n'}}{% endfor %}{% if add_generation_prompt %}{{ '<|im_start|>assistant\n' }}{% endif %}", true,
+		"<|im_start|>system\n{{ system_prompt }}<|im_end|>\n<|im_start|>user\n{{ user_msg_1 }}<|im_end|>\n<|im_start|>assistant\n{{ model_answer_1 }}<|im_end|>\n<|im_start|>user\n{{ user_msg_2 }}<|im_end|>\n<|im_start|>assistant\n"},
+	{"Gemma", "{{ bos_token }}{% if messages[0]['role'] == 'system' %}{{ raise_exception('System role not supported') }}{% endif %}{% for message in messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if (message['role'] == 'assistant') %}{% set role = 'model' %}{% else %}{% set role = message['role'] %}{% endif %}{{ '<start_of_turn>' + role + '\n' + message['content'] | trim + '<end_of_turn>\n' }}{% endfor %}{% if add_generation_prompt %}{{'<start_of_turn>model\n'}}{% endif %}", false,
+		"<s><start_of_turn>user\n{{ user_msg_1 }}<end_of_turn>\n<start_of_turn>model\n{{ model_answer_1 }}<end_of_turn>\n<start_of_turn>user\n{{ user_msg_2 }}<end_of_turn>\n<start_of_turn>model\n"},
+	{"Phi-3", "{% for message in messages %}{% if message['role'] == 'system' %}{{'<|system|>\n' + message['content'] + '<|end|>\n'}}{% elif message['role'] == 'user' %}{{'<|user|>\n' + message['content'] + '<|end|>\n'}}{% elif message['role'] == 'assistant' %}{{'<|assistant|>\n' + message['content'] + '<|end|>\n'}}{% endif %}{% endfor %}{% if add_generation_prompt %}{{ '<|assistant|>\n' }}{% else %}{{ eos_token }}{% endif %}", true,
+		"<|system|>\n{{ system_prompt }}<|end|>\n<|user|>\n{{ user_msg_1 }}<|end|>\n<|assistant|>\n{{ model_answer_1 }}<|end|>\n<|user|>\n{{ user_msg_2 }}<|end|>\n<|assistant|>\n"},
+	{"OpenChat 3.5", "{{ bos_token }}{% for message in messages %}{{ 'GPT4 Correct ' + message['role'].title() + ': ' + message['content'] + '<|end_of_turn|>'}}{% endfor %}{% if add_generation_prompt %}{{ 'GPT4 Correct Assistant:' }}{% endif %}", false,
+		"<s>GPT4 Correct User: {{ user_msg_1 }}<|end_of_turn|>GPT4 Correct Assistant: {{ model_answer_1 }}<|end_of_turn|>GPT4 Correct User: {{ user_msg_2 }}<|end_of_turn|>GPT4 Correct Assistant:"},
+}
+
+func TestPublishedTemplates(t *testing.T) {
+	for _, test := range publishedTemplates {
+		messages := messagesWithSystem
+		if !test.supportsSystem {
+			messages = messages[1:]
+		}
+		got, err := render(t, test.src, map[string]any{
+			"messages":              messages,
+			"bos_token":             "<s>",
+			"eos_token":             "</s>",
+			"add_generation_prompt": true,
+		})
+		if err != nil {
+			fmt.Printf("%s: render failed: %s\n", test.name, err)
+			t.Fail()
+			continue
+		}
+		if got != test.expected {
+			fmt.Printf("%s: render() = %q\nexpected: %q\n", test.name, got, test.expected)
+			t.Fail()
+		}
+	}
+}
+
+func TestRaiseException(t *testing.T) {
+	for _, test := range publishedTemplates {
+		if test.name != "Gemma" {
+			continue
+		}
+		_, err := render(t, test.src, map[string]any{"messages": messagesWithSystem})
+		var exception *Exception
+		if !errors.As(err, &exception) || exception.Message != "System role not supported" {
+			fmt.Printf("render() error = %v, expected exception 'System role not supported'\n", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, test := range []struct {
+		src     string
+		message string
+	}{
+		{"{% if true %}", "Parse() failed: line 1: unexpected end of template: expecting 'elif' or 'else' or 'endif'"},
+		{"a\n{% for %}", "Parse() failed: line 2: expecting name of loop variable"},
+		{"{{ 'a' ", "Parse() failed: line 1: unclosed tag: expecting '}}'"},
+		{"{{ 'a }}", "Parse() failed: line 1: unclosed string"},
+		{"{{ 1 + }}", "Parse() failed: line 1: unexpected end of tag: expecting expression"},
+		{"{% macro m() %}{% endmacro %}", "Parse() failed: line 1: unknown statement 'macro'"},
+		{"{{ a b }}", "Parse() failed: line 1: unexpected 'b': expecting end of tag"},
+		{"{{ x.y }}", "'x' is undefined, so it has no attribute 'y'"},
+		{"{{ 1 + 'a' }}", "unsupported operand types for +: integer and string"},
+		{"{{ x | unknown }}", "unknown filter 'unknown'"},
+		{"{% set x.y = 1 %}", "can't set attribute of 'x', because it's not a namespace"},
+		{"{{ [1] | tojson(indent=-1) }}", "filter 'tojson': indent must be between 0 and 1048576"},
+		{"{{ 2 ** 100000 }}", "the result of ** is too large"},
+		{"{{ -3 ** 41 }}", "the result of ** is too large"},
+		{"{{ 10.0 ** 400 }}", "the result of ** is too large"},
+		{"{{ 9223372036854775807 + 1 }}", "the result of + is too large"},
+		{"{{ -9223372036854775807 - 2 }}", "the result of - is too large"},
+		{"{{ 9223372036854775807 * 2 }}", "the result of * is too large"},
+		{"{{ (2 ** 62) * 4 }}", "the result of * is too large"},
+		{"{{ (-2 ** 63) // -1 }}", "the result of // is too large"},
+		{"{{ 'a,b'.split('') }}", "split() separator is empty"},
+		{"{{ 'ab' * 1000000 }}", "the repeated string is longer than 1048576 bytes"},
+		{"{{ [1, 2] * 1000000 }}", "the repeated list is longer than 1048576 items"},
+		{"{{ range(10000000) | length }}", "range() is longer than 1048576 items"},
+	} {
+		_, err := render(t, test.src, nil)
+		if err == nil || err.Error() != test.message {
+			fmt.Printf("render(%q) error = %v, expected %s\n", test.src, err, test.message)
+			t.Fail()
+		}
+	}
+}
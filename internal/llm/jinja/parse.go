@@ -0,0 +1,985 @@
+package jinja
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenType int
+
+const (
+	tokenName tokenType = iota
+	tokenString
+	tokenInt
+	tokenFloat
+	tokenOperator
+	// end of the tokens of a tag
+	tokenEnd
+)
+
+type token struct {
+	typ   tokenType
+	value string
+	line  int
+}
+
+// kinds of the parts of a template
+const (
+	partText = iota
+	// {{ expression }}
+	partOutput
+	// {% statement %}
+	partStatement
+)
+
+// part of a template: text, or the tokens of a tag.
+type part struct {
+	kind   int
+	text   string
+	tokens []token
+	line   int
+}
+
+// operators, longest first, so the longest match is found
+var operators = []string{"//", "**", "==", "!=", "<=", ">=", "+", "-", "*", "/", "%", "~", "<", ">", "=", "(", ")", "[", "]", "{", "}", ",", ".", ":", "|"}
+
+func isSpace(r rune) bool {
+	return unicode.IsSpace(r)
+}
+
+// splits the template into text and tags, applying the whitespace control of the tags
+// and the options trim_blocks and lstrip_blocks, which are enabled when chat templates are rendered.
+// trim_blocks removes the first newline after a statement or a comment,
+// and lstrip_blocks removes the spaces and tabs before a statement or a comment at the start of a line.
+func lex(src string) ([]part, error) {
+	var parts []part
+	pos := 0
+	line := 1
+	// how the text after the previous tag is trimmed: 0 not trimmed, 1 the first newline, 2 all whitespace
+	trimNext := 0
+	for {
+		i := nextTag(src, pos)
+		end := i
+		if i < 0 {
+			end = len(src)
+		}
+		text := src[pos:end]
+		switch trimNext {
+		case 1:
+			if strings.HasPrefix(text, "\r\n") {
+				text = text[2:]
+			} else {
+				text = strings.TrimPrefix(text, "\n")
+			}
+		case 2:
+			text = strings.TrimLeftFunc(text, isSpace)
+		}
+		if i < 0 {
+			if text != "" {
+				parts = append(parts, part{kind: partText, text: text, line: line})
+			}
+			return parts, nil
+		}
+		kind := src[i+1]
+		j := i + 2
+		modifier := byte(0)
+		if j < len(src) && (src[j] == '-' || src[j] == '+') {
+			modifier = src[j]
+			j++
+		}
+		if modifier == '-' {
+			text = strings.TrimRightFunc(text, isSpace)
+		} else if kind != '{' && modifier != '+' {
+			lineStart := strings.LastIndexByte(src[:i], '\n') + 1
+			if lineStart >= pos && strings.Trim(src[lineStart:i], " \t") == "" {
+				text = strings.TrimRight(text, " \t")
+			}
+		}
+		if text != "" {
+			parts = append(parts, part{kind: partText, text: text, line: line})
+		}
+		line += strings.Count(src[pos:i], "\n")
+		tagLine := line
+		var tokens []token
+		var endModifier byte
+		var err error
+		if kind == '#' {
+			k := strings.Index(src[j:], "#}")
+			if k < 0 {
+				return nil, &SyntaxError{line, "unclosed comment"}
+			}
+			k += j
+			if k > j && (src[k-1] == '-' || src[k-1] == '+') {
+				endModifier = src[k-1]
+			}
+			line += strings.Count(src[i:k], "\n")
+			pos = k + 2
+		} else {
+			tokens, endModifier, pos, err = lexTag(src, j, kind, &line)
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case endModifier == '-':
+			trimNext = 2
+		case kind != '{' && endModifier != '+':
+			trimNext = 1
+		default:
+			trimNext = 0
+		}
+		switch kind {
+		case '{':
+			parts = append(parts, part{kind: partOutput, tokens: tokens, line: tagLine})
+		case '%':
+			parts = append(parts, part{kind: partStatement, tokens: tokens, line: tagLine})
+		}
+	}
+}
+
+// returns the index of the next {{, {% or {#, or -1 if there is none.
+func nextTag(src string, pos int) int {
+	for {
+		i := strings.IndexByte(src[pos:], '{')
+		if i < 0 || pos+i+1 >= len(src) {
+			return -1
+		}
+		i += pos
+		switch src[i+1] {
+		case '{', '%', '#':
+			return i
+		}
+		pos = i + 1
+	}
+}
+
+// reads the tokens of a tag that starts at pos, up to the end of the tag (}} or %}).
+// Returns the modifier before the end of the tag (- or +, or 0), and the position after the end of the tag.
+func lexTag(src string, pos int, kind byte, line *int) ([]token, byte, int, error) {
+	closing := "}}"
+	if kind == '%' {
+		closing = "%}"
+	}
+	var tokens []token
+	// depth of brackets, so }} in a dict literal doesn't end the tag
+	depth := 0
+	for {
+		for pos < len(src) && isSpace(rune(src[pos])) {
+			if src[pos] == '\n' {
+				*line++
+			}
+			pos++
+		}
+		if pos >= len(src) {
+			return nil, 0, 0, &SyntaxError{*line, fmt.Sprintf("unclosed tag: expecting '%s'", closing)}
+		}
+		rest := src[pos:]
+		if depth == 0 {
+			for _, modifier := range []byte{'-', '+', 0} {
+				end := closing
+				if modifier != 0 {
+					end = string(modifier) + closing
+				}
+				if strings.HasPrefix(rest, end) {
+					tokens = append(tokens, token{typ: tokenEnd, line: *line})
+					return tokens, modifier, pos + len(end), nil
+				}
+			}
+		}
+		c := rest[0]
+		switch {
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			n := 1
+			for n < len(rest) && (rest[n] == '_' || rest[n] >= 'a' && rest[n] <= 'z' || rest[n] >= 'A' && rest[n] <= 'Z' || rest[n] >= '0' && rest[n] <= '9') {
+				n++
+			}
+			tokens = append(tokens, token{tokenName, rest[:n], *line})
+			pos += n
+		case c >= '0' && c <= '9':
+			n := 1
+			typ := tokenInt
+			for n < len(rest) && (rest[n] >= '0' && rest[n] <= '9' || rest[n] == '_') {
+				n++
+			}
+			if n+1 < len(rest) && rest[n] == '.' && rest[n+1] >= '0' && rest[n+1] <= '9' {
+				typ = tokenFloat
+				n++
+				for n < len(rest) && rest[n] >= '0' && rest[n] <= '9' {
+					n++
+				}
+			}
+			if n < len(rest) && (rest[n] == 'e' || rest[n] == 'E') {
+				m := n + 1
+				if m < len(rest) && (rest[m] == '+' || rest[m] == '-') {
+					m++
+				}
+				if m < len(rest) && rest[m] >= '0' && rest[m] <= '9' {
+					typ = tokenFloat
+					n = m
+					for n < len(rest) && rest[n] >= '0' && rest[n] <= '9' {
+						n++
+					}
+				}
+			}
+			tokens = append(tokens, token{typ, strings.ReplaceAll(rest[:n], "_", ""), *line})
+			pos += n
+		case c == '\'' || c == '"':
+			value, n, err := unquote(rest)
+			if err != nil {
+				return nil, 0, 0, &SyntaxError{*line, err.Error()}
+			}
+			*line += strings.Count(rest[:n], "\n")
+			tokens = append(tokens, token{tokenString, value, *line})
+			pos += n
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(rest, o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, 0, 0, &SyntaxError{*line, fmt.Sprintf("unexpected character '%c'", c)}
+			}
+			switch op {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+			tokens = append(tokens, token{tokenOperator, op, *line})
+			pos += len(op)
+		}
+	}
+}
+
+// parses the string literal at the start of s, and returns its value and its length in s.
+func unquote(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			case '\\', '\'', '"':
+				b.WriteByte(s[i])
+			case 'u', 'x':
+				size := 4
+				if s[i] == 'x' {
+					size = 2
+				}
+				if i+size >= len(s) {
+					return "", 0, fmt.Errorf("invalid escape sequence in string")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid escape sequence in string")
+				}
+				b.WriteRune(rune(r))
+				i += size
+			case '\n':
+				// line continuation
+			default:
+				// unknown escape sequences are kept, like in Python
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unclosed string")
+}
+
+// parser parses the parts of a template into nodes.
+type parser struct {
+	parts []part
+	pos   int
+	// tokens of the current tag
+	tokens []token
+	tpos   int
+}
+
+// parses nodes until one of the statements endTags, and returns the nodes and the name of the statement.
+// The tokens of the statement after its name are left to be parsed by the caller.
+func (p *parser) parseBody(endTags ...string) ([]node, string, error) {
+	var nodes []node
+	for p.pos < len(p.parts) {
+		pt := p.parts[p.pos]
+		p.pos++
+		switch pt.kind {
+		case partText:
+			nodes = append(nodes, textNode(pt.text))
+		case partOutput:
+			p.tokens, p.tpos = pt.tokens, 0
+			e, err := p.parseExpression(true)
+			if err != nil {
+				return nil, "", err
+			}
+			err = p.expectEnd()
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, outputNode{e})
+		case partStatement:
+			p.tokens, p.tpos = pt.tokens, 0
+			t := p.next()
+			if t.typ != tokenName {
+				return nil, "", &SyntaxError{t.line, "expecting statement name"}
+			}
+			for _, endTag := range endTags {
+				if t.value == endTag {
+					return nodes, endTag, nil
+				}
+			}
+			n, err := p.parseStatement(t)
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, n...)
+		}
+	}
+	if len(endTags) > 0 {
+		return nil, "", &SyntaxError{p.lastLine(), fmt.Sprintf("unexpected end of template: expecting '%s'", strings.Join(endTags, "' or '"))}
+	}
+	return nodes, "", nil
+}
+
+func (p *parser) lastLine() int {
+	if len(p.parts) == 0 {
+		return 1
+	}
+	last := p.parts[len(p.parts)-1]
+	return last.line + strings.Count(last.text, "\n")
+}
+
+func (p *parser) parseStatement(t token) ([]node, error) {
+	switch t.value {
+	case "if":
+		return p.parseIf()
+	case "for":
+		return p.parseFor()
+	case "set":
+		return p.parseSet()
+	case "generation":
+		// marks the text of the assistant for training. It doesn't affect the output
+		err := p.expectEnd()
+		if err != nil {
+			return nil, err
+		}
+		body, _, err := p.parseBody("endgeneration")
+		if err != nil {
+			return nil, err
+		}
+		return body, p.expectEnd()
+	}
+	return nil, &SyntaxError{t.line, fmt.Sprintf("unknown statement '%s'", t.value)}
+}
+
+func (p *parser) parseIf() ([]node, error) {
+	n := &ifNode{}
+	for {
+		cond, err := p.parseExpression(true)
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectEnd()
+		if err != nil {
+			return nil, err
+		}
+		body, endTag, err := p.parseBody("elif", "else", "endif")
+		if err != nil {
+			return nil, err
+		}
+		n.conds = append(n.conds, cond)
+		n.bodies = append(n.bodies, body)
+		switch endTag {
+		case "else":
+			err = p.expectEnd()
+			if err != nil {
+				return nil, err
+			}
+			n.elseBody, _, err = p.parseBody("endif")
+			if err != nil {
+				return nil, err
+			}
+			return []node{n}, p.expectEnd()
+		case "endif":
+			return []node{n}, p.expectEnd()
+		}
+	}
+}
+
+func (p *parser) parseFor() ([]node, error) {
+	n := &forNode{}
+	for {
+		t := p.next()
+		if t.typ != tokenName {
+			return nil, &SyntaxError{t.line, "expecting name of loop variable"}
+		}
+		n.targets = append(n.targets, t.value)
+		if !p.skipOperator(",") {
+			break
+		}
+	}
+	t := p.next()
+	if t.typ != tokenName || t.value != "in" {
+		return nil, &SyntaxError{t.line, "expecting 'in'"}
+	}
+	var err error
+	// the iterable can't be a conditional expression, because 'if' filters the items
+	n.iter, err = p.parseExpression(false)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipName("if") {
+		n.filter, err = p.parseExpression(false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = p.expectEnd()
+	if err != nil {
+		return nil, err
+	}
+	body, endTag, err := p.parseBody("else", "endfor")
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	if endTag == "else" {
+		err = p.expectEnd()
+		if err != nil {
+			return nil, err
+		}
+		n.elseBody, _, err = p.parseBody("endfor")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []node{n}, p.expectEnd()
+}
+
+func (p *parser) parseSet() ([]node, error) {
+	n := &setNode{}
+	t := p.next()
+	if t.typ != tokenName {
+		return nil, &SyntaxError{t.line, "expecting name of variable"}
+	}
+	if p.skipOperator(".") {
+		attr := p.next()
+		if attr.typ != tokenName {
+			return nil, &SyntaxError{attr.line, "expecting name of attribute"}
+		}
+		n.namespace = t.value
+		n.targets = []string{attr.value}
+	} else {
+		n.targets = []string{t.value}
+		for p.skipOperator(",") {
+			t := p.next()
+			if t.typ != tokenName {
+				return nil, &SyntaxError{t.line, "expecting name of variable"}
+			}
+			n.targets = append(n.targets, t.value)
+		}
+	}
+	if !p.skipOperator("=") {
+		return nil, &SyntaxError{p.peek().line, "expecting '='"}
+	}
+	var err error
+	n.value, err = p.parseTuple()
+	if err != nil {
+		return nil, err
+	}
+	return []node{n}, p.expectEnd()
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.tpos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.tpos]
+	if t.typ != tokenEnd {
+		p.tpos++
+	}
+	return t
+}
+
+// skips the next token if it's the operator op.
+func (p *parser) skipOperator(op string) bool {
+	if t := p.peek(); t.typ == tokenOperator && t.value == op {
+		p.tpos++
+		return true
+	}
+	return false
+}
+
+// skips the next token if it's the name.
+func (p *parser) skipName(name string) bool {
+	if t := p.peek(); t.typ == tokenName && t.value == name {
+		p.tpos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectOperator(op string) error {
+	if !p.skipOperator(op) {
+		return p.unexpected(fmt.Sprintf("expecting '%s'", op))
+	}
+	return nil
+}
+
+func (p *parser) expectEnd() error {
+	if p.peek().typ != tokenEnd {
+		return p.unexpected("expecting end of tag")
+	}
+	return nil
+}
+
+func (p *parser) unexpected(message string) error {
+	t := p.peek()
+	if t.typ == tokenEnd {
+		return &SyntaxError{t.line, fmt.Sprintf("unexpected end of tag: %s", message)}
+	}
+	return &SyntaxError{t.line, fmt.Sprintf("unexpected '%s': %s", t.value, message)}
+}
+
+// parses expressions separated by commas. More than one expression is a tuple, which is a list.
+func (p *parser) parseTuple() (expr, error) {
+	e, err := p.parseExpression(true)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().typ != tokenOperator || p.peek().value != "," {
+		return e, nil
+	}
+	items := []expr{e}
+	for p.skipOperator(",") {
+		e, err := p.parseExpression(true)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, e)
+	}
+	return listExpr(items), nil
+}
+
+// parses an expression. If withCondition is false, the expression can't be a conditional expression (x if y else z).
+func (p *parser) parseExpression(withCondition bool) (expr, error) {
+	e, err := p.parseOr()
+	if err != nil || !withCondition {
+		return e, err
+	}
+	for p.skipName("if") {
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		var otherwise expr = literal{undefined{}}
+		if p.skipName("else") {
+			otherwise, err = p.parseExpression(true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		e = condExpr{cond, e, otherwise}
+	}
+	return e, nil
+}
+
+func (p *parser) parseOr() (expr, error) {
+	e, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.skipName("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		e = orExpr{e, right}
+	}
+	return e, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	e, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.skipName("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		e = andExpr{e, right}
+	}
+	return e, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if p.skipName("not") {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (expr, error) {
+	e, err := p.parseMath1()
+	if err != nil {
+		return nil, err
+	}
+	c := compareExpr{first: e}
+	for {
+		t := p.peek()
+		var op string
+		switch {
+		case t.typ == tokenOperator && (t.value == "==" || t.value == "!=" || t.value == "<" || t.value == ">" || t.value == "<=" || t.value == ">="):
+			op = t.value
+			p.tpos++
+		case t.typ == tokenName && t.value == "in":
+			op = "in"
+			p.tpos++
+		case t.typ == tokenName && t.value == "not" && p.tokens[p.tpos+1].typ == tokenName && p.tokens[p.tpos+1].value == "in":
+			op = "not in"
+			p.tpos += 2
+		}
+		if op == "" {
+			break
+		}
+		right, err := p.parseMath1()
+		if err != nil {
+			return nil, err
+		}
+		c.ops = append(c.ops, op)
+		c.operands = append(c.operands, right)
+	}
+	if len(c.ops) == 0 {
+		return e, nil
+	}
+	return c, nil
+}
+
+// parses a sequence of binary operators of the same precedence, with operands parsed by parseOperand.
+func (p *parser) parseBinary(ops []string, parseOperand func() (expr, error)) (expr, error) {
+	e, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.typ != tokenOperator || !slices.Contains(ops, t.value) {
+			return e, nil
+		}
+		p.tpos++
+		right, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		e = binaryExpr{t.value, e, right}
+	}
+}
+
+func (p *parser) parseMath1() (expr, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseConcat)
+}
+
+func (p *parser) parseConcat() (expr, error) {
+	return p.parseBinary([]string{"~"}, p.parseMath2)
+}
+
+func (p *parser) parseMath2() (expr, error) {
+	return p.parseBinary([]string{"*", "/", "//", "%"}, p.parsePow)
+}
+
+func (p *parser) parsePow() (expr, error) {
+	return p.parseBinary([]string{"**"}, func() (expr, error) { return p.parseUnary(true) })
+}
+
+func (p *parser) parseUnary(withFilter bool) (expr, error) {
+	var e expr
+	var err error
+	switch {
+	case p.skipOperator("-"):
+		e, err = p.parseUnary(false)
+		e = negExpr{e}
+	case p.skipOperator("+"):
+		e, err = p.parseUnary(false)
+	default:
+		e, err = p.parsePrimary()
+		if err == nil {
+			e, err = p.parsePostfix(e)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if withFilter {
+		return p.parseFilterExpr(e)
+	}
+	return e, nil
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.next()
+	switch t.typ {
+	case tokenName:
+		switch t.value {
+		case "true", "True":
+			return literal{true}, nil
+		case "false", "False":
+			return literal{false}, nil
+		case "none", "None":
+			return literal{nil}, nil
+		}
+		return nameExpr(t.value), nil
+	case tokenString:
+		s := t.value
+		// adjacent strings are concatenated
+		for p.peek().typ == tokenString {
+			s += p.next().value
+		}
+		return literal{s}, nil
+	case tokenInt:
+		n, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			return nil, &SyntaxError{t.line, fmt.Sprintf("invalid integer '%s'", t.value)}
+		}
+		return literal{n}, nil
+	case tokenFloat:
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, &SyntaxError{t.line, fmt.Sprintf("invalid number '%s'", t.value)}
+		}
+		return literal{f}, nil
+	case tokenOperator:
+		switch t.value {
+		case "(":
+			if p.skipOperator(")") {
+				return listExpr(nil), nil
+			}
+			e, err := p.parseTuple()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expectOperator(")")
+		case "[":
+			var items []expr
+			for !p.skipOperator("]") {
+				if len(items) > 0 {
+					err := p.expectOperator(",")
+					if err != nil {
+						return nil, err
+					}
+					if p.skipOperator("]") {
+						break
+					}
+				}
+				e, err := p.parseExpression(true)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, e)
+			}
+			return listExpr(items), nil
+		case "{":
+			d := dictExpr{}
+			for !p.skipOperator("}") {
+				if len(d.keys) > 0 {
+					err := p.expectOperator(",")
+					if err != nil {
+						return nil, err
+					}
+					if p.skipOperator("}") {
+						break
+					}
+				}
+				key, err := p.parseExpression(true)
+				if err != nil {
+					return nil, err
+				}
+				err = p.expectOperator(":")
+				if err != nil {
+					return nil, err
+				}
+				value, err := p.parseExpression(true)
+				if err != nil {
+					return nil, err
+				}
+				d.keys = append(d.keys, key)
+				d.values = append(d.values, value)
+			}
+			return d, nil
+		}
+	}
+	if t.typ != tokenEnd {
+		p.tpos--
+	}
+	return nil, p.unexpected("expecting expression")
+}
+
+func (p *parser) parsePostfix(e expr) (expr, error) {
+	for {
+		switch {
+		case p.skipOperator("."):
+			t := p.next()
+			switch t.typ {
+			case tokenName:
+				e = attrExpr{e, t.value}
+			case tokenInt:
+				n, _ := strconv.ParseInt(t.value, 10, 64)
+				e = itemExpr{e, literal{n}}
+			default:
+				return nil, &SyntaxError{t.line, "expecting name of attribute"}
+			}
+		case p.skipOperator("["):
+			var err error
+			e, err = p.parseSubscript(e)
+			if err != nil {
+				return nil, err
+			}
+		case p.skipOperator("("):
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = callExpr{e, args}
+		default:
+			return e, nil
+		}
+	}
+}
+
+// parses the subscript after [, which is an index or a slice.
+func (p *parser) parseSubscript(e expr) (expr, error) {
+	var bounds [3]expr
+	isSlice := false
+	for i := 0; i < 3; i++ {
+		t := p.peek()
+		if !(t.typ == tokenOperator && (t.value == ":" || t.value == "]")) {
+			var err error
+			bounds[i], err = p.parseExpression(true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if i == 2 || !p.skipOperator(":") {
+			break
+		}
+		isSlice = true
+	}
+	err := p.expectOperator("]")
+	if err != nil {
+		return nil, err
+	}
+	if !isSlice {
+		if bounds[0] == nil {
+			return nil, p.unexpected("expecting index")
+		}
+		return itemExpr{e, bounds[0]}, nil
+	}
+	return sliceExpr{e, bounds[0], bounds[1], bounds[2]}, nil
+}
+
+// parses the arguments of a call after (, up to ).
+func (p *parser) parseArgs() (args, error) {
+	var a args
+	for !p.skipOperator(")") {
+		if len(a.positional) > 0 || len(a.keywords) > 0 {
+			err := p.expectOperator(",")
+			if err != nil {
+				return a, err
+			}
+			if p.skipOperator(")") {
+				break
+			}
+		}
+		if t := p.peek(); t.typ == tokenName && p.tokens[p.tpos+1].typ == tokenOperator && p.tokens[p.tpos+1].value == "=" {
+			p.tpos += 2
+			value, err := p.parseExpression(true)
+			if err != nil {
+				return a, err
+			}
+			a.keywords = append(a.keywords, keywordArg{t.value, value})
+			continue
+		}
+		if len(a.keywords) > 0 {
+			return a, p.unexpected("positional argument after keyword argument")
+		}
+		value, err := p.parseExpression(true)
+		if err != nil {
+			return a, err
+		}
+		a.positional = append(a.positional, value)
+	}
+	return a, nil
+}
+
+// parses the filters (x | name) and the tests (x is name) after an expression.
+func (p *parser) parseFilterExpr(e expr) (expr, error) {
+	for {
+		switch {
+		case p.skipOperator("|"):
+			name, a, err := p.parseNameAndArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = filterExpr{e, name, a}
+		case p.skipName("is"):
+			negated := p.skipName("not")
+			name, a, err := p.parseNameAndArgs()
+			if err != nil {
+				return nil, err
+			}
+			if len(a.positional) == 0 && len(a.keywords) == 0 && testTakesArgument(name) {
+				// the argument of a test can be written without parentheses, e.g. x is divisibleby 3
+				if t := p.peek(); t.typ == tokenString || t.typ == tokenInt || t.typ == tokenFloat ||
+					t.typ == tokenName && !slices.Contains([]string{"and", "or", "else", "if", "not", "in", "is"}, t.value) {
+					arg, err := p.parsePrimary()
+					if err != nil {
+						return nil, err
+					}
+					a.positional = []expr{arg}
+				}
+			}
+			e = testExpr{e, name, a, negated}
+		default:
+			return e, nil
+		}
+	}
+}
+
+// parses the name of a filter or a test, and the arguments in parentheses if there are any.
+func (p *parser) parseNameAndArgs() (string, args, error) {
+	t := p.next()
+	if t.typ != tokenName {
+		return "", args{}, &SyntaxError{t.line, "expecting name of filter or test"}
+	}
+	if p.skipOperator("(") {
+		a, err := p.parseArgs()
+		return t.value, a, err
+	}
+	return t.value, args{}, nil
+}
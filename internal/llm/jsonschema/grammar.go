@@ -0,0 +1,253 @@
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// rules of the grammar for JSON values that are not constrained by the schema.
+// Whitespace is limited, so the model can't generate whitespace forever.
+var primitiveRules = []struct {
+	name string
+	body string
+	// rules the rule references
+	deps []string
+}{
+	{"ws", `| " " | "\n" [ \t]*`, nil},
+	{"value", `object | array | string | number | boolean | null`, []string{"object", "array", "string", "number", "boolean", "null"}},
+	{"object", `"{" ws ( string ":" ws value ( "," ws string ":" ws value )* )? "}" ws`, []string{"string", "value", "ws"}},
+	{"array", `"[" ws ( value ( "," ws value )* )? "]" ws`, []string{"value", "ws"}},
+	{"string", `"\"" char* "\"" ws`, []string{"char", "ws"}},
+	{"char", `[^"\\\x7F\x00-\x1F] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] )`, nil},
+	{"number", `"-"? ( "0" | [1-9] [0-9]* ) ( "." [0-9]+ )? ( [eE] [-+]? [0-9]+ )? ws`, []string{"ws"}},
+	{"integer", `"-"? ( "0" | [1-9] [0-9]* ) ws`, []string{"ws"}},
+	{"boolean", `( "true" | "false" ) ws`, []string{"ws"}},
+	{"null", `"null" ws`, []string{"ws"}},
+}
+
+type generator struct {
+	// rules in the order they are added
+	rules []string
+	names map[string]bool
+}
+
+// returns a GBNF grammar that accepts the JSON texts that validate against the schema.
+// Objects have the required properties first, followed by the optional properties,
+// and each group is in the order the properties are defined in the schema.
+func (s *Schema) Grammar() string {
+	g := &generator{names: make(map[string]bool)}
+	g.rule(s, "root")
+	return strings.Join(g.rules, "\n") + "\n"
+}
+
+// adds a rule for the schema with a unique name based on name, and returns the name of the rule.
+func (g *generator) rule(s *Schema, name string) string {
+	name = g.uniqueName(name)
+	g.names[name] = true
+	i := len(g.rules)
+	// the rule is added before its body is generated, so it's before the rules it references
+	g.rules = append(g.rules, "")
+	g.rules[i] = name + " ::= " + g.body(s, name)
+	return name
+}
+
+// returns name if it's not used by a rule, or name followed by a number.
+func (g *generator) uniqueName(name string) string {
+	// rule names can have only letters, digits and dashes
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, name)
+	unique := name
+	for i := 1; g.names[unique] || isPrimitive(unique); i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	return unique
+}
+
+func isPrimitive(name string) bool {
+	for _, rule := range primitiveRules {
+		if rule.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// adds the rule of a primitive and the rules it references, if they are not added, and returns its name.
+func (g *generator) primitive(name string) string {
+	if g.names[name] {
+		return name
+	}
+	g.names[name] = true
+	for _, rule := range primitiveRules {
+		if rule.name == name {
+			g.rules = append(g.rules, name+" ::= "+rule.body)
+			for _, dep := range rule.deps {
+				g.primitive(dep)
+			}
+		}
+	}
+	return name
+}
+
+// returns the body of the rule of the schema.
+func (g *generator) body(s *Schema, name string) string {
+	if s.enum != nil {
+		// only the values that validate against the rest of the schema are generated
+		var alternatives []string
+		for _, value := range s.enum {
+			if s.Validate(value) == nil {
+				alternatives = append(alternatives, literal(jsonText(value)))
+			}
+		}
+		return "( " + strings.Join(alternatives, " | ") + " ) " + g.primitive("ws")
+	}
+	var alternatives []string
+	switch {
+	case s.anyOf != nil:
+		for i, sub := range s.anyOf {
+			alternatives = append(alternatives, g.rule(sub, fmt.Sprintf("%s-%d", name, i)))
+		}
+	case len(s.types) == 0:
+		return g.primitive("value")
+	default:
+		for _, t := range s.types {
+			alternatives = append(alternatives, g.typeBody(s, t, name))
+		}
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0]
+	}
+	return "( " + strings.Join(alternatives, " ) | ( ") + " )"
+}
+
+// returns the grammar for values of the type t that validate against the schema.
+func (g *generator) typeBody(s *Schema, t string, name string) string {
+	ws := g.primitive("ws")
+	switch t {
+	case "object":
+		if len(s.properties) == 0 {
+			if s.additionalProperties {
+				return g.primitive("object")
+			}
+			return `"{" ` + ws + ` "}" ` + ws
+		}
+		var required, optional []string
+		for _, p := range s.properties {
+			keyValue := literal(jsonText(p.name)) + " " + ws + ` ":" ` + ws + " " + g.rule(p.schema, name+"-"+p.name)
+			if s.required[p.name] {
+				required = append(required, keyValue)
+			} else {
+				optional = append(optional, keyValue)
+			}
+		}
+		return `"{" ` + ws + " " + properties(required, optional, ws) + ` "}" ` + ws
+	case "array":
+		var item string
+		if s.items != nil {
+			item = g.rule(s.items, name+"-item")
+		} else {
+			item = g.primitive("value")
+		}
+		return `"[" ` + ws + " " + repetition(item, s.minItems, s.maxItems, ws) + ` "]" ` + ws
+	}
+	return g.primitive(t)
+}
+
+// returns the grammar of the properties of an object separated by commas.
+// The required properties are all present and the optional properties are present or not, in the given order.
+func properties(required, optional []string, ws string) string {
+	comma := `"," ` + ws + " "
+	var b strings.Builder
+	for i, p := range required {
+		if i > 0 {
+			b.WriteString(" " + comma)
+		}
+		b.WriteString(p)
+	}
+	if len(required) > 0 {
+		for _, p := range optional {
+			b.WriteString(" ( " + comma + p + " )?")
+		}
+		return b.String()
+	}
+	// without required properties, the first property that is present has no comma before it
+	var alternatives []string
+	for i, p := range optional {
+		alternative := p
+		for _, next := range optional[i+1:] {
+			alternative += " ( " + comma + next + " )?"
+		}
+		alternatives = append(alternatives, alternative)
+	}
+	return "( " + strings.Join(alternatives, " | ") + " )?"
+}
+
+// returns the grammar of at least minItems and at most maxItems (-1 = no limit) items separated by commas.
+func repetition(item string, minItems, maxItems int, ws string) string {
+	if maxItems == 0 {
+		return ""
+	}
+	next := `"," ` + ws + " " + item
+	rest := strings.Repeat(" "+next, max(minItems-1, 0))
+	if maxItems < 0 {
+		rest += " ( " + next + " )*"
+	} else {
+		// nested, so that there is only one way to parse the items
+		optional := ""
+		for i := max(minItems, 1); i < maxItems; i++ {
+			if optional == "" {
+				optional = "( " + next + " )?"
+			} else {
+				optional = "( " + next + " " + optional + " )?"
+			}
+		}
+		if optional != "" {
+			rest += " " + optional
+		}
+	}
+	if minItems == 0 {
+		return "( " + item + rest + " )?"
+	}
+	return item + rest
+}
+
+// returns the JSON encoding of the value without insignificant whitespace.
+func jsonText(v any) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	// the value was decoded from JSON, so it can be encoded
+	_ = enc.Encode(v)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// returns a GBNF string literal of the text.
+func literal(text string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range text {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7F:
+			fmt.Fprintf(&b, `\x%02X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
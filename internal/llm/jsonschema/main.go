@@ -0,0 +1,433 @@
+// Package jsonschema converts a JSON Schema to a GBNF grammar, so the generated text is JSON that validates against the schema,
+// and validates JSON values against the schema.
+// Only the subset of JSON Schema that can be expressed as a grammar is supported.
+// Schemas that use other keywords are rejected with an error, instead of being partially enforced.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Schema is a parsed JSON Schema.
+type Schema struct {
+	// allowed types. Empty means any type
+	types      []string
+	properties []property
+	required   map[string]bool
+	// false if additionalProperties is false
+	additionalProperties bool
+	// nil if items is not set
+	items    *Schema
+	minItems int
+	// -1 if maxItems is not set
+	maxItems int
+	// allowed values, nil if neither enum nor const is set
+	enum []any
+	// nil if anyOf is not set
+	anyOf []*Schema
+}
+
+// property of an object, in the order it's defined in the schema.
+type property struct {
+	name   string
+	schema *Schema
+}
+
+// Error is an error in a schema, or a value that doesn't validate against the schema.
+type Error struct {
+	// JSON pointer to the part of the schema or the value the error is about, e.g. "#/properties/name"
+	Path    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// maximum value of minItems and maxItems, and maximum number of properties of an object.
+// The size of the grammar grows with them, quadratically for maxItems and for optional properties.
+const maxCount = 100
+
+var types = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// keywords that don't affect validation, so they are ignored
+var annotations = []string{"$schema", "$id", "$comment", "title", "description", "default", "examples"}
+
+// parses a JSON Schema.
+func Parse(data []byte) (*Schema, error) {
+	return parse(data, "#")
+}
+
+func parse(data json.RawMessage, path string) (*Schema, error) {
+	s := &Schema{additionalProperties: true, maxItems: -1}
+	var b bool
+	if json.Unmarshal(data, &b) == nil {
+		if !b {
+			return nil, &Error{path, "the schema false is not supported"}
+		}
+		return s, nil
+	}
+	var keywords map[string]json.RawMessage
+	err := json.Unmarshal(data, &keywords)
+	if err != nil {
+		return nil, &Error{path, "the schema must be an object or a boolean"}
+	}
+	names := make([]string, 0, len(keywords))
+	for name := range keywords {
+		names = append(names, name)
+	}
+	// the errors don't depend on the order of the map
+	slices.Sort(names)
+	var required []string
+	for _, name := range names {
+		value := keywords[name]
+		keywordPath := path + "/" + escapePointer(name)
+		switch name {
+		case "type":
+			s.types, err = parseTypes(value, keywordPath)
+		case "properties":
+			err = s.parseProperties(value, keywordPath)
+		case "required":
+			err = json.Unmarshal(value, &required)
+			if err != nil {
+				err = &Error{keywordPath, "must be an array of strings"}
+			}
+		case "additionalProperties":
+			err = json.Unmarshal(value, &s.additionalProperties)
+			if err != nil {
+				err = &Error{keywordPath, "only true and false are supported"}
+			}
+		case "items":
+			s.items, err = parse(value, keywordPath)
+		case "minItems":
+			s.minItems, err = parseCount(value, keywordPath)
+		case "maxItems":
+			s.maxItems, err = parseCount(value, keywordPath)
+		case "enum":
+			s.enum, err = parseEnum(value, keywordPath)
+		case "const":
+			var v any
+			v, err = decode(value)
+			s.enum = []any{v}
+		case "anyOf":
+			var schemas []json.RawMessage
+			err = json.Unmarshal(value, &schemas)
+			if err != nil || len(schemas) == 0 {
+				return nil, &Error{keywordPath, "must be a non-empty array of schemas"}
+			}
+			for i, schema := range schemas {
+				sub, err := parse(schema, keywordPath+"/"+strconv.Itoa(i))
+				if err != nil {
+					return nil, err
+				}
+				s.anyOf = append(s.anyOf, sub)
+			}
+		default:
+			if !slices.Contains(annotations, name) {
+				return nil, &Error{keywordPath, fmt.Sprintf("unsupported keyword '%s'", name)}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.anyOf != nil && slices.ContainsFunc(names, func(name string) bool {
+		return name != "anyOf" && !slices.Contains(annotations, name)
+	}) {
+		return nil, &Error{path, "anyOf can't be combined with other keywords"}
+	}
+	if s.maxItems >= 0 && s.maxItems < s.minItems {
+		return nil, &Error{path, "maxItems is less than minItems"}
+	}
+	s.required = make(map[string]bool, len(required))
+	for _, name := range required {
+		if !slices.ContainsFunc(s.properties, func(p property) bool { return p.name == name }) {
+			return nil, &Error{path + "/required", fmt.Sprintf("required property '%s' is not defined in properties", name)}
+		}
+		s.required[name] = true
+	}
+	if s.enum != nil && !slices.ContainsFunc(s.enum, func(v any) bool { return s.Validate(v) == nil }) {
+		return nil, &Error{path, "no value of enum or const validates against the schema"}
+	}
+	return s, nil
+}
+
+func parseTypes(data json.RawMessage, path string) ([]string, error) {
+	var t string
+	var ts []string
+	if json.Unmarshal(data, &t) == nil {
+		ts = []string{t}
+	} else if json.Unmarshal(data, &ts) != nil || len(ts) == 0 {
+		return nil, &Error{path, "must be a string or a non-empty array of strings"}
+	}
+	for _, t := range ts {
+		if !slices.Contains(types, t) {
+			return nil, &Error{path, fmt.Sprintf("unknown type '%s'", t)}
+		}
+	}
+	return ts, nil
+}
+
+func (s *Schema) parseProperties(data json.RawMessage, path string) error {
+	var properties map[string]json.RawMessage
+	err := json.Unmarshal(data, &properties)
+	if err != nil {
+		return &Error{path, "must be an object"}
+	}
+	// the properties are generated in the order they are defined, so the order is read from the JSON text
+	names, err := objectKeys(data)
+	if err != nil {
+		return &Error{path, "must be an object"}
+	}
+	if len(names) > maxCount {
+		return &Error{path, fmt.Sprintf("unsupported number of properties greater than %d", maxCount)}
+	}
+	for _, name := range names {
+		sub, err := parse(properties[name], path+"/"+escapePointer(name))
+		if err != nil {
+			return err
+		}
+		s.properties = append(s.properties, property{name: name, schema: sub})
+	}
+	return nil
+}
+
+// returns the keys of the JSON object in the order they appear.
+func objectKeys(data json.RawMessage) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	_, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key.(string))
+		var value json.RawMessage
+		err = dec.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func parseCount(data json.RawMessage, path string) (int, error) {
+	var n int
+	err := json.Unmarshal(data, &n)
+	if err != nil || n < 0 {
+		return 0, &Error{path, "must be a non-negative integer"}
+	}
+	if n > maxCount {
+		return 0, &Error{path, fmt.Sprintf("unsupported value greater than %d", maxCount)}
+	}
+	return n, nil
+}
+
+func parseEnum(data json.RawMessage, path string) ([]any, error) {
+	var values []json.RawMessage
+	err := json.Unmarshal(data, &values)
+	if err != nil || len(values) == 0 {
+		return nil, &Error{path, "must be a non-empty array"}
+	}
+	enum := make([]any, len(values))
+	for i, value := range values {
+		enum[i], err = decode(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return enum, nil
+}
+
+// decodes a JSON value, with numbers as json.Number, so they are not rounded.
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// escapes a key of an object to be part of a JSON pointer.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// parses the text as JSON and validates it against the schema.
+// The numbers of the returned value are json.Number.
+func (s *Schema) Unmarshal(text string) (any, error) {
+	v, err := decode([]byte(text))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err)
+	}
+	err = s.Validate(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// validates a value decoded from JSON with json.Number numbers.
+func (s *Schema) Validate(v any) error {
+	return s.validate(v, "#")
+}
+
+func (s *Schema) validate(v any, path string) error {
+	if len(s.types) > 0 && !slices.ContainsFunc(s.types, func(t string) bool { return hasType(v, t) }) {
+		return &Error{path, fmt.Sprintf("expected %s, found %s", strings.Join(s.types, " or "), typeOf(v))}
+	}
+	if s.enum != nil && !slices.ContainsFunc(s.enum, func(e any) bool { return equal(v, e) }) {
+		return &Error{path, "the value is not one of the allowed values"}
+	}
+	if s.anyOf != nil {
+		var errs []error
+		for _, sub := range s.anyOf {
+			err := sub.validate(v, path)
+			if err == nil {
+				errs = nil
+				break
+			}
+			errs = append(errs, err)
+		}
+		if errs != nil {
+			return &Error{path, fmt.Sprintf("the value doesn't match any schema of anyOf: %s", errors.Join(errs...))}
+		}
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, p := range s.properties {
+			value, ok := v[p.name]
+			if !ok {
+				if s.required[p.name] {
+					return &Error{path, fmt.Sprintf("missing required property '%s'", p.name)}
+				}
+				continue
+			}
+			err := p.schema.validate(value, path+"/"+escapePointer(p.name))
+			if err != nil {
+				return err
+			}
+		}
+		if !s.additionalProperties {
+			for name := range v {
+				if !slices.ContainsFunc(s.properties, func(p property) bool { return p.name == name }) {
+					return &Error{path, fmt.Sprintf("unexpected property '%s'", name)}
+				}
+			}
+		}
+	case []any:
+		if len(v) < s.minItems {
+			return &Error{path, fmt.Sprintf("expected at least %d items, found %d", s.minItems, len(v))}
+		}
+		if s.maxItems >= 0 && len(v) > s.maxItems {
+			return &Error{path, fmt.Sprintf("expected at most %d items, found %d", s.maxItems, len(v))}
+		}
+		if s.items != nil {
+			for i, item := range v {
+				err := s.items.validate(item, path+"/"+strconv.Itoa(i))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if isInteger(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func hasType(v any, t string) bool {
+	if n, ok := v.(json.Number); ok && t == "number" {
+		return numberValue(n) != nil
+	}
+	return typeOf(v) == t
+}
+
+// returns the value of the number, or nil if it's not a valid number.
+func numberValue(n json.Number) *big.Rat {
+	r, ok := new(big.Rat).SetString(string(n))
+	if !ok {
+		return nil
+	}
+	return r
+}
+
+// reports whether the number is an integer. Numbers with a zero fractional part, like 1.0, are integers.
+func isInteger(n json.Number) bool {
+	r := numberValue(n)
+	return r != nil && r.IsInt()
+}
+
+// reports whether the JSON values are equal. Numbers are compared by value, so 1 and 1.0 are equal.
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, y := numberValue(a), numberValue(b)
+		return x != nil && y != nil && x.Cmp(y) == 0
+	}
+	return a == b
+}
@@ -0,0 +1,159 @@
+package jsonschema
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"cmitsakis/llm-api/internal/llm/grammar"
+)
+
+const schemaPerson = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string"},
+		"age": {"type": "integer"},
+		"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2}
+	},
+	"required": ["name"],
+	"additionalProperties": false
+}`
+
+func TestGrammar(t *testing.T) {
+	s, err := Parse([]byte(schemaPerson))
+	if err != nil {
+		fmt.Printf("Parse() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	expected := `root ::= "{" ws "\"name\"" ws ":" ws root-name ( "," ws "\"age\"" ws ":" ws root-age )? ( "," ws "\"tags\"" ws ":" ws root-tags )? "}" ws
+ws ::= | " " | "\n" [ \t]*
+root-name ::= string
+string ::= "\"" char* "\"" ws
+char ::= [^"\\\x7F\x00-\x1F] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] )
+root-age ::= integer
+integer ::= "-"? ( "0" | [1-9] [0-9]* ) ws
+root-tags ::= "[" ws ( root-tags-item ( "," ws root-tags-item )? )? "]" ws
+root-tags-item ::= ( "\"a\"" | "\"b\"" ) ws
+`
+	if got := s.Grammar(); got != expected {
+		fmt.Printf("Grammar() = \n%s\nexpected:\n%s\n", got, expected)
+		t.Fail()
+	}
+}
+
+// the grammars must be accepted by the GBNF parser
+func TestGrammarIsValid(t *testing.T) {
+	for _, schema := range []string{
+		schemaPerson,
+		`{}`,
+		`true`,
+		`{"type": "object"}`,
+		`{"type": "object", "additionalProperties": false}`,
+		`{"type": "object", "properties": {"a b": {}, "a-b": {"type": "boolean"}, "\"q\"": {"const": "x\ny"}}}`,
+		`{"type": ["string", "null"]}`,
+		`{"anyOf": [{"type": "number"}, {"type": "array", "items": {"type": "string"}, "minItems": 2, "maxItems": 4}]}`,
+		`{"type": "array", "minItems": 1}`,
+		`{"type": "array", "maxItems": 0}`,
+		`{"enum": [1, "one", null, {"a": [true]}]}`,
+		`{"type": "array", "minItems": 50, "maxItems": 100}`,
+		manyProperties(100),
+	} {
+		s, err := Parse([]byte(schema))
+		if err != nil {
+			fmt.Printf("Parse(%s) failed: %s\n", schema, err)
+			t.Fail()
+			continue
+		}
+		_, err = grammar.Parse(s.Grammar())
+		if err != nil {
+			fmt.Printf("grammar of %s is invalid: %s\n%s\n", schema, err, s.Grammar())
+			t.Fail()
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	for _, test := range []struct {
+		schema  string
+		message string
+	}{
+		{`{"type": "string", "pattern": "^a"}`, "#/pattern: unsupported keyword 'pattern'"},
+		{`{"$ref": "#/$defs/a"}`, "#/$ref: unsupported keyword '$ref'"},
+		{`{"properties": {"a": {"oneOf": []}}}`, "#/properties/a/oneOf: unsupported keyword 'oneOf'"},
+		{`{"additionalProperties": {"type": "string"}}`, "#/additionalProperties: only true and false are supported"},
+		{`{"type": "date"}`, "#/type: unknown type 'date'"},
+		{`{"properties": {"a": {}}, "required": ["b"]}`, "#/required: required property 'b' is not defined in properties"},
+		{`{"anyOf": [{}], "type": "string"}`, "#: anyOf can't be combined with other keywords"},
+		{`{"type": "string", "enum": [1, 2]}`, "#: no value of enum or const validates against the schema"},
+		{`{"minItems": 2, "maxItems": 1}`, "#: maxItems is less than minItems"},
+		{`{"maxItems": 101}`, "#/maxItems: unsupported value greater than 100"},
+		{`{"minItems": 1000000}`, "#/minItems: unsupported value greater than 100"},
+		{manyProperties(101), "#/properties: unsupported number of properties greater than 100"},
+		{`false`, "#: the schema false is not supported"},
+		{`[]`, "#: the schema must be an object or a boolean"},
+	} {
+		_, err := Parse([]byte(test.schema))
+		if err == nil || err.Error() != test.message {
+			fmt.Printf("Parse(%s) error = %v, expected %s\n", test.schema, err, test.message)
+			t.Fail()
+		}
+	}
+}
+
+// returns a schema of an object with n optional properties.
+func manyProperties(n int) string {
+	properties := make([]string, n)
+	for i := range properties {
+		properties[i] = fmt.Sprintf(`"p%d": {}`, i)
+	}
+	return `{"properties": {` + strings.Join(properties, ", ") + `}}`
+}
+
+func TestUnmarshal(t *testing.T) {
+	s, err := Parse([]byte(schemaPerson))
+	if err != nil {
+		fmt.Printf("Parse() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	for _, test := range []struct {
+		text    string
+		message string
+	}{
+		{`{"name": "Bob", "age": 3.0, "tags": ["a"]} `, ""},
+		{`{"name": "Bob"}`, ""},
+		{`{"age": 3}`, "#: missing required property 'name'"},
+		{`{"name": "Bob", "age": 3.5}`, "#/age: expected integer, found number"},
+		{`{"name": "Bob", "tags": ["a", "c"]}`, "#/tags/1: the value is not one of the allowed values"},
+		{`{"name": "Bob", "tags": ["a", "b", "a"]}`, "#/tags: expected at most 2 items, found 3"},
+		{`{"name": "Bob", "extra": 1}`, "#: unexpected property 'extra'"},
+		{`{"name": "Bob"} {}`, "invalid JSON: unexpected data after the JSON value"},
+		{`["Bob"]`, "#: expected object, found array"},
+	} {
+		_, err := s.Unmarshal(test.text)
+		if test.message == "" && err != nil || test.message != "" && (err == nil || err.Error() != test.message) {
+			fmt.Printf("Unmarshal(%s) error = %v, expected %q\n", test.text, err, test.message)
+			t.Fail()
+		}
+	}
+}
+
+func TestEnumNumbers(t *testing.T) {
+	s, err := Parse([]byte(`{"anyOf": [{"const": 1}, {"const": "1"}]}`))
+	if err != nil {
+		fmt.Printf("Parse() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	for _, text := range []string{`1`, `1.0`, `1e0`, `"1"`} {
+		if _, err := s.Unmarshal(text); err != nil {
+			fmt.Printf("Unmarshal(%s) failed: %s\n", text, err)
+			t.Fail()
+		}
+	}
+	if _, err := s.Unmarshal(`2`); err == nil {
+		fmt.Println("Unmarshal(2) succeeded")
+		t.Fail()
+	}
+}
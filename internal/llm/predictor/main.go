@@ -3,11 +3,20 @@ package predictor
 import (
 	"fmt"
 
+	"cmitsakis/llm-api/internal/llm/grammar"
 	llama "github.com/go-skynet/go-llama.cpp"
 )
 
+// LLM is the model that a Predictor predicts with. It's implemented by *llama.LLama,
+// and by fakes in tests, which can't load model files.
+type LLM interface {
+	Predict(text string, opts ...llama.PredictOption) (string, error)
+	TokenizeString(text string, opts ...llama.PredictOption) (int32, []int32, error)
+	Free()
+}
+
 type Predictor struct {
-	llm               *llama.LLama
+	llm               LLM
 	predictOptionArgs []llama.PredictOption
 }
 
@@ -16,22 +25,34 @@ func New(modelPath string, modelOptionArgs []llama.ModelOption, predictOptionArg
 	if err != nil {
 		return Predictor{}, fmt.Errorf("Loading the model failed: %w", err)
 	}
+	return NewFromLLM(l, predictOptionArgs), nil
+}
+
+// returns a predictor that predicts with a model that is already loaded.
+func NewFromLLM(llm LLM, predictOptionArgs []llama.PredictOption) Predictor {
 	return Predictor{
-		llm:               l,
+		llm:               llm,
 		predictOptionArgs: predictOptionArgs,
-	}, nil
+	}
 }
 
-func (p Predictor) Predict(prompt string, predictOptionArgs ...llama.PredictOption) (string, error) {
-	var opts []llama.PredictOption
+// returns the default predict options of the predictor followed by predictOptionArgs.
+func (p Predictor) optionArgs(predictOptionArgs []llama.PredictOption) []llama.PredictOption {
 	if len(predictOptionArgs) == 0 {
-		opts = p.predictOptionArgs
-	} else {
-		opts = make([]llama.PredictOption, len(p.predictOptionArgs))
-		copy(opts, p.predictOptionArgs)
-		opts = append(opts, predictOptionArgs...)
+		return p.predictOptionArgs
 	}
-	response, err := p.llm.Predict(prompt, opts...)
+	opts := make([]llama.PredictOption, len(p.predictOptionArgs), len(p.predictOptionArgs)+len(predictOptionArgs))
+	copy(opts, p.predictOptionArgs)
+	return append(opts, predictOptionArgs...)
+}
+
+// returns the options that will be used for prediction, if predictOptionArgs are passed to Predict().
+func (p Predictor) Options(predictOptionArgs ...llama.PredictOption) llama.PredictOptions {
+	return llama.NewPredictOptions(p.optionArgs(predictOptionArgs)...)
+}
+
+func (p Predictor) Predict(prompt string, predictOptionArgs ...llama.PredictOption) (string, error) {
+	response, err := p.llm.Predict(prompt, p.optionArgs(predictOptionArgs)...)
 	if err != nil {
 		return "", fmt.Errorf("Predict() failed: %w", err)
 	}
@@ -47,6 +68,37 @@ func (p Predictor) PredictToChannel(prompt string, responseChan chan<- string, p
 	return p.Predict(prompt, predictOptionArgs...)
 }
 
+// returns the option that constrains the prediction to text the GBNF grammar accepts.
+// The grammar is validated first, because llama.cpp doesn't report errors of invalid grammars.
+func WithGrammar(src string) (llama.PredictOption, error) {
+	_, err := grammar.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return llama.WithGrammar(src), nil
+}
+
+// returns the options of TokenizeString().
+// The output buffer of TokenizeString() has the size of the option Tokens, so the predict options can't be used,
+// because their Tokens is the number of tokens to predict, and text longer than that would not fit.
+// Every token is at least one byte long, and the tokenizer can add the beginning-of-sequence token and a leading space,
+// so text is split into at most len(text)+2 tokens.
+func tokenizeOptions(text string) []llama.PredictOption {
+	return []llama.PredictOption{llama.SetTokens(len(text) + 2)}
+}
+
+// returns the number of tokens the model tokenizer splits text into.
+func (p Predictor) CountTokens(text string) (int, error) {
+	n, _, err := p.llm.TokenizeString(text, tokenizeOptions(text)...)
+	if err != nil {
+		return 0, fmt.Errorf("TokenizeString() failed: %w", err)
+	}
+	return int(n), nil
+}
+
+// frees the model. The zero Predictor has no model, so freeing it does nothing.
 func (p Predictor) Free() {
-	p.llm.Free()
+	if p.llm != nil {
+		p.llm.Free()
+	}
 }
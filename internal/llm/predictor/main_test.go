@@ -0,0 +1,27 @@
+package predictor
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+)
+
+func TestTokenizeOptions(t *testing.T) {
+	// the prompt is longer than the number of tokens to predict
+	p := Predictor{predictOptionArgs: []llama.PredictOption{llama.SetTokens(16)}}
+	text := strings.Repeat("a ", 100)
+	if got := p.Options().Tokens; got != 16 {
+		fmt.Printf("Options().Tokens = %d, expected 16\n", got)
+		t.Fail()
+	}
+	if got := llama.NewPredictOptions(tokenizeOptions(text)...).Tokens; got < len(text)+1 {
+		fmt.Printf("Tokens of tokenizeOptions() = %d, expected at least %d\n", got, len(text)+1)
+		t.Fail()
+	}
+	if got := llama.NewPredictOptions(tokenizeOptions("")...).Tokens; got < 2 {
+		fmt.Printf("Tokens of tokenizeOptions() of empty text = %d\n", got)
+		t.Fail()
+	}
+}
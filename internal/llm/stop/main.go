@@ -0,0 +1,192 @@
+// Package stop finds stop sequences in text that is generated token by token.
+// Text that could be the beginning of a stop sequence (a prefix of a literal, or of a match of a regular expression)
+// is held back until it's known whether the stop sequence matches,
+// so the text that is streamed to the client never contains a part of a stop sequence.
+package stop
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// Matcher matches literal stop sequences and regular expressions.
+type Matcher struct {
+	literals []string
+	regexps  []*regexp.Regexp
+	// programs of the regular expressions that find partial matches, one for every regular expression (nil if it failed to compile)
+	progs []*syntax.Prog
+	// length of the longest literal
+	maxLiteralLen int
+}
+
+// returns a Matcher that matches any of the literals and the regular expressions.
+// Empty literals and nil regular expressions are ignored.
+func New(literals []string, regexps []*regexp.Regexp) *Matcher {
+	m := &Matcher{}
+	for _, literal := range literals {
+		if literal == "" {
+			continue
+		}
+		m.literals = append(m.literals, literal)
+		m.maxLiteralLen = max(m.maxLiteralLen, len(literal))
+	}
+	for _, re := range regexps {
+		if re != nil {
+			m.regexps = append(m.regexps, re)
+			m.progs = append(m.progs, compilePrefixProg(re))
+		}
+	}
+	return m
+}
+
+// Match is a match of a stop sequence.
+type Match struct {
+	// index of the text where the match starts
+	Index int
+	// the text that matched
+	Text string
+}
+
+// returns the earliest match in text of any of the literals. Literals can only match at or after index from.
+func (m *Matcher) findLiteral(text string, from int) (Match, bool) {
+	var match Match
+	found := false
+	for _, literal := range m.literals {
+		i := strings.Index(text[from:], literal)
+		if i < 0 {
+			continue
+		}
+		i += from
+		if !found || i < match.Index {
+			match = Match{Index: i, Text: literal}
+			found = true
+		}
+	}
+	return match, found
+}
+
+// returns the match of the regular expression in text, if it's earlier than the match found so far.
+func findRegexp(re *regexp.Regexp, text string, match Match, found bool) (Match, bool) {
+	loc := re.FindStringIndex(text)
+	if loc == nil || (found && loc[0] >= match.Index) {
+		return match, found
+	}
+	return Match{Index: loc[0], Text: text[loc[0]:loc[1]]}, true
+}
+
+// returns the earliest match in text of any of the stop sequences.
+func (m *Matcher) Find(text string) (Match, bool) {
+	match, found := m.findLiteral(text, 0)
+	for _, re := range m.regexps {
+		match, found = findRegexp(re, text, match, found)
+	}
+	return match, found
+}
+
+// returns the length of the longest suffix of text that is a proper prefix of a literal,
+// so it could become a match when more text is appended.
+func (m *Matcher) partialLiteralLen(text string) int {
+	longest := 0
+	for _, literal := range m.literals {
+		for n := min(len(literal)-1, len(text)); n > longest; n-- {
+			if strings.HasSuffix(text, literal[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// Stream accumulates generated text and returns the part of it that can be sent to the client.
+type Stream struct {
+	matcher *Matcher
+	// one for every regular expression of the matcher (nil if its program failed to compile)
+	prefixMatchers []*prefixMatcher
+	// the text is appended to buf, so appending a token doesn't copy the text before it
+	buf  strings.Builder
+	text string
+	// number of bytes of text that have been returned by Write()
+	sent  int
+	match *Match
+}
+
+func (m *Matcher) NewStream() *Stream {
+	s := &Stream{matcher: m}
+	for _, prog := range m.progs {
+		var pm *prefixMatcher
+		if prog != nil {
+			pm = newPrefixMatcher(prog)
+		}
+		s.prefixMatchers = append(s.prefixMatchers, pm)
+	}
+	return s
+}
+
+// appends the token to the text, and returns the text that can be sent to the client.
+// If a stop sequence matches, stopped is true, and the returned text ends where the match starts.
+// Write must not be called after a stop sequence matched.
+// The cost of a call depends on the length of the token, not on the length of the text before it,
+// except when a regular expression matches, or could match depending on what follows the text.
+func (s *Stream) Write(token string) (text string, stopped bool) {
+	previousLen := len(s.text)
+	s.buf.WriteString(token)
+	s.text = s.buf.String()
+	// the previous text had no match, so a literal match must end in the new token
+	from := max(0, previousLen-s.matcher.maxLiteralLen+1)
+	match, found := s.matcher.findLiteral(s.text, from)
+	// text before the viable start of a regular expression can't be part of a match of it
+	end := len(s.text) - s.matcher.partialLiteralLen(s.text)
+	for i, re := range s.matcher.regexps {
+		if pm := s.prefixMatchers[i]; pm != nil {
+			start, mayMatch := pm.viableStart(s.text)
+			end = min(end, start)
+			if !mayMatch {
+				// the regular expression is matched against the whole text only if a match could have ended in the new token
+				continue
+			}
+		}
+		match, found = findRegexp(re, s.text, match, found)
+	}
+	if found {
+		s.match = &match
+		// text that was sent can't be part of the match, because it couldn't become a match when it was sent
+		text = s.text[s.sent:max(s.sent, match.Index)]
+		s.sent = max(s.sent, match.Index)
+		return text, true
+	}
+	// text that could be the beginning of a stop sequence is held back
+	if end <= s.sent {
+		return "", false
+	}
+	text = s.text[s.sent:end]
+	s.sent = end
+	return text, false
+}
+
+// returns the text that has been held back. It's called when the generation ends without a match.
+func (s *Stream) Flush() string {
+	if s.match != nil {
+		return ""
+	}
+	text := s.text[s.sent:]
+	s.sent = len(s.text)
+	return text
+}
+
+// returns the generated text without the stop sequence and anything after it.
+func (s *Stream) Text() string {
+	if s.match != nil {
+		return s.text[:s.match.Index]
+	}
+	return s.text
+}
+
+// returns the stop sequence that matched.
+func (s *Stream) Match() (Match, bool) {
+	if s.match == nil {
+		return Match{}, false
+	}
+	return *s.match, true
+}
@@ -0,0 +1,229 @@
+package stop
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+// writes the tokens to a new stream, and returns the text sent to the client and the stream.
+func writeTokens(m *Matcher, tokens []string) (string, *Stream) {
+	s := m.NewStream()
+	var sent string
+	for _, token := range tokens {
+		text, stopped := s.Write(token)
+		sent += text
+		if stopped {
+			return sent, s
+		}
+	}
+	return sent + s.Flush(), s
+}
+
+func TestLiteral(t *testing.T) {
+	m := New([]string{"USER:", "</s>"}, nil)
+	sent, s := writeTokens(m, []string{"Hello", " there", "\n", "US", "ER", ":", " more"})
+	if sent != "Hello there\n" {
+		fmt.Printf("sent = %q\n", sent)
+		t.Fail()
+	}
+	if s.Text() != "Hello there\n" {
+		fmt.Printf("Text() = %q\n", s.Text())
+		t.Fail()
+	}
+	match, found := s.Match()
+	if !found || match.Text != "USER:" || match.Index != len("Hello there\n") {
+		fmt.Printf("Match() = %+v, %v\n", match, found)
+		t.Fail()
+	}
+}
+
+func TestLiteralInsideToken(t *testing.T) {
+	m := New([]string{"</s>"}, nil)
+	sent, s := writeTokens(m, []string{"Hi", " there</s>trailing"})
+	if sent != "Hi there" {
+		fmt.Printf("sent = %q\n", sent)
+		t.Fail()
+	}
+	if match, found := s.Match(); !found || match.Text != "</s>" {
+		fmt.Printf("Match() = %+v, %v\n", match, found)
+		t.Fail()
+	}
+}
+
+func TestPartialMatchReleased(t *testing.T) {
+	m := New([]string{"USER:"}, nil)
+	s := m.NewStream()
+	text, _ := s.Write("a US")
+	if text != "a " {
+		fmt.Printf("text = %q: partial match must be held back\n", text)
+		t.Fail()
+	}
+	text, _ = s.Write("A")
+	if text != "USA" {
+		fmt.Printf("text = %q: text that can't match must be sent\n", text)
+		t.Fail()
+	}
+	if _, found := s.Match(); found {
+		fmt.Println("unexpected match")
+		t.Fail()
+	}
+}
+
+func TestFlush(t *testing.T) {
+	m := New([]string{"USER:"}, nil)
+	sent, s := writeTokens(m, []string{"end with US"})
+	if sent != "end with US" {
+		fmt.Printf("sent = %q: held back text must be sent when the generation ends\n", sent)
+		t.Fail()
+	}
+	if _, found := s.Match(); found {
+		fmt.Println("unexpected match")
+		t.Fail()
+	}
+}
+
+func TestEarliestMatch(t *testing.T) {
+	m := New([]string{"bbb", "b"}, []*regexp.Regexp{regexp.MustCompile(`a+`)})
+	match, found := m.Find("xxbbbaa")
+	if !found || match.Index != 2 || match.Text != "bbb" {
+		fmt.Printf("Find() = %+v, %v\n", match, found)
+		t.Fail()
+	}
+	match, found = m.Find("xaab")
+	if !found || match.Index != 1 || match.Text != "aa" {
+		fmt.Printf("Find() = %+v, %v\n", match, found)
+		t.Fail()
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	m := New([]string{""}, []*regexp.Regexp{nil})
+	sent, s := writeTokens(m, []string{"a", "b"})
+	if sent != "ab" || s.Text() != "ab" {
+		fmt.Printf("sent = %q, Text() = %q\n", sent, s.Text())
+		t.Fail()
+	}
+}
+
+func TestRegexpPartialMatch(t *testing.T) {
+	m := New(nil, []*regexp.Regexp{regexp.MustCompile(`\n(USER|ASSISTANT):`)})
+	s := m.NewStream()
+	for _, step := range []struct {
+		token string
+		sent  string
+	}{
+		{"Hello", "Hello"},
+		{"\nUS", ""},
+		{"ER", ""},
+		{":", ""},
+	} {
+		text, stopped := s.Write(step.token)
+		if text != step.sent {
+			fmt.Printf("Write(%q) = %q, expected %q\n", step.token, text, step.sent)
+			t.Fail()
+		}
+		if stopped != (step.token == ":") {
+			fmt.Printf("Write(%q) stopped = %v\n", step.token, stopped)
+			t.Fail()
+		}
+	}
+	if s.Text() != "Hello" {
+		fmt.Printf("Text() = %q\n", s.Text())
+		t.Fail()
+	}
+	if match, _ := s.Match(); match.Text != "\nUSER:" {
+		fmt.Printf("Match() = %+v\n", match)
+		t.Fail()
+	}
+}
+
+func TestRegexpPartialMatchReleased(t *testing.T) {
+	m := New(nil, []*regexp.Regexp{regexp.MustCompile(`\n(USER|ASSISTANT):`)})
+	s := m.NewStream()
+	text, _ := s.Write("a\nAS")
+	if text != "a" {
+		fmt.Printf("text = %q: partial match must be held back\n", text)
+		t.Fail()
+	}
+	text, _ = s.Write("K")
+	if text != "\nASK" {
+		fmt.Printf("text = %q: text that can't match must be sent\n", text)
+		t.Fail()
+	}
+}
+
+func TestRegexpAssertions(t *testing.T) {
+	// text that is not at the beginning of a line can't match
+	m := New(nil, []*regexp.Regexp{regexp.MustCompile(`(?m)^END`)})
+	s := m.NewStream()
+	if text, _ := s.Write("xEN"); text != "xEN" {
+		fmt.Printf("text = %q\n", text)
+		t.Fail()
+	}
+	if text, _ := s.Write("\nEN"); text != "\n" {
+		fmt.Printf("text = %q: partial match at the beginning of a line must be held back\n", text)
+		t.Fail()
+	}
+	// the beginning of the text can't match an anchor at the beginning later
+	m = New(nil, []*regexp.Regexp{regexp.MustCompile(`^abc`)})
+	s = m.NewStream()
+	if text, _ := s.Write("xab"); text != "xab" {
+		fmt.Printf("text = %q\n", text)
+		t.Fail()
+	}
+}
+
+func TestRegexpSplitRune(t *testing.T) {
+	m := New(nil, []*regexp.Regexp{regexp.MustCompile(`é!`)})
+	s := m.NewStream()
+	e := "é"
+	text, _ := s.Write("a" + e[:1])
+	if text != "a" {
+		fmt.Printf("text = %q: incomplete rune must be held back\n", text)
+		t.Fail()
+	}
+	text, _ = s.Write(e[1:])
+	if text != "" {
+		fmt.Printf("text = %q: partial match must be held back\n", text)
+		t.Fail()
+	}
+	_, stopped := s.Write("!")
+	if !stopped || s.Text() != "a" {
+		fmt.Printf("stopped = %v, Text() = %q\n", stopped, s.Text())
+		t.Fail()
+	}
+}
+
+func TestRegexpMatchDependsOnNextToken(t *testing.T) {
+	// the match of foo\B depends on the rune after it, which is in the next token
+	m := New(nil, []*regexp.Regexp{regexp.MustCompile(`foo\B`)})
+	s := m.NewStream()
+	if text, stopped := s.Write("a foo"); text != "a " || stopped {
+		fmt.Printf("text = %q, stopped = %v: partial match must be held back\n", text, stopped)
+		t.Fail()
+	}
+	if text, stopped := s.Write("d"); text != "" || !stopped || s.Text() != "a " {
+		fmt.Printf("text = %q, stopped = %v, Text() = %q\n", text, stopped, s.Text())
+		t.Fail()
+	}
+	// the match ends in the middle of a token
+	m = New(nil, []*regexp.Regexp{regexp.MustCompile(`b+c`)})
+	sent, s := writeTokens(m, []string{"a", "b", "bcd", "e"})
+	if match, _ := s.Match(); sent != "a" || match.Text != "bbc" {
+		fmt.Printf("sent = %q, Match() = %+v\n", sent, match)
+		t.Fail()
+	}
+}
+
+// the cost of every token must not grow with the length of the text generated before it.
+func BenchmarkStreamLongOutput(b *testing.B) {
+	m := New([]string{"USER:", "</s>"}, []*regexp.Regexp{regexp.MustCompile(`\n(USER|ASSISTANT):`), regexp.MustCompile(`(?m)^END$`)})
+	for i := 0; i < b.N; i++ {
+		s := m.NewStream()
+		for j := 0; j < 20000; j++ {
+			s.Write(" word")
+			s.Write("\n")
+		}
+	}
+}
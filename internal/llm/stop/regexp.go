@@ -0,0 +1,146 @@
+package stop
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// compiles the regular expression to a program that prefixMatcher can run.
+// Returns nil if it fails, which can't happen for a regular expression that regexp.Compile accepted.
+func compilePrefixProg(re *regexp.Regexp) *syntax.Prog {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil
+	}
+	return prog
+}
+
+type thread struct {
+	pc uint32
+	// byte offset of the text where the match of the thread starts
+	start int
+}
+
+// prefixMatcher finds the earliest position of a text from which a match of a regular expression could start,
+// if more text is appended. The text before that position can never be part of a match.
+// It simulates the NFA of the regular expression on the text incrementally, with one thread per possible start of a match,
+// so the text is scanned only once, no matter how many times more text is appended.
+type prefixMatcher struct {
+	prog *syntax.Prog
+	// threads at offset pos that wait to consume the next rune, in increasing order of start
+	threads []thread
+	// byte offset of the text up to which the threads have been advanced
+	pos int
+	// the rune before pos, or -1 at the beginning of the text
+	prev rune
+	// true if a thread reached a match while advancing
+	matched bool
+}
+
+func newPrefixMatcher(prog *syntax.Prog) *prefixMatcher {
+	return &prefixMatcher{prog: prog, prev: -1}
+}
+
+// adds the thread to list, following the instructions that don't consume a rune.
+// Threads that reach an instruction that consumes a rune, or a match, are added to list.
+// Only the first thread that reaches an instruction is added, which is the one with the earliest start,
+// because all threads that reach the same instruction have the same future.
+// Empty-width assertions are satisfied if they are in flags.
+func (m *prefixMatcher) addThread(list []thread, visited []bool, pc uint32, start int, flags syntax.EmptyOp) []thread {
+	if visited[pc] {
+		return list
+	}
+	visited[pc] = true
+	inst := &m.prog.Inst[pc]
+	switch inst.Op {
+	case syntax.InstAlt, syntax.InstAltMatch:
+		list = m.addThread(list, visited, inst.Out, start, flags)
+		list = m.addThread(list, visited, inst.Arg, start, flags)
+	case syntax.InstCapture, syntax.InstNop:
+		list = m.addThread(list, visited, inst.Out, start, flags)
+	case syntax.InstEmptyWidth:
+		if syntax.EmptyOp(inst.Arg)&^flags == 0 {
+			list = m.addThread(list, visited, inst.Out, start, flags)
+		}
+	case syntax.InstMatch, syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+		list = append(list, thread{pc: pc, start: start})
+	}
+	return list
+}
+
+// returns the threads after following the instructions that don't consume a rune,
+// including a new thread for a match that starts at pos.
+func (m *prefixMatcher) closure(flags syntax.EmptyOp) []thread {
+	visited := make([]bool, len(m.prog.Inst))
+	var list []thread
+	for _, t := range m.threads {
+		list = m.addThread(list, visited, t.pc, t.start, flags)
+	}
+	return m.addThread(list, visited, uint32(m.prog.Start), m.pos, flags)
+}
+
+func matchRune(inst *syntax.Inst, r rune) bool {
+	switch inst.Op {
+	case syntax.InstRune, syntax.InstRune1:
+		return inst.MatchRune(r)
+	case syntax.InstRuneAny:
+		return true
+	case syntax.InstRuneAnyNotNL:
+		return r != '\n'
+	}
+	return false
+}
+
+// advances the threads over the rune r that has the given size in bytes.
+func (m *prefixMatcher) step(r rune, size int) {
+	var next []thread
+	for _, t := range m.closure(syntax.EmptyOpContext(m.prev, r)) {
+		inst := &m.prog.Inst[t.pc]
+		if inst.Op == syntax.InstMatch {
+			m.matched = true
+			continue
+		}
+		if matchRune(inst, r) {
+			next = append(next, thread{pc: inst.Out, start: t.start})
+		}
+	}
+	m.threads = next
+	m.prev = r
+	m.pos += size
+}
+
+// advances the threads over the complete runes of text after pos.
+// An incomplete UTF-8 sequence at the end of text is left for when the rest of it is appended.
+func (m *prefixMatcher) advance(text string) {
+	for m.pos < len(text) && utf8.FullRuneInString(text[m.pos:]) {
+		r, size := utf8.DecodeRuneInString(text[m.pos:])
+		m.step(r, size)
+	}
+}
+
+// returns the earliest byte offset of text from which a match could start, if more text is appended.
+// Returns len(text) if no match can start before the end of the text.
+// mayMatch is true if a match could end in the text appended since the previous call, so the text must be matched
+// against the regular expression. It can be true even if there is no match, because it's not known yet what follows the text.
+func (m *prefixMatcher) viableStart(text string) (start int, mayMatch bool) {
+	m.matched = false
+	m.advance(text)
+	// it's not known yet what follows the text, so the assertions about the end of the text or the line
+	// and about word boundaries could be satisfied later
+	flags := syntax.EmptyOpContext(m.prev, -1)&(syntax.EmptyBeginLine|syntax.EmptyBeginText) |
+		syntax.EmptyEndLine | syntax.EmptyEndText | syntax.EmptyWordBoundary | syntax.EmptyNoWordBoundary
+	// the incomplete UTF-8 sequence at the end is held back too
+	start = m.pos
+	for _, t := range m.closure(flags) {
+		if m.prog.Inst[t.pc].Op == syntax.InstMatch {
+			m.matched = true
+		}
+		start = min(start, t.start)
+	}
+	return start, m.matched
+}
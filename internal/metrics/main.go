@@ -0,0 +1,278 @@
+// Package metrics implements counters, gauges and histograms,
+// and exposes them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metrics and writes them in the Prometheus text format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// writes all metrics in the Prometheus text format, in the order they were registered.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+// the name, help text and label names of a metric
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer, typ string) {
+	helpEscaper := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, helpEscaper.Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, typ)
+}
+
+// returns the key that identifies the series with the given label values.
+// It panics if the number of values doesn't match the number of labels, because that's a programming error.
+func (d desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", d.name, len(labelValues), len(d.labels)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formats the labels as {name="value",...}. extraName and extraValue are appended if extraName is not empty.
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `%s="%s"`, extraName, labelValueEscaper.Replace(extraValue))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sorted keys, so the output is deterministic
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func splitKey(key string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return strings.Split(key, "\xff")
+}
+
+// Counter is a value that only increases, partitioned by labels.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, labels: labels},
+		values: make(map[string]float64),
+	}
+	r.register(c)
+	return c
+}
+
+// adds v to the counter with the given label values. v must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metric %s: counter cannot decrease", c.name))
+	}
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		labels := formatLabels(c.labels, splitKey(key, len(c.labels)), "", "")
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatFloat(c.values[key]))
+	}
+}
+
+// GaugeFunc is a value that can go up and down, partitioned by labels.
+// Its values are collected when the metrics are written.
+type GaugeFunc struct {
+	desc
+	collect func(set func(v float64, labelValues ...string))
+}
+
+// collect is called every time the metrics are written, and must call set once for every series.
+func (r *Registry) NewGaugeFunc(name string, help string, collect func(set func(v float64, labelValues ...string)), labels ...string) *GaugeFunc {
+	g := &GaugeFunc{
+		desc:    desc{name: name, help: help, labels: labels},
+		collect: collect,
+	}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w, "gauge")
+	values := make(map[string]float64)
+	g.collect(func(v float64, labelValues ...string) {
+		values[g.key(labelValues)] = v
+	})
+	for _, key := range sortedKeys(values) {
+		labels := formatLabels(g.labels, splitKey(key, len(g.labels)), "", "")
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatFloat(values[key]))
+	}
+}
+
+// Histogram counts observed values in buckets, partitioned by labels.
+type Histogram struct {
+	desc
+	// upper bounds of the buckets in increasing order, without +Inf
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	// counts[i] is the number of observations in bucket i (not cumulative). The last one is +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// buckets are the upper bounds of the buckets. They are sorted, and the +Inf bucket is added.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	buckets = slices.Compact(buckets)
+	if len(buckets) > 0 && math.IsInf(buckets[len(buckets)-1], 1) {
+		buckets = buckets[:len(buckets)-1]
+	}
+	h := &Histogram{
+		desc:    desc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	i, _ := slices.BinarySearch(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		labelValues := splitKey(key, len(h.labels))
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", formatFloat(le)), cumulative)
+		}
+		labels := formatLabels(h.labels, labelValues, "", "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, s.count)
+	}
+}
+
+// returns count buckets, where the first one is start and every next one is factor times the previous.
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func writeText(r *Registry) string {
+	var sb strings.Builder
+	r.WriteText(&sb)
+	return sb.String()
+}
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Number of requests.", "endpoint", "status")
+	c.Inc("/predict", "200")
+	c.Inc("/chat", "200")
+	c.Add(2, "/predict", "200")
+	c.Inc("/chat", "503")
+	expected := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{endpoint="/chat",status="200"} 1
+requests_total{endpoint="/chat",status="503"} 1
+requests_total{endpoint="/predict",status="200"} 3
+`
+	if got := writeText(r); got != expected {
+		fmt.Printf("got:\n%s\nexpected:\n%s\n", got, expected)
+		t.Fail()
+	}
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("events_total", "Number of events.")
+	c.Add(1.5)
+	expected := `# HELP events_total Number of events.
+# TYPE events_total counter
+events_total 1.5
+`
+	if got := writeText(r); got != expected {
+		fmt.Printf("got:\n%s\nexpected:\n%s\n", got, expected)
+		t.Fail()
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("escaped_total", "Help with \\ and\nnewline.", "value")
+	c.Inc("quote \" backslash \\ newline \n")
+	expected := `# HELP escaped_total Help with \\ and\nnewline.
+# TYPE escaped_total counter
+escaped_total{value="quote \" backslash \\ newline \n"} 1
+`
+	if got := writeText(r); got != expected {
+		fmt.Printf("got:\n%s\nexpected:\n%s\n", got, expected)
+		t.Fail()
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{1, 0.1}, "model")
+	h.Observe(0.05, "a")
+	h.Observe(0.1, "a")
+	h.Observe(0.5, "a")
+	h.Observe(3, "a")
+	expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{model="a",le="0.1"} 2
+latency_seconds_bucket{model="a",le="1"} 3
+latency_seconds_bucket{model="a",le="+Inf"} 4
+latency_seconds_sum{model="a"} 3.65
+latency_seconds_count{model="a"} 4
+`
+	if got := writeText(r); got != expected {
+		fmt.Printf("got:\n%s\nexpected:\n%s\n", got, expected)
+		t.Fail()
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeFunc("queue_length", "Waiting requests.", func(set func(float64, ...string)) {
+		set(2, "b")
+		set(0, "a")
+	}, "model")
+	expected := `# HELP queue_length Waiting requests.
+# TYPE queue_length gauge
+queue_length{model="a"} 0
+queue_length{model="b"} 2
+`
+	if got := writeText(r); got != expected {
+		fmt.Printf("got:\n%s\nexpected:\n%s\n", got, expected)
+		t.Fail()
+	}
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	buckets := ExponentialBuckets(0.5, 2, 4)
+	expected := []float64{0.5, 1, 2, 4}
+	if fmt.Sprint(buckets) != fmt.Sprint(expected) {
+		fmt.Printf("got %v, expected %v\n", buckets, expected)
+		t.Fail()
+	}
+}
@@ -0,0 +1,237 @@
+// Package queue implements a bounded queue of requests waiting for exclusive access to a resource.
+// Requests of different clients are served in round-robin order, and requests of the same client in FIFO order,
+// so a client that submits many requests cannot starve the other clients.
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFull    = errors.New("queue is full")
+	ErrTimeout = errors.New("timed out waiting in queue")
+)
+
+type request struct {
+	ready   chan struct{}
+	changed chan struct{}
+	granted bool
+}
+
+type clientQueue struct {
+	id       string
+	requests []*request
+}
+
+type Queue struct {
+	maxSize int
+	maxWait time.Duration
+
+	mu sync.Mutex
+	// true if a request has acquired the resource
+	busy bool
+	// when the resource was acquired
+	acquiredAt time.Time
+	// clients with waiting requests in round-robin order. The first client will be served next.
+	clients []*clientQueue
+	// number of waiting requests
+	size int
+	// exponential moving average of the time the resource is held
+	avgHoldTime time.Duration
+}
+
+// creates a new queue that holds up to maxSize waiting requests.
+// Requests that wait longer than maxWait fail with ErrTimeout (0 = no limit).
+func New(maxSize int, maxWait time.Duration) *Queue {
+	return &Queue{
+		maxSize: maxSize,
+		maxWait: maxWait,
+	}
+}
+
+// waits until the caller acquires the resource, and returns a function that must be called to release it.
+// If other requests are waiting, onPosition (if not nil) is called with the position of the request in the queue (1 = next),
+// initially and every time the position changes.
+// It fails with ErrFull if the queue is full, with ErrTimeout if the request waited too long,
+// or with the error of ctx if ctx is done.
+func (q *Queue) Acquire(ctx context.Context, clientID string, onPosition func(position int)) (func(), error) {
+	q.mu.Lock()
+	if !q.busy && q.size == 0 {
+		q.busy = true
+		q.acquiredAt = time.Now()
+		q.mu.Unlock()
+		return q.releaseFunc(), nil
+	}
+	if q.size >= q.maxSize {
+		q.mu.Unlock()
+		return nil, ErrFull
+	}
+	req := &request{
+		ready:   make(chan struct{}),
+		changed: make(chan struct{}, 1),
+	}
+	q.enqueue(clientID, req)
+	position := q.position(req)
+	q.mu.Unlock()
+
+	if onPosition != nil {
+		onPosition(position)
+	}
+	var timeout <-chan time.Time
+	if q.maxWait > 0 {
+		timer := time.NewTimer(q.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case <-req.ready:
+			return q.releaseFunc(), nil
+		case <-req.changed:
+			q.mu.Lock()
+			if req.granted {
+				q.mu.Unlock()
+				continue
+			}
+			newPosition := q.position(req)
+			q.mu.Unlock()
+			if onPosition != nil && newPosition != position {
+				position = newPosition
+				onPosition(position)
+			}
+		case <-ctx.Done():
+			if q.abandon(req) {
+				return q.releaseFunc(), nil
+			}
+			return nil, ctx.Err()
+		case <-timeout:
+			if q.abandon(req) {
+				return q.releaseFunc(), nil
+			}
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// returns the number of waiting requests.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// returns an estimation of how long a new request would have to wait.
+func (q *Queue) EstimatedWait() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.avgHoldTime * time.Duration(q.size+1)
+}
+
+func (q *Queue) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(q.release)
+	}
+}
+
+func (q *Queue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	holdTime := time.Since(q.acquiredAt)
+	if q.avgHoldTime == 0 {
+		q.avgHoldTime = holdTime
+	} else {
+		q.avgHoldTime = (4*q.avgHoldTime + holdTime) / 5
+	}
+	if q.size == 0 {
+		q.busy = false
+		return
+	}
+	// serve the first request of the next client, and move the client to the end of the round
+	c := q.clients[0]
+	req := c.requests[0]
+	c.requests = c.requests[1:]
+	q.clients = q.clients[1:]
+	if len(c.requests) > 0 {
+		q.clients = append(q.clients, c)
+	}
+	q.size--
+	q.acquiredAt = time.Now()
+	req.granted = true
+	close(req.ready)
+	q.notifyAll()
+}
+
+// removes the request from the queue.
+// Returns true if the request has already acquired the resource, so the caller has to release it.
+func (q *Queue) abandon(req *request) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if req.granted {
+		return true
+	}
+	for i, c := range q.clients {
+		for j, r := range c.requests {
+			if r != req {
+				continue
+			}
+			c.requests = append(c.requests[:j], c.requests[j+1:]...)
+			if len(c.requests) == 0 {
+				q.clients = append(q.clients[:i], q.clients[i+1:]...)
+			}
+			q.size--
+			q.notifyAll()
+			return false
+		}
+	}
+	return false
+}
+
+func (q *Queue) enqueue(clientID string, req *request) {
+	q.size++
+	for _, c := range q.clients {
+		if c.id == clientID {
+			c.requests = append(c.requests, req)
+			return
+		}
+	}
+	q.clients = append(q.clients, &clientQueue{id: clientID, requests: []*request{req}})
+}
+
+// returns the position of a waiting request. The caller must hold q.mu.
+func (q *Queue) position(req *request) int {
+	for i, c := range q.clients {
+		for k, r := range c.requests {
+			if r != req {
+				continue
+			}
+			// in every round, each client has one request served.
+			// Clients before c are served k+1 times before req, and clients after c k times.
+			position := k + 1
+			for j, other := range q.clients {
+				if j < i {
+					position += min(len(other.requests), k+1)
+				} else if j > i {
+					position += min(len(other.requests), k)
+				}
+			}
+			return position
+		}
+	}
+	return 0
+}
+
+// notifies all waiting requests that their position might have changed. The caller must hold q.mu.
+func (q *Queue) notifyAll() {
+	for _, c := range q.clients {
+		for _, r := range c.requests {
+			select {
+			case r.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// enqueues a request in the background and returns a channel that receives the release function when the request acquires the resource.
+func acquireAsync(q *Queue, clientID string) <-chan func() {
+	ch := make(chan func(), 1)
+	go func() {
+		release, err := q.Acquire(context.Background(), clientID, nil)
+		if err != nil {
+			close(ch)
+			return
+		}
+		ch <- release
+	}()
+	return ch
+}
+
+func waitForLen(q *Queue, n int) {
+	for q.Len() != n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairness(t *testing.T) {
+	q := New(10, 0)
+	release, err := q.Acquire(context.Background(), "a", nil)
+	if err != nil {
+		fmt.Printf("Acquire() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	a1 := acquireAsync(q, "a")
+	waitForLen(q, 1)
+	a2 := acquireAsync(q, "a")
+	waitForLen(q, 2)
+	b1 := acquireAsync(q, "b")
+	waitForLen(q, 3)
+
+	// client b must be served before the second request of client a
+	for i, ch := range []<-chan func(){a1, b1, a2} {
+		release()
+		release = <-ch
+		if release == nil {
+			fmt.Printf("request %d failed\n", i)
+			t.Fail()
+			return
+		}
+	}
+	release()
+	if q.Len() != 0 {
+		fmt.Printf("queue length = %d\n", q.Len())
+		t.Fail()
+	}
+}
+
+func TestPosition(t *testing.T) {
+	q := New(10, 0)
+	release, _ := q.Acquire(context.Background(), "a", nil)
+	acquireAsync(q, "a")
+	acquireAsync(q, "a")
+	waitForLen(q, 2)
+	positions := make(chan int, 10)
+	go q.Acquire(context.Background(), "b", func(position int) {
+		positions <- position
+	})
+	if position := <-positions; position != 2 {
+		fmt.Printf("initial position = %d\n", position)
+		t.Fail()
+	}
+	release()
+	if position := <-positions; position != 1 {
+		fmt.Printf("position after release = %d\n", position)
+		t.Fail()
+	}
+}
+
+func TestFull(t *testing.T) {
+	q := New(1, 0)
+	q.Acquire(context.Background(), "a", nil)
+	acquireAsync(q, "a")
+	waitForLen(q, 1)
+	_, err := q.Acquire(context.Background(), "b", nil)
+	if !errors.Is(err, ErrFull) {
+		fmt.Printf("expected ErrFull, got: %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	q := New(1, 10*time.Millisecond)
+	q.Acquire(context.Background(), "a", nil)
+	_, err := q.Acquire(context.Background(), "b", nil)
+	if !errors.Is(err, ErrTimeout) {
+		fmt.Printf("expected ErrTimeout, got: %v\n", err)
+		t.Fail()
+	}
+	if q.Len() != 0 {
+		fmt.Printf("queue length = %d\n", q.Len())
+		t.Fail()
+	}
+}
+
+func TestCancel(t *testing.T) {
+	q := New(1, 0)
+	release, _ := q.Acquire(context.Background(), "a", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		_, err := q.Acquire(ctx, "b", nil)
+		errCh <- err
+	}()
+	waitForLen(q, 1)
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		fmt.Printf("expected context.Canceled, got: %v\n", err)
+		t.Fail()
+	}
+	release()
+	// the resource must be available again
+	release, err := q.Acquire(context.Background(), "c", nil)
+	if err != nil {
+		fmt.Printf("Acquire() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	release()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// policies for logging the content of prompts and responses
+const (
+	logContentFull      = "full"      // the content is logged as is
+	logContentTruncated = "truncated" // the beginning of the content is logged
+	logContentHashed    = "hashed"    // the SHA-256 hash of the content is logged, so equal contents can be correlated
+	logContentOmitted   = "omitted"   // only the length of the content is logged
+)
+
+type LogConfig struct {
+	// "json" or "text"
+	Format string
+	// policy for logging the content of prompts and responses
+	Content string
+	// maximum number of characters logged if Content is "truncated"
+	ContentMaxLength int
+}
+
+// returns the logger configured by config.
+func newLogger(config LogConfig) (*slog.Logger, error) {
+	switch config.Content {
+	case logContentFull, logContentTruncated, logContentHashed, logContentOmitted:
+	default:
+		return nil, fmt.Errorf("invalid value of flag -log-content: '%s'", config.Content)
+	}
+	if config.ContentMaxLength < 0 {
+		return nil, errors.New("flag -log-content-max-length cannot be negative")
+	}
+	switch config.Format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, nil)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, nil)), nil
+	default:
+		return nil, fmt.Errorf("invalid value of flag -log-format: '%s'", config.Format)
+	}
+}
+
+// returns the attribute that logs the content according to the policy of config.
+func (config LogConfig) contentAttr(key string, content string) slog.Attr {
+	switch config.Content {
+	case logContentFull:
+		return slog.String(key, content)
+	case logContentTruncated:
+		if utf8.RuneCountInString(content) <= config.ContentMaxLength {
+			return slog.String(key, content)
+		}
+		runes := []rune(content)
+		return slog.Group(key,
+			slog.String("truncated", string(runes[:config.ContentMaxLength])),
+			slog.Int("length", len(runes)),
+		)
+	case logContentHashed:
+		hash := sha256.Sum256([]byte(content))
+		return slog.Group(key,
+			slog.String("sha256", hex.EncodeToString(hash[:])),
+			slog.Int("length", utf8.RuneCountInString(content)),
+		)
+	default:
+		return slog.Group(key, slog.Int("length", utf8.RuneCountInString(content)))
+	}
+}
+
+type requestLogKey struct{}
+
+// requestLog is stored in the context of every request.
+type requestLog struct {
+	logger *slog.Logger
+	config LogConfig
+}
+
+// returns the logger of the request, which adds the request ID to every record.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if rl, ok := ctx.Value(requestLogKey{}).(requestLog); ok {
+		return rl.logger
+	}
+	return slog.Default()
+}
+
+// returns the attribute that logs a prompt or a response of the request according to the configured policy.
+func logContent(ctx context.Context, key string, content string) slog.Attr {
+	rl, ok := ctx.Value(requestLogKey{}).(requestLog)
+	if !ok {
+		return LogConfig{Content: logContentOmitted}.contentAttr(key, content)
+	}
+	return rl.config.contentAttr(key, content)
+}
+
+// returns the ID of the request. The client can set it with the header X-Request-ID, otherwise a random one is generated.
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id != "" && len(id) <= 128 {
+		valid := true
+		for _, c := range id {
+			if c < 0x21 || c > 0x7e {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return id
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// assigns an ID to every request, returns it in the header X-Request-ID,
+// and logs every request with its status code and latency.
+func logRequests(h http.Handler, config LogConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set("X-Request-ID", id)
+		logger := slog.Default().With(slog.String("requestID", id))
+		r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, requestLog{logger: logger, config: config}))
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			logger.Info("request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("remoteAddr", r.RemoteAddr),
+				slog.Int("status", sr.status(r)),
+				slog.Float64("latencyMs", float64(time.Since(start).Microseconds())/1000),
+			)
+		}()
+		h.ServeHTTP(sr, r)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cmitsakis/llm-api/internal/llm/predictor"
+	"cmitsakis/llm-api/internal/llm/stop"
+	llama "github.com/go-skynet/go-llama.cpp"
+)
+
+// failingLLM is a model whose predictions fail.
+type failingLLM struct {
+	fakeLLM
+}
+
+func (failingLLM) Predict(text string, opts ...llama.PredictOption) (string, error) {
+	return "", errors.New("out of memory")
+}
+
+func TestContentAttr(t *testing.T) {
+	for _, test := range []struct {
+		config   LogConfig
+		content  string
+		expected string
+	}{
+		{LogConfig{Content: logContentFull}, "héllo", "prompt=héllo"},
+		{LogConfig{Content: logContentTruncated, ContentMaxLength: 5}, "héllo", "prompt=héllo"},
+		{LogConfig{Content: logContentTruncated, ContentMaxLength: 2}, "héllo", "prompt=[truncated=hé length=5]"},
+		{LogConfig{Content: logContentTruncated, ContentMaxLength: 0}, "héllo", "prompt=[truncated= length=5]"},
+		{LogConfig{Content: logContentHashed}, "hello", "prompt=[sha256=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824 length=5]"},
+		{LogConfig{Content: logContentOmitted}, "héllo", "prompt=[length=5]"},
+	} {
+		if got := test.config.contentAttr("prompt", test.content).String(); got != test.expected {
+			fmt.Printf("contentAttr() with policy %s = %s, expected %s\n", test.config.Content, got, test.expected)
+			t.Fail()
+		}
+	}
+}
+
+// the text of prompts and responses must be logged only as the policy allows.
+func TestPredictionLogRedaction(t *testing.T) {
+	const prompt = "my secret prompt"
+	const response = "my secret response"
+	for _, test := range []struct {
+		config LogConfig
+		llm    predictor.LLM
+		// true if the text is logged as it is
+		logged bool
+	}{
+		{LogConfig{Content: logContentFull}, fakeLLM{tokens: []string{response}}, true},
+		{LogConfig{Content: logContentTruncated, ContentMaxLength: 9}, fakeLLM{tokens: []string{response}}, false},
+		{LogConfig{Content: logContentHashed}, fakeLLM{tokens: []string{response}}, false},
+		{LogConfig{Content: logContentOmitted}, fakeLLM{tokens: []string{response}}, false},
+		// the prompt is logged when the prediction fails
+		{LogConfig{Content: logContentOmitted}, failingLLM{}, false},
+	} {
+		buf := &bytes.Buffer{}
+		logger := slog.New(slog.NewJSONHandler(buf, nil))
+		ctx := context.WithValue(context.Background(), requestLogKey{}, requestLog{logger: logger, config: test.config})
+		p := predictor.NewFromLLM(test.llm, nil)
+		predict(ctx, "a", p, generatedPrompt{text: prompt}, nil, stop.New(nil, nil), func(string) bool { return true })
+		logs := buf.String()
+		if logs == "" {
+			fmt.Printf("policy %s: the prediction was not logged\n", test.config.Content)
+			t.Fail()
+			continue
+		}
+		if _, failed := test.llm.(failingLLM); !failed && strings.Contains(logs, response) != test.logged {
+			fmt.Printf("policy %s: response logged = %t, expected %t:\n%s", test.config.Content, !test.logged, test.logged, logs)
+			t.Fail()
+		}
+		if strings.Contains(logs, prompt) != test.logged {
+			fmt.Printf("policy %s: prompt logged = %t, expected %t:\n%s", test.config.Content, !test.logged, test.logged, logs)
+			t.Fail()
+		}
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, requestLogger(r.Context()) != slog.Default())
+	}), LogConfig{Content: logContentOmitted})
+	for _, test := range []struct {
+		header string
+		// true if the ID of the client is used
+		kept bool
+	}{
+		{"my-request-1", true},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+		{"my request", false},
+		{"", false},
+	} {
+		r := httptest.NewRequest("GET", "/status", nil)
+		if test.header != "" {
+			r.Header.Set("X-Request-ID", test.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		id := w.Header().Get("X-Request-ID")
+		if (id == test.header) != test.kept || id == "" {
+			fmt.Printf("X-Request-ID = %q for the header %q\n", id, test.header)
+			t.Fail()
+		}
+		if w.Body.String() != "true" {
+			fmt.Printf("the request has no logger\n")
+			t.Fail()
+		}
+	}
+}
@@ -1,36 +1,202 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
-	"text/template"
+	"syscall"
 	"time"
 
 	llama "github.com/go-skynet/go-llama.cpp"
 
 	"cmitsakis/llm-api/internal/llm/conversation"
+	"cmitsakis/llm-api/internal/llm/jsonschema"
 	"cmitsakis/llm-api/internal/llm/predictor"
+	"cmitsakis/llm-api/internal/llm/stop"
+	"cmitsakis/llm-api/internal/queue"
 )
 
-var predictMutex sync.Mutex
+// reasons why a prediction finished
+const (
+	finishReasonStop      = "stop"      // a stop sequence matched
+	finishReasonLength    = "length"    // the token limit was reached
+	finishReasonEOS       = "eos"       // the model generated the end-of-sequence token
+	finishReasonCancelled = "cancelled" // the client stopped receiving tokens
+)
+
+type predictionResult struct {
+	Text             string
+	FinishReason     string
+	PromptTokens     int
+	CompletionTokens int
+	// the text of the stop sequence that matched, if FinishReason is finishReasonStop
+	StopSequence string
+	// number of the oldest messages of the conversation that were dropped, so the prompt fits in the context
+	DroppedMessages int
+}
+
+// predictionPrompt is the prompt of a request: either the text of the prompt, or the conversation of /chat.
+// The prompt of a conversation is generated after the request leaves the queue of the model,
+// because dropping the messages that don't fit in the context uses the tokenizer of the model.
+type predictionPrompt struct {
+	text string
+	// nil if the prompt is text
+	chat *chatPrompt
+}
+
+// generatedPrompt is the prompt that the model predicts from, with its number of tokens.
+type generatedPrompt struct {
+	text            string
+	tokens          int
+	droppedMessages int
+}
+
+// returns the prompt the model predicts from. The caller must have acquired the model.
+func (pp predictionPrompt) generate(model *Model, p predictor.Predictor, opts []llama.PredictOption) (generatedPrompt, error) {
+	if pp.chat != nil {
+		return pp.chat.generate(model, p, opts)
+	}
+	tokens, err := p.CountTokens(pp.text)
+	if err != nil {
+		return generatedPrompt{}, fmt.Errorf("failed to count prompt tokens: %s", err)
+	}
+	return generatedPrompt{text: pp.text, tokens: tokens}, nil
+}
+
+// handles an error returned by generate().
+func (pp predictionPrompt) handleError(err error, writeError func(statusCode int, message string)) {
+	switch {
+	case errors.Is(err, conversation.ErrConversationTooLong):
+		writeError(http.StatusBadRequest, err.Error())
+	case pp.chat != nil:
+		writeError(generatePromptErrorStatus(err), fmt.Sprintf("failed to generate the prompt: %s", err))
+	default:
+		writeError(http.StatusInternalServerError, err.Error())
+	}
+}
+
+// sets the header X-Dropped-Messages of the responses of /chat.
+// It has no effect if the response has already started, e.g. to send the position in the queue.
+func (pp predictionPrompt) setHeader(w http.ResponseWriter, generated generatedPrompt) {
+	if pp.chat != nil {
+		w.Header().Set("X-Dropped-Messages", strconv.Itoa(generated.droppedMessages))
+	}
+}
+
+// performs prediction with the predictor of the given model. The caller must have acquired the model, and generated the prompt with it.
+// onToken is called with the generated text as it becomes available, and the prediction stops if it returns false.
+// The text passed to onToken can be empty.
+// The prediction also stops at the next token after ctx is done (e.g. because the client disconnected).
+// If it stops because the request timed out, the result is returned with an error that wraps errRequestTimeout.
+// The prediction stops when one of the stop sequences matches, and the text is truncated where the match starts.
+// Text that could be the beginning of a stop sequence is passed to onToken only after it's known that it isn't.
+func predict(ctx context.Context, model string, p predictor.Predictor, prompt generatedPrompt, opts []llama.PredictOption, stops *stop.Matcher, onToken func(text string) bool) (result predictionResult, err error) {
+	start := time.Now()
+	var firstToken time.Time
+	defer func() {
+		observePrediction(model, start, firstToken, result, err)
+	}()
+	result.PromptTokens = prompt.tokens
+	result.DroppedMessages = prompt.droppedMessages
+	var tokensAccumulated string
+	stream := stops.NewStream()
+	opts = append(opts[:len(opts):len(opts)], llama.SetTokenCallback(func(token string) bool {
+		if firstToken.IsZero() {
+			firstToken = time.Now()
+		}
+		result.CompletionTokens++
+		tokensAccumulated, token = conversation.TrimAndAppend(tokensAccumulated, token)
+		text, stopped := stream.Write(token)
+		if stopped {
+			match, _ := stream.Match()
+			result.FinishReason = finishReasonStop
+			result.StopSequence = match.Text
+			onToken(text)
+			return false
+		}
+		if ctx.Err() != nil || !onToken(text) {
+			result.FinishReason = finishReasonCancelled
+			return false
+		}
+		return true
+	}))
+	_, err = p.Predict(prompt.text, opts...)
+	result.Text = stream.Text()
+	logger := requestLogger(ctx).With(slog.String("model", model))
+	if err != nil {
+		logger.Error("prediction failed",
+			slog.String("error", err.Error()),
+			slog.Int("promptTokens", result.PromptTokens),
+			slog.Int("completionTokens", result.CompletionTokens),
+			logContent(ctx, "prompt", prompt.text),
+		)
+		return result, err
+	}
+	if result.FinishReason == "" {
+		result.FinishReason = finishReasonEOS
+		if tokens := p.Options(opts...).Tokens; tokens > 0 && result.CompletionTokens >= tokens {
+			result.FinishReason = finishReasonLength
+		}
+		// the generation ended, so the text that was held back can't become a stop sequence
+		onToken(stream.Flush())
+	}
+	attrs := []any{
+		slog.String("finishReason", result.FinishReason),
+		slog.String("stopSequence", result.StopSequence),
+		slog.Int("promptTokens", result.PromptTokens),
+		slog.Int("completionTokens", result.CompletionTokens),
+		slog.Int("seed", p.Options(opts...).Seed),
+		slog.Float64("durationMs", float64(time.Since(start).Microseconds())/1000),
+	}
+	if !firstToken.IsZero() {
+		attrs = append(attrs, slog.Float64("timeToFirstTokenMs", float64(firstToken.Sub(start).Microseconds())/1000))
+	}
+	if result.FinishReason == finishReasonCancelled {
+		cause := context.Cause(ctx)
+		if cause == nil {
+			cause = errors.New("failed to send token to the client")
+		}
+		attrs = append(attrs, slog.String("cancelCause", cause.Error()))
+	}
+	attrs = append(attrs, logContent(ctx, "prompt", prompt.text), logContent(ctx, "response", result.Text))
+	logger.Info("prediction", attrs...)
+	if result.FinishReason == finishReasonCancelled {
+		// the client is still there if the request timed out, so it must be told the prediction didn't finish
+		return result, requestTimeoutError(ctx)
+	}
+	return result, nil
+}
 
-func handlePrediction(w http.ResponseWriter, r *http.Request, p predictor.Predictor, prompt string, stopRegex *regexp.Regexp) {
-	log.Printf("<prompt>%s</prompt>\n", prompt)
+// handles an error returned by predict(), if the response has not started.
+// If the request timed out, writeError is called with HTTP 504, otherwise with HTTP 500.
+func handlePredictionError(err error, writeError func(statusCode int, message string)) {
+	if errors.Is(err, errRequestTimeout) {
+		writeError(http.StatusGatewayTimeout, err.Error())
+		return
+	}
+	writeError(http.StatusInternalServerError, fmt.Sprintf("prediction failed: %s", err))
+}
+
+// performs prediction for /predict and /chat.
+// For /chat, the prompt is the conversation, and the text of the prompt is generated from it after the request leaves the queue.
+func handlePrediction(w http.ResponseWriter, r *http.Request, model *Model, prompt predictionPrompt) {
 	stopRegexSubmittedStr := r.Form.Get("stopRegex")
 	var stopRegexSubmitted *regexp.Regexp
 	if stopRegexSubmittedStr != "" {
-		log.Printf("<stopRegex>%s</stopRegex>\n", stopRegexSubmittedStr)
 		var err error
 		stopRegexSubmitted, err = regexp.Compile(stopRegexSubmittedStr)
 		if err != nil {
@@ -39,53 +205,211 @@ func handlePrediction(w http.ResponseWriter, r *http.Request, p predictor.Predic
 			return
 		}
 	}
-	var tokensAccumulated string
-	opts := []llama.PredictOption{llama.SetTokenCallback(func(token string) bool {
-		tokensAccumulated, token = conversation.TrimAndAppend(tokensAccumulated, token)
-		if stopRegex != nil && stopRegex.MatchString(tokensAccumulated) || stopRegexSubmitted != nil && stopRegexSubmitted.MatchString(tokensAccumulated) {
-			return false
-		}
-		_, err := io.WriteString(w, token)
-		if err != nil {
-			return false
-		}
-		return true
-	})}
-	temperatureStr := r.Form.Get("temperature")
-	if temperatureStr != "" {
-		temperature, err := strconv.ParseFloat(temperatureStr, 32)
-		if err != nil {
+	samplingParams, err := requestSamplingParams(r.Form, model)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	opts := samplingParams.predictOptions()
+	grammarOpt, schema, err := model.grammarOption(r.Form)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if grammarOpt != nil {
+		opts = append(opts, grammarOpt)
+	}
+	// the seed is returned, so the prediction can be repeated
+	w.Header().Set("X-Seed", strconv.Itoa(*samplingParams.Seed))
+	stopLiterals := r.Form["stop"]
+	var tools []conversation.Tool
+	if prompt.chat != nil {
+		tools = prompt.chat.conv.Tools
+		if len(tools) > 0 && grammarOpt != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "failed to parse value 'temperature' %s: %s", temperatureStr, err)
+			fmt.Fprint(w, "tools can't be used together with grammar, grammarName or jsonSchema")
 			return
 		}
-		opts = append(opts, llama.SetTemperature(float32(temperature)))
-		log.Printf("<temperature>%v</temperature>\n", temperature)
+		stopLiterals = append(stopLiterals[:len(stopLiterals):len(stopLiterals)], model.PromptTemplate.StopSequences()...)
+	}
+	if len(tools) > 0 {
+		// the model must wait for the results of the tool calls
+		stopLiterals = append(stopLiterals[:len(stopLiterals):len(stopLiterals)], toolResultStop)
+	}
+	stops := model.stopMatcher(stopLiterals, stopRegexSubmitted)
+	switch {
+	case schema != nil:
+		handleJSONPrediction(w, r, model, prompt, opts, stops, structuredPredictionResponse(schema, *samplingParams.Seed))
+		return
+	case len(tools) > 0:
+		handleJSONPrediction(w, r, model, prompt, opts, stops, toolsPredictionResponse(r.Context(), *samplingParams.Seed))
+		return
+	}
+	if wantsEventStream(r) {
+		handlePredictionEventStream(w, r, model, prompt, opts, *samplingParams.Seed, stops)
+		return
 	}
-	locked := predictMutex.TryLock()
-	if !locked {
-		// another request is performing prediction
-		// reject this request with HTTP 503
-		log.Printf("sending HTTP error: %v. Server is busy", http.StatusText(http.StatusServiceUnavailable))
-		w.WriteHeader(http.StatusServiceUnavailable)
-		fmt.Fprintf(w, "server is busy")
+	p, release, err := model.acquire(w, r, nil)
+	if err != nil {
+		model.handleError(w, err, plainTextError(w))
+		return
+	}
+	defer release()
+	generated, err := prompt.generate(model, p, opts)
+	if err != nil {
+		prompt.handleError(err, plainTextError(w))
+		return
+	}
+	prompt.setHeader(w, generated)
+	written := false
+	_, err = predict(r.Context(), model.Name, p, generated, opts, stops, func(token string) bool {
+		if token == "" {
+			return true
+		}
+		written = true
+		_, err := io.WriteString(w, token)
+		return err == nil
+	})
+	if err != nil && !written {
+		handlePredictionError(err, plainTextError(w))
 		return
 	}
-	defer predictMutex.Unlock()
-	response, err := p.Predict(prompt, opts...)
 	if err != nil {
-		log.Printf("p.Predict() failed: %s\n", err)
 		// panic on HTTP/1.x closes the connection,
 		// on HTTP/2 it sends RST_STREAM,
 		// so the client knows the stream ended prematurely
 		panic(http.ErrAbortHandler)
 	}
-	log.Printf("<response>%s</response>\n", response)
+}
+
+// structuredResponse is the response of /predict and /chat if the request sets jsonSchema.
+type structuredResponse struct {
+	// the response parsed as JSON, which validates against the schema
+	Output           any    `json:"output"`
+	FinishReason     string `json:"finishReason"`
+	PromptTokens     int    `json:"promptTokens"`
+	CompletionTokens int    `json:"completionTokens"`
+	Seed             int    `json:"seed"`
+	// number of the oldest messages of the conversation of /chat that were dropped, so the prompt fits in the context
+	DroppedMessages int `json:"droppedMessages,omitempty"`
+}
+
+// performs prediction and sends in JSON the response that respond returns for the result.
+// The response is sent when the prediction ends, so it's not streamed.
+// If respond fails, the error is sent with HTTP 500.
+func handleJSONPrediction(w http.ResponseWriter, r *http.Request, model *Model, prompt predictionPrompt, opts []llama.PredictOption, stops *stop.Matcher, respond func(result predictionResult) (any, error)) {
+	p, release, err := model.acquire(w, r, nil)
+	if err != nil {
+		model.handleError(w, err, plainTextError(w))
+		return
+	}
+	defer release()
+	generated, err := prompt.generate(model, p, opts)
+	if err != nil {
+		prompt.handleError(err, plainTextError(w))
+		return
+	}
+	prompt.setHeader(w, generated)
+	result, err := predict(r.Context(), model.Name, p, generated, opts, stops, func(string) bool { return true })
+	if err != nil {
+		handlePredictionError(err, plainTextError(w))
+		return
+	}
+	if result.FinishReason == finishReasonCancelled {
+		// the client disconnected
+		return
+	}
+	response, err := respond(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// returns the response of a prediction constrained by the grammar of the JSON Schema, validated against the schema.
+func structuredPredictionResponse(schema *jsonschema.Schema, seed int) func(result predictionResult) (any, error) {
+	return func(result predictionResult) (any, error) {
+		// the grammar guarantees valid output, unless the prediction stopped early (e.g. at the token limit or a stop sequence)
+		output, err := schema.Unmarshal(result.Text)
+		if err != nil {
+			return nil, fmt.Errorf("the response doesn't validate against jsonSchema (finish reason: %s): %s", result.FinishReason, err)
+		}
+		return structuredResponse{
+			Output:           output,
+			FinishReason:     result.FinishReason,
+			PromptTokens:     result.PromptTokens,
+			CompletionTokens: result.CompletionTokens,
+			Seed:             seed,
+			DroppedMessages:  result.DroppedMessages,
+		}, nil
+	}
+}
+
+// streams the response as Server-Sent Events.
+// Every token is sent as a "token" event, and the prediction ends with either a "done" or an "error" event.
+// While the request waits in the queue, a "queue" event is sent with its initial position, and every time its position changes.
+func handlePredictionEventStream(w http.ResponseWriter, r *http.Request, model *Model, prompt predictionPrompt, opts []llama.PredictOption, seed int, stops *stop.Matcher) {
+	var sw sseWriter
+	p, release, err := model.acquire(w, r, func(position int) {
+		if sw.w == nil {
+			sw = newSSEWriter(w)
+		}
+		sw.writeEvent("queue", sseQueue{Position: position})
+	})
+	if err != nil {
+		if sw.w == nil {
+			model.handleError(w, err, plainTextError(w))
+		} else {
+			// the status code has been sent already
+			model.handleError(w, err, func(_ int, message string) {
+				sw.writeEvent("error", sseError{Error: message})
+			})
+		}
+		return
+	}
+	defer release()
+	generated, err := prompt.generate(model, p, opts)
+	if err != nil {
+		if sw.w == nil {
+			prompt.handleError(err, plainTextError(w))
+		} else {
+			prompt.handleError(err, func(_ int, message string) {
+				sw.writeEvent("error", sseError{Error: message})
+			})
+		}
+		return
+	}
+	if sw.w == nil {
+		prompt.setHeader(w, generated)
+		sw = newSSEWriter(w)
+	}
+	result, err := predict(r.Context(), model.Name, p, generated, opts, stops, func(token string) bool {
+		if token == "" {
+			return true
+		}
+		return sw.writeEvent("token", sseToken{Token: token}) == nil
+	})
+	if err != nil {
+		sw.writeEvent("error", sseError{Error: err.Error()})
+		return
+	}
+	sw.writeEvent("done", sseDone{
+		FinishReason:     result.FinishReason,
+		PromptTokens:     result.PromptTokens,
+		CompletionTokens: result.CompletionTokens,
+		StopSequence:     result.StopSequence,
+		Seed:             seed,
+		DroppedMessages:  result.DroppedMessages,
+	})
 }
 
 type PredictHandler struct {
-	Predictor predictor.Predictor
-	StopRegex *regexp.Regexp
+	Manager *ModelManager
 }
 
 func (h PredictHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -98,8 +422,11 @@ func (h PredictHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		prompt := r.Form.Get("prompt")
-		handlePrediction(w, r, h.Predictor, prompt, h.StopRegex)
+		model := getModelOrFail(w, h.Manager, r.Form.Get("model"))
+		if model == nil {
+			return
+		}
+		handlePrediction(w, r, model, predictionPrompt{text: r.Form.Get("prompt")})
 	default:
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -109,10 +436,7 @@ func (h PredictHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type ChatHandler struct {
-	Predictor      predictor.Predictor
-	PromptTemplate conversation.PromptTemplate
-	SystemPrompt   string
-	StopRegex      *regexp.Regexp
+	Manager *ModelManager
 }
 
 func (h ChatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -125,34 +449,82 @@ func (h ChatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		systemPrompt := h.SystemPrompt
+		// messages with explicit roles
+		var taggedMessages []chatMessage
+		if hasJSONBody(r) {
+			taggedMessages, err = readJSONChatBody(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "failed to parse JSON body: %s", err)
+				return
+			}
+		} else {
+			taggedMessages, err = parseFormChatMessages(r.Form)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+		}
+		model := getModelOrFail(w, h.Manager, r.Form.Get("model"))
+		if model == nil {
+			return
+		}
+		if model.PromptTemplate.IsZero() {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "the prompt template of model '%s' is not set", model.Name)
+			return
+		}
+		systemPrompt := model.SystemPrompt
 		systemPromptGiven := r.Form.Get("system")
 		if systemPromptGiven != "" {
 			systemPrompt = systemPromptGiven
 		}
-		conv := conversation.NewConversation(systemPrompt)
-		messages := r.Form["messages"]
-		for i, message := range messages {
-			if i%2 == 0 {
-				conv.AddMessageUser(message)
-			} else {
-				conv.AddMessageAssistant(message)
+		var conv conversation.Conversation
+		if taggedMessages != nil {
+			if len(r.Form["messages"]) > 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, "messages can't be set both with and without roles")
+				return
+			}
+			if systemPromptGiven != "" && slices.ContainsFunc(taggedMessages, func(m chatMessage) bool { return conversation.Role(m.Role) == conversation.RoleSystem }) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, "the system prompt can't be set both with the parameter system and with system messages")
+				return
+			}
+			policy, err := parseMergePolicy(r.Form.Get("mergeMessages"))
+			if err == nil {
+				conv, err = newChatConversation(taggedMessages, systemPrompt, policy)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, err)
+				return
+			}
+		} else {
+			conv = conversation.NewConversation(systemPrompt)
+			messages := r.Form["messages"]
+			for i, message := range messages {
+				if i%2 == 0 {
+					conv.AddMessageUser(message)
+				} else {
+					conv.AddMessageAssistant(message)
+				}
 			}
 		}
-		prompt, err := conv.GeneratePrompt(h.PromptTemplate)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "conv.GeneratePrompt() failed: %s", err)
-			return
-		}
-		replyPrefix := r.Form.Get("replyPrefix")
-		if replyPrefix != "" {
-			if !strings.HasSuffix(prompt, "\n") {
-				prompt += " "
+		if toolsJSON := r.Form.Get("tools"); toolsJSON != "" {
+			var definitions []toolDefinition
+			err := json.Unmarshal([]byte(toolsJSON), &definitions)
+			if err == nil {
+				conv.Tools, err = newTools(definitions)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "invalid tools: %s", err)
+				return
 			}
-			prompt += replyPrefix
 		}
-		handlePrediction(w, r, h.Predictor, prompt, h.StopRegex)
+		handlePrediction(w, r, model, predictionPrompt{chat: &chatPrompt{conv: conv, replyPrefix: r.Form.Get("replyPrefix")}})
 	default:
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -167,6 +539,7 @@ type ModelConfig struct {
 	PromptTemplate         string  `json:"promptTemplate"`
 	PromptTemplateType     string  `json:"promptTemplateType"`
 	PromptTemplateFilePath string  `json:"promptTemplateFile"`
+	PromptTemplateSyntax   string  `json:"promptTemplateSyntax"`
 	RopeFreqBase           float64 `json:"ropeFreqBase"`
 	RopeFreqScale          float64 `json:"ropeFreqScale"`
 }
@@ -177,6 +550,7 @@ type PredictConfig struct {
 	SystemPrompt         string
 	SystemPromptFilePath string
 	StopRegex            string
+	Stop                 stringList
 	NKeep                int
 	TopK                 int
 	TopP                 float64
@@ -188,223 +562,359 @@ type PredictConfig struct {
 	Mirostat             int
 	MirostatTau          float64
 	MirostatEta          float64
+	Seed                 int
+}
+
+// errRequestTimeout is the cause of the cancellation of the context of requests that take longer than the request timeout.
+var errRequestTimeout = errors.New("request timeout")
+
+// returns a handler that cancels the context of the request after timeout, with a cause that wraps errRequestTimeout.
+// Predictions stop when the context of the request is cancelled.
+func timeoutHandler(h http.Handler, timeout time.Duration) http.Handler {
+	if timeout == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeoutCause(r.Context(), timeout, fmt.Errorf("%w (%s)", errRequestTimeout, timeout))
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// returns the cause of the cancellation of ctx if the request timed out, or nil if it didn't (e.g. the client disconnected).
+func requestTimeoutError(ctx context.Context) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errRequestTimeout) {
+		return cause
+	}
+	return nil
+}
+
+type QueueConfig struct {
+	Size         int
+	Timeout      time.Duration
+	ClientHeader string
 }
 
 type Config struct {
 	Model               ModelConfig
 	ModelConfigFilePath string
+	ConfigFilePath      string
+	GrammarDir          string
+	LazyLoad            bool
+	ModelIdleTimeout    time.Duration
+	MemoryBudget        byteSize
 	Predict             PredictConfig
+	Queue               QueueConfig
 	Addr                string
+	RequestTimeout      time.Duration
+	ShutdownGracePeriod time.Duration
+	AdminToken          string
+	Log                 LogConfig
 	License             bool
 }
 
-func main2() error {
-	var config Config
-
+// defines the command line options of the config in fs.
+func defineFlags(fs *flag.FlagSet, config *Config) {
 	// HTTP server options
-	flag.StringVar(&config.Addr, "addr", "localhost:8080", `TCP network address the server listens on, in the form "host:port" or ":port" (e.g. "localhost:8080" or "127.0.0.1:8080" or ":8080")`)
+	fs.StringVar(&config.Addr, "addr", "localhost:8080", `TCP network address the server listens on, in the form "host:port" or ":port" (e.g. "localhost:8080" or "127.0.0.1:8080" or ":8080")`)
+	fs.DurationVar(&config.ShutdownGracePeriod, "shutdown-grace-period", 30*time.Second, "on SIGINT or SIGTERM, time to wait for in-flight requests to finish, before cancelling them")
+	fs.StringVar(&config.AdminToken, "admin-token", "", "token that authenticates requests to the admin endpoints (e.g. /admin/reload) with the header \"Authorization: Bearer <token>\". If not set, the admin endpoints are disabled")
+	fs.DurationVar(&config.RequestTimeout, "request-timeout", 0, "maximum duration of a request, including the time waiting in the queue. Prediction stops when the limit is reached (0 = no limit)")
+
+	// Logging options
+	fs.StringVar(&config.Log.Format, "log-format", "json", "format of the logs. valid values: json, text")
+	fs.StringVar(&config.Log.Content, "log-content", logContentOmitted, "how prompts and responses are logged. valid values: full, truncated (the first characters, see -log-content-max-length), hashed (SHA-256), omitted (only the length)")
+	fs.IntVar(&config.Log.ContentMaxLength, "log-content-max-length", 200, "maximum number of characters of prompts and responses that are logged if -log-content is truncated")
+
+	// Queue options
+	fs.IntVar(&config.Queue.Size, "queue-size", 16, "maximum number of requests waiting for the model. Requests that arrive when the queue is full are rejected with HTTP 503")
+	fs.DurationVar(&config.Queue.Timeout, "queue-timeout", time.Minute, "maximum time a request waits in the queue, before it is rejected with HTTP 503 (0 = no limit)")
+	fs.StringVar(&config.Queue.ClientHeader, "queue-client-header", "", "name of HTTP header that identifies the client, so requests of different clients are served fairly (default: the IP address identifies the client)")
 
 	// Model options
-	flag.IntVar(&config.Model.ContextSize, "context", 512, "context size")
-	flag.IntVar(&config.Model.GpuLayers, "gpu-layers", 0, "number of GPU layers")
-	flag.StringVar(&config.Model.PromptTemplate, "prompt-template", "", "prompt template. Setting the prompt template with this or the other prompt template flags is required if you want to use the /chat API endpoint")
-	flag.StringVar(&config.Model.PromptTemplateFilePath, "prompt-template-file", "", "path to prompt template file. Setting the prompt template with this or the other prompt template flags is required if you want to use the /chat API endpoint")
-	flag.StringVar(&config.Model.PromptTemplateType, "prompt-template-type", "", "prompt template type. valid values: llama-2, vicuna_v1.1. Setting the prompt template with this or the other prompt template flags is required if you want to use the /chat API endpoint")
-	flag.Float64Var(&config.Model.RopeFreqBase, "rope-freq-base", 0, "RoPE base frequency (default 10000 unless specified in the GGUF file)")
-	flag.Float64Var(&config.Model.RopeFreqScale, "rope-freq-scale", 0, "RoPE frequency scaling factor (default 1 unless specified in the GGUF file)")
-	flag.StringVar(&config.ModelConfigFilePath, "model-config-file", "", "path to config file for the model")
+	fs.IntVar(&config.Model.ContextSize, "context", 512, "context size")
+	fs.IntVar(&config.Model.GpuLayers, "gpu-layers", 0, "number of GPU layers")
+	fs.StringVar(&config.Model.PromptTemplate, "prompt-template", "", "prompt template. Setting the prompt template with this or the other prompt template flags is required if you want to use the /chat API endpoint, unless the prompt template is detected from the metadata of the model file")
+	fs.StringVar(&config.Model.PromptTemplateFilePath, "prompt-template-file", "", "path to prompt template file. Setting the prompt template with this or the other prompt template flags is required if you want to use the /chat API endpoint, unless the prompt template is detected from the metadata of the model file")
+	fs.StringVar(&config.Model.PromptTemplateSyntax, "prompt-template-syntax", "", "syntax of the prompt template set with -prompt-template or -prompt-template-file. valid values: go, jinja (default: jinja for files with extension .jinja or .j2, otherwise go)")
+	fs.StringVar(&config.Model.PromptTemplateType, "prompt-template-type", "", "prompt template type. valid values: "+strings.Join(conversation.PromptTemplateNames(), ", ")+". Setting the prompt template with this or the other prompt template flags is required if you want to use the /chat API endpoint, unless the prompt template is detected from the metadata of the model file")
+	fs.Float64Var(&config.Model.RopeFreqBase, "rope-freq-base", 0, "RoPE base frequency (default 10000 unless specified in the GGUF file)")
+	fs.Float64Var(&config.Model.RopeFreqScale, "rope-freq-scale", 0, "RoPE frequency scaling factor (default 1 unless specified in the GGUF file)")
+	fs.StringVar(&config.ModelConfigFilePath, "model-config-file", "", "path to config file for the model")
+	fs.StringVar(&config.GrammarDir, "grammar-dir", "", "directory of GBNF grammars that requests can use with the parameter grammarName. Every file with extension .gbnf is a grammar, named after the file without the extension")
+	fs.BoolVar(&config.LazyLoad, "lazy-load", false, "load models when they are requested for the first time, instead of at startup")
+	fs.DurationVar(&config.ModelIdleTimeout, "model-idle-timeout", 0, "unload models that have not been used for this duration. They are loaded again when requested (0 = never unload)")
+	fs.Var(&config.MemoryBudget, "memory-budget", `maximum memory the loaded models can use, e.g. "16GiB". The memory a model needs is estimated from the size of its file. If loading a model would exceed the budget, the least recently used models are unloaded (0 = no limit)`)
+	fs.StringVar(&config.ConfigFilePath, "config-file", "", "path to config file that defines the models to serve, in addition to the models given as arguments")
 
 	// Predict options
-	flag.IntVar(&config.Predict.NKeep, "n-keep", 0, "number of tokens to keep from initial prompt (0 = disabled)")
-	flag.StringVar(&config.Predict.StopRegex, "stop-regex", "", "regular expression that will stop prediction, if a match is found (experimental)")
-	flag.StringVar(&config.Predict.SystemPrompt, "system-prompt", "", "system prompt")
-	flag.StringVar(&config.Predict.SystemPromptFilePath, "system-prompt-file", "", "read the system prompt from this file")
-	flag.IntVar(&config.Predict.Threads, "threads", runtime.NumCPU(), "number of threads")
-	flag.IntVar(&config.Predict.Tokens, "tokens", 0, "number of tokens to predict (0 = no limit)")
+	fs.IntVar(&config.Predict.NKeep, "n-keep", 0, "number of tokens to keep from initial prompt (0 = disabled)")
+	fs.StringVar(&config.Predict.StopRegex, "stop-regex", "", "regular expression that will stop prediction, if a match is found (experimental)")
+	fs.Var(&config.Predict.Stop, "stop", "string that will stop prediction, if it is generated. Use it multiple times to set multiple stop strings")
+	fs.StringVar(&config.Predict.SystemPrompt, "system-prompt", "", "system prompt")
+	fs.StringVar(&config.Predict.SystemPromptFilePath, "system-prompt-file", "", "read the system prompt from this file")
+	fs.IntVar(&config.Predict.Threads, "threads", runtime.NumCPU(), "number of threads")
+	fs.IntVar(&config.Predict.Tokens, "tokens", 0, "number of tokens to predict (0 = no limit)")
 
 	// Sampling options
-	flag.IntVar(&config.Predict.TopK, "top-k", 40, "top-k")
-	flag.Float64Var(&config.Predict.TopP, "top-p", 0.2, "top-p (1 = disabled)")
-	flag.Float64Var(&config.Predict.Temperature, "temperature", 0.8, "temperature")
-	flag.Float64Var(&config.Predict.TailFreeSamplingZ, "tail-free-sampling-z", 1, "tail free sampling parameter z (1 = disabled)")
-	flag.Float64Var(&config.Predict.FrequencyPenalty, "penalty-frequency", 0.1, "frequency penalty (0 = disabled)")
-	flag.Float64Var(&config.Predict.PresencePenalty, "penalty-presence", 0, "presense penalty (0 = disabled)")
-	flag.Float64Var(&config.Predict.RepetitionPenalty, "penalty-repetition", 1.1, "repetition penalty (1 = disabled)")
-	flag.IntVar(&config.Predict.Mirostat, "mirostat", 0, "mirostat (0 = disabled, 1 = mirostat, 2 = mirostat 2.0)")
-	flag.Float64Var(&config.Predict.MirostatTau, "mirostat-tau", 5, "mirostat target entropy")
-	flag.Float64Var(&config.Predict.MirostatEta, "mirostat-eta", 0.1, "mirostat learning rate")
+	fs.IntVar(&config.Predict.TopK, "top-k", 40, "top-k")
+	fs.Float64Var(&config.Predict.TopP, "top-p", 0.2, "top-p (1 = disabled)")
+	fs.Float64Var(&config.Predict.Temperature, "temperature", 0.8, "temperature")
+	fs.Float64Var(&config.Predict.TailFreeSamplingZ, "tail-free-sampling-z", 1, "tail free sampling parameter z (1 = disabled)")
+	fs.Float64Var(&config.Predict.FrequencyPenalty, "penalty-frequency", 0.1, "frequency penalty (0 = disabled)")
+	fs.Float64Var(&config.Predict.PresencePenalty, "penalty-presence", 0, "presense penalty (0 = disabled)")
+	fs.Float64Var(&config.Predict.RepetitionPenalty, "penalty-repetition", 1.1, "repetition penalty (1 = disabled)")
+	fs.IntVar(&config.Predict.Mirostat, "mirostat", 0, "mirostat (0 = disabled, 1 = mirostat, 2 = mirostat 2.0)")
+	fs.Float64Var(&config.Predict.MirostatTau, "mirostat-tau", 5, "mirostat target entropy")
+	fs.Float64Var(&config.Predict.MirostatEta, "mirostat-eta", 0.1, "mirostat learning rate")
+	fs.IntVar(&config.Predict.Seed, "seed", -1, "seed of the random number generator of the sampler, so predictions can be repeated (-1 = random seed for every request)")
 
 	// other options
-	flag.BoolVar(&config.License, "license", false, "show license")
-
-	flag.Parse()
-
-	if config.License {
-		fmt.Printf("%v\n", license)
-		for _, licenseDep := range licenseDeps {
-			fmt.Printf("\n%v\n", licenseDep)
-		}
-		return nil
-	}
+	fs.BoolVar(&config.License, "license", false, "show license")
+}
 
-	args := flag.Args()
-	if len(args) == 0 {
-		return errors.New("no arguments")
-	}
-	if len(args) > 1 {
-		return errors.New("too many arguments")
+// parses the command line options and the model config file.
+// Command line options have priority over the model config file.
+// Returns the config and the command line arguments that are not options.
+func parseConfig(arguments []string, errorHandling flag.ErrorHandling) (Config, []string, error) {
+	var config Config
+	fs := flag.NewFlagSet(os.Args[0], errorHandling)
+	defineFlags(fs, &config)
+	err := fs.Parse(arguments)
+	if err != nil {
+		return Config{}, nil, err
 	}
-
 	if config.ModelConfigFilePath != "" {
 		modelConfigFile, err := os.Open(config.ModelConfigFilePath)
 		if err != nil {
-			return fmt.Errorf("failed to open model config file: %s", err)
+			return Config{}, nil, fmt.Errorf("failed to open model config file: %s", err)
 		}
 		err = json.NewDecoder(modelConfigFile).Decode(&config.Model)
-		if err != nil {
-			return fmt.Errorf("failed to parse model config file: %s", err)
-		}
 		modelConfigFile.Close()
-		// parse flags again because command line options have priority over config file
-		flag.Parse()
-	}
-
-	var stopRegex *regexp.Regexp
-	if config.Predict.StopRegex != "" {
-		var err error
-		stopRegex, err = regexp.Compile(config.Predict.StopRegex)
 		if err != nil {
-			return fmt.Errorf("failed to parse regex of flag -stop-regex: %s", err)
+			return Config{}, nil, fmt.Errorf("failed to parse model config file: %s", err)
 		}
+		// parse flags again because command line options have priority over config file
+		fs.Parse(arguments)
 	}
+	return config, fs.Args(), nil
+}
 
-	// set systemPrompt
-	var systemPrompt string
+// returns the configuration of the models given as arguments and the models defined in the config file.
+func modelConfigsFromConfig(config Config, args []string) ([]NamedModelConfig, error) {
 	if config.Predict.SystemPrompt != "" && config.Predict.SystemPromptFilePath != "" {
-		return errors.New("cannot use flags -system-prompt and -system-prompt-file at the same time")
+		return nil, errors.New("cannot use flags -system-prompt and -system-prompt-file at the same time")
 	}
-	if config.Predict.SystemPrompt != "" {
-		systemPrompt = config.Predict.SystemPrompt
-	} else if config.Predict.SystemPromptFilePath != "" {
-		systemPromptBytes, err := os.ReadFile(config.Predict.SystemPromptFilePath)
+	// models given as arguments are configured by the command line options,
+	// and models defined in the config file take the values of the command line options as defaults
+	defaultModelConfig := NamedModelConfig{
+		ModelConfig:          config.Model,
+		SystemPrompt:         config.Predict.SystemPrompt,
+		SystemPromptFilePath: config.Predict.SystemPromptFilePath,
+		Stop:                 config.Predict.Stop,
+	}
+	var fileConfig FileConfig
+	if config.ConfigFilePath != "" {
+		var err error
+		fileConfig, err = readFileConfig(config.ConfigFilePath, defaultModelConfig)
 		if err != nil {
-			return fmt.Errorf("failed to read system prompt from file: %s", err)
+			return nil, err
 		}
-		systemPrompt = strings.TrimSpace(string(systemPromptBytes))
 	}
-
-	// make sure only one of the -prompt-template* flags is set
-	if config.Model.PromptTemplate != "" && config.Model.PromptTemplateType != "" {
-		return errors.New("conflicting flags: -prompt-template -prompt-template-type")
+	// the limits and the presets of the config file apply to the models given as arguments too
+	defaultModelConfig.SamplingLimits = fileConfig.SamplingLimits
+	defaultModelConfig.SamplingPresets = fileConfig.SamplingPresets
+	var modelConfigs []NamedModelConfig
+	for _, arg := range args {
+		modelConfig := defaultModelConfig
+		modelConfig.Name, modelConfig.Path = parseModelArg(arg)
+		modelConfigs = append(modelConfigs, modelConfig)
 	}
-	if config.Model.PromptTemplate != "" && config.Model.PromptTemplateFilePath != "" {
-		return errors.New("conflicting flags: -prompt-template -prompt-template-file")
+	modelConfigs = append(modelConfigs, fileConfig.Models...)
+	if len(modelConfigs) == 0 {
+		return nil, errors.New("no models: set the path of the model as argument")
 	}
-	if config.Model.PromptTemplateType != "" && config.Model.PromptTemplateFilePath != "" {
-		return errors.New("conflicting flags: -prompt-template-type -prompt-template-file")
+	modelNames := make(map[string]bool)
+	for _, modelConfig := range modelConfigs {
+		if modelConfig.Name == "" || modelConfig.Path == "" {
+			return nil, errors.New("every model needs a name and a path")
+		}
+		if modelNames[modelConfig.Name] {
+			return nil, fmt.Errorf("duplicate model name: '%s'", modelConfig.Name)
+		}
+		modelNames[modelConfig.Name] = true
 	}
-	// set promptTemplate from one of the -prompt-template* flags
-	var promptTemplate conversation.PromptTemplate
-	if config.Model.PromptTemplate != "" {
+	return modelConfigs, nil
+}
+
+// creates the models defined by the config. The models are not loaded.
+func newModels(config Config, modelConfigs []NamedModelConfig, manager *ModelManager) (Models, error) {
+	var stopRegex *regexp.Regexp
+	if config.Predict.StopRegex != "" {
 		var err error
-		promptTemplate, err = conversation.NewPromptTemplate(config.Model.PromptTemplate)
+		stopRegex, err = regexp.Compile(config.Predict.StopRegex)
 		if err != nil {
-			return fmt.Errorf("failed to create prompt template: %s", err)
-		}
-	} else if config.Model.PromptTemplateType != "" {
-		switch config.Model.PromptTemplateType {
-		case "llama-2":
-			promptTemplate = conversation.PromptTemplateLlama2
-		case "vicuna_v1.1":
-			promptTemplate = conversation.PromptTemplateVicunaV11
-		default:
-			return fmt.Errorf("invalid value of prompt_template_type: '%s'", config.Model.PromptTemplateType)
-		}
-	} else if config.Model.PromptTemplateFilePath != "" {
-		if promptTemplate.Template != nil {
-			return errors.New("cannot set both prompt_template_type and prompt_template_file")
-		}
-		promptTemplateFileBytes, err := os.ReadFile(config.Model.PromptTemplateFilePath)
+			return nil, fmt.Errorf("failed to parse regex of flag -stop-regex: %s", err)
+		}
+	}
+	grammars, err := readGrammars(config.GrammarDir)
+	if err != nil {
+		return nil, err
+	}
+	var models Models
+	for _, modelConfig := range modelConfigs {
+		// every model has its own queue, because predictions of different models can run at the same time
+		requestQueue := &RequestQueue{
+			Queue:        queue.New(config.Queue.Size, config.Queue.Timeout),
+			ClientHeader: config.Queue.ClientHeader,
+		}
+		model, err := newModel(modelConfig, config.Predict, stopRegex, grammars, requestQueue, manager)
 		if err != nil {
-			return fmt.Errorf("failed to read prompt template file '%s': %s", config.Model.PromptTemplateFilePath, err)
+			return nil, fmt.Errorf("failed to configure model '%s': %s", modelConfig.Name, err)
 		}
-		promptTemplateTemplate, err := template.New("user").Parse(string(promptTemplateFileBytes))
+		models = append(models, model)
+	}
+	return models, nil
+}
+
+// loads the models that are not loaded.
+func loadModels(manager *ModelManager, models Models) error {
+	for _, model := range models {
+		err := manager.Load(model)
 		if err != nil {
-			return fmt.Errorf("failed to parse prompt template file: %s", err)
+			return fmt.Errorf("failed to load model '%s': %s", model.Name, err)
 		}
-		promptTemplate = conversation.PromptTemplate{
-			Template: promptTemplateTemplate,
+	}
+	return nil
+}
+
+func main2() error {
+	config, args, err := parseConfig(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		return err
+	}
+
+	if config.License {
+		fmt.Printf("%v\n", license)
+		for _, licenseDep := range licenseDeps {
+			fmt.Printf("\n%v\n", licenseDep)
 		}
+		return nil
+	}
+
+	logger, err := newLogger(config.Log)
+	if err != nil {
+		return err
 	}
+	// the output of the log package goes to the logger too
+	slog.SetDefault(logger)
 
-	configJSON, _ := json.MarshalIndent(config, "", "  ")
+	modelConfigs, err := modelConfigsFromConfig(config, args)
+	if err != nil {
+		return err
+	}
+
+	configJSON, _ := json.MarshalIndent(struct {
+		Config
+		Models []NamedModelConfig
+	}{config, modelConfigs}, "", "  ")
 	fmt.Println(string(configJSON))
 
-	// fail if system prompt is not set and it is required
-	if systemPrompt == "" && promptTemplate.RequiresSystemPrompt {
-		return errors.New("system prompt not set but the prompt template requires one")
-	}
-
-	modelFilePath := args[0]
-	modelOptions := []llama.ModelOption{
-		llama.SetContext(config.Model.ContextSize),
-		llama.SetGPULayers(config.Model.GpuLayers),
-	}
-	if config.Model.RopeFreqBase != 0 {
-		modelOptions = append(modelOptions, llama.WithRopeFreqBase(float32(config.Model.RopeFreqBase)))
-	}
-	if config.Model.RopeFreqScale != 0 {
-		modelOptions = append(modelOptions, llama.WithRopeFreqScale(float32(config.Model.RopeFreqScale)))
-	}
-	predictor, err := predictor.New(
-		modelFilePath,
-		modelOptions,
-		[]llama.PredictOption{
-			llama.SetTokens(config.Predict.Tokens),
-			llama.SetThreads(config.Predict.Threads),
-			llama.SetNKeep(config.Predict.NKeep),
-			llama.SetTopK(config.Predict.TopK),
-			llama.SetTopP(float32(config.Predict.TopP)),
-			llama.SetTemperature(float32(config.Predict.Temperature)),
-			llama.SetTailFreeSamplingZ(float32(config.Predict.TailFreeSamplingZ)),
-			llama.SetPenalty(float32(config.Predict.RepetitionPenalty)),
-			llama.SetFrequencyPenalty(float32(config.Predict.FrequencyPenalty)),
-			llama.SetPresencePenalty(float32(config.Predict.PresencePenalty)),
-			llama.SetMirostat(config.Predict.Mirostat),
-			llama.SetMirostatTAU(float32(config.Predict.MirostatTau)),
-			llama.SetMirostatETA(float32(config.Predict.MirostatEta)),
-			llama.SetPenalizeNL(false),
-		},
-	)
+	manager := NewModelManager(int64(config.MemoryBudget), config.ModelIdleTimeout)
+	defer manager.Free()
+	models, err := newModels(config, modelConfigs, manager)
 	if err != nil {
-		return fmt.Errorf("predictor.New() failed: %s", err)
+		return err
+	}
+	for _, model := range models {
+		if model.PromptTemplate.IsZero() {
+			log.Printf("`/chat` and `/v1/chat/completions` endpoints are not working for model '%s' because prompt template is not set and it was not detected from the metadata of the model file\n", model.Name)
+		}
+	}
+	manager.SetModels(models)
+	if !config.LazyLoad {
+		err = loadModels(manager, models)
+		if err != nil {
+			return err
+		}
+	}
+
+	reloader := &Reloader{
+		Arguments: os.Args[1:],
+		Manager:   manager,
 	}
-	defer predictor.Free()
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	defer signal.Stop(reloadSignal)
+	go func() {
+		for range reloadSignal {
+			log.Println("received SIGHUP: reloading configuration")
+			reloader.Reload()
+		}
+	}()
 
 	mux := http.NewServeMux()
-	mux.Handle("/predict", PredictHandler{
-		Predictor: predictor,
-		StopRegex: stopRegex,
-	})
-	if promptTemplate.Template != nil {
-		mux.Handle("/chat", ChatHandler{
-			Predictor:      predictor,
-			PromptTemplate: promptTemplate,
-			SystemPrompt:   systemPrompt,
-			StopRegex:      stopRegex,
-		})
-	} else {
-		log.Println("`/chat` endpoint is not working because prompt template is not set")
+	// requests to every endpoint are counted in the metrics
+	handle := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, instrumentHandler(pattern, h))
+	}
+	handle("/predict", PredictHandler{Manager: manager})
+	handle("/chat", ChatHandler{Manager: manager})
+	handle("/v1/models", ModelsHandler{Manager: manager})
+	handle("/status", StatusHandler{Manager: manager})
+	handle("/presets", PresetsHandler{Manager: manager})
+	handle("/templates", TemplatesHandler{})
+	handle("/v1/completions", CompletionsHandler{Manager: manager})
+	handle("/v1/chat/completions", ChatCompletionsHandler{Manager: manager})
+	registerModelMetrics(manager)
+	mux.Handle("/metrics", metricsRegistry)
+	if config.AdminToken != "" {
+		handle("/admin/reload", ReloadHandler{Reloader: reloader, Token: config.AdminToken})
 	}
 
+	// the context of all requests is cancelled when the grace period of the shutdown expires
+	baseCtx, cancelBaseCtx := context.WithCancelCause(context.Background())
+	defer cancelBaseCtx(nil)
 	s := &http.Server{
-		Handler:     mux,
+		Handler:     logRequests(timeoutHandler(mux, config.RequestTimeout), config.Log),
 		ReadTimeout: 30 * time.Second,
 		Addr:        config.Addr,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
 	}
-	err = s.ListenAndServe()
-	if err != nil {
+	signalCtx, stopSignal := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignal()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
 		return fmt.Errorf("ListenAndServe() failed: %s", err)
+	case <-signalCtx.Done():
+	}
+	// restore the default behavior, so a second signal kills the process immediately
+	stopSignal()
+	return shutdown(s, config.ShutdownGracePeriod, cancelBaseCtx)
+}
+
+// stops accepting new requests, and waits for in-flight requests to finish.
+// If they don't finish within the grace period, they are cancelled, so the predictions stop at the next token.
+func shutdown(s *http.Server, gracePeriod time.Duration, cancelRequests context.CancelCauseFunc) error {
+	log.Printf("shutting down: waiting up to %s for in-flight requests to finish\n", gracePeriod)
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("Shutdown() failed: %s", err)
+	}
+	log.Println("shutting down: grace period expired, cancelling in-flight requests")
+	cancelRequests(errors.New("server shutdown"))
+	err = s.Shutdown(context.Background())
+	if err != nil {
+		return fmt.Errorf("Shutdown() failed: %s", err)
 	}
 	return nil
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cmitsakis/llm-api/internal/llm/predictor"
+	llama "github.com/go-skynet/go-llama.cpp"
+)
+
+// fakeLLM is a model that predicts the same tokens for every prompt, and counts every byte of text as a token.
+type fakeLLM struct {
+	tokens []string
+	// time it takes to predict every token
+	delay time.Duration
+}
+
+func (l fakeLLM) Predict(text string, opts ...llama.PredictOption) (string, error) {
+	options := llama.NewPredictOptions(opts...)
+	var response strings.Builder
+	for i, token := range l.tokens {
+		if options.Tokens > 0 && i >= options.Tokens {
+			break
+		}
+		time.Sleep(l.delay)
+		response.WriteString(token)
+		if options.TokenCallback != nil && !options.TokenCallback(token) {
+			break
+		}
+	}
+	return response.String(), nil
+}
+
+func (l fakeLLM) TokenizeString(text string, opts ...llama.PredictOption) (int32, []int32, error) {
+	return int32(len(text)), nil, nil
+}
+
+func (l fakeLLM) Free() {}
+
+// returns a model named "a" whose predictor is llm, with a context of 512 tokens.
+func newTestModelWithLLM(t *testing.T, llm predictor.LLM) (*ModelManager, *Model) {
+	mm := NewModelManager(0, 0)
+	mm.newPredictor = func(m *modelInstance) (predictor.Predictor, error) {
+		return predictor.NewFromLLM(llm, nil), nil
+	}
+	model := newTestModel(t, mm, "a", 10)
+	model.config.ContextSize = 512
+	mm.SetModels(Models{model})
+	return mm, model
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tokens := strings.Split(strings.Repeat("a", 100), "")
+	for _, test := range []struct {
+		name string
+		llm  fakeLLM
+		form url.Values
+		// true if the queue is busy, so the request times out while waiting
+		busy       bool
+		statusCode int
+		body       string
+	}{
+		{"waiting in queue", fakeLLM{tokens: tokens}, url.Values{}, true, http.StatusServiceUnavailable, "server is busy: request timeout (20ms)"},
+		{"before the first token", fakeLLM{tokens: tokens, delay: 100 * time.Millisecond}, url.Values{}, false, http.StatusGatewayTimeout, "request timeout (20ms)"},
+		{"jsonSchema", fakeLLM{tokens: tokens, delay: 5 * time.Millisecond}, url.Values{"jsonSchema": {`{"type": "string"}`}}, false, http.StatusGatewayTimeout, "request timeout (20ms)"},
+		{"stream", fakeLLM{tokens: tokens, delay: 5 * time.Millisecond}, url.Values{"stream": {"true"}}, false, http.StatusOK, "event: error\ndata: {\"error\":\"request timeout (20ms)\"}\n\n"},
+	} {
+		mm, model := newTestModelWithLLM(t, test.llm)
+		if test.busy {
+			release, err := model.Queue.Acquire(context.Background(), "other client", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+		}
+		test.form.Set("model", "a")
+		test.form.Set("prompt", "hello")
+		r := httptest.NewRequest("POST", "/predict", strings.NewReader(test.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		timeoutHandler(PredictHandler{Manager: mm}, 20*time.Millisecond).ServeHTTP(w, r)
+		if w.Code != test.statusCode {
+			fmt.Printf("%s: status code = %d, expected %d\n", test.name, w.Code, test.statusCode)
+			t.Fail()
+		}
+		if body := w.Body.String(); !strings.HasSuffix(body, test.body) {
+			fmt.Printf("%s: body = %q, expected to end with %q\n", test.name, body, test.body)
+			t.Fail()
+		}
+	}
+}
+
+func TestRequestCancelledByClient(t *testing.T) {
+	mm, _ := newTestModelWithLLM(t, fakeLLM{tokens: []string{"a", "b"}})
+	form := url.Values{"model": {"a"}, "prompt": {"hello"}, "jsonSchema": {`{"type": "string"}`}}
+	ctx, cancel := context.WithCancel(context.Background())
+	// the client disconnected before the prediction started
+	cancel()
+	r := httptest.NewRequest("POST", "/predict", strings.NewReader(form.Encode())).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	timeoutHandler(PredictHandler{Manager: mm}, time.Minute).ServeHTTP(w, r)
+	if w.Body.Len() != 0 {
+		fmt.Printf("body = %q, expected nothing to be sent to the client that disconnected\n", w.Body.String())
+		t.Fail()
+	}
+}
+
+// starts a server with handler, sends a request to it, and shuts the server down while the handler runs.
+// It returns the error of shutdown() and the cause of the cancellation of the context of the request.
+func shutdownDuringRequest(t *testing.T, handler func(r *http.Request), gracePeriod time.Duration) (error, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseCtx, cancelBaseCtx := context.WithCancelCause(context.Background())
+	defer cancelBaseCtx(nil)
+	started := make(chan struct{})
+	cause := make(chan error, 1)
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			handler(r)
+			cause <- context.Cause(r.Context())
+		}),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	go s.Serve(ln)
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+	err = shutdown(s, gracePeriod, cancelBaseCtx)
+	return err, <-cause
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	err, cause := shutdownDuringRequest(t, func(r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}, time.Minute)
+	if err != nil {
+		fmt.Printf("shutdown() failed: %s\n", err)
+		t.Fail()
+	}
+	if cause != nil {
+		fmt.Printf("the request that finished within the grace period was cancelled: %s\n", cause)
+		t.Fail()
+	}
+}
+
+func TestShutdownCancelsRequestsAfterGracePeriod(t *testing.T) {
+	err, cause := shutdownDuringRequest(t, func(r *http.Request) {
+		<-r.Context().Done()
+	}, 20*time.Millisecond)
+	if err != nil {
+		fmt.Printf("shutdown() failed: %s\n", err)
+		t.Fail()
+	}
+	if cause == nil || cause.Error() != "server shutdown" {
+		fmt.Printf("cause of the cancellation of the request = %v, expected server shutdown\n", cause)
+		t.Fail()
+	}
+}
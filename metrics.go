@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"cmitsakis/llm-api/internal/metrics"
+)
+
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	metricHTTPRequests = metricsRegistry.NewCounter("llm_api_http_requests_total",
+		"Number of HTTP requests by endpoint and status code (499 if the client cancelled the request before the response started).", "endpoint", "code")
+	metricRejectedRequests = metricsRegistry.NewCounter("llm_api_rejected_requests_total",
+		"Number of requests rejected with HTTP 503 because the server is busy, by reason (queue_full, queue_timeout, request_timeout, memory_budget).", "model", "reason")
+	metricPromptTokens = metricsRegistry.NewCounter("llm_api_prompt_tokens_total",
+		"Number of prompt tokens processed.", "model")
+	metricCompletionTokens = metricsRegistry.NewCounter("llm_api_completion_tokens_total",
+		"Number of tokens generated.", "model")
+	metricPredictions = metricsRegistry.NewCounter("llm_api_predictions_total",
+		"Number of predictions by finish reason (stop, length, eos, cancelled, error).", "model", "finish_reason")
+	metricTimeToFirstToken = metricsRegistry.NewHistogram("llm_api_time_to_first_token_seconds",
+		"Time from the start of the prediction until the first token is generated.",
+		metrics.ExponentialBuckets(0.05, 2, 12), "model")
+	metricTokensPerSecond = metricsRegistry.NewHistogram("llm_api_tokens_per_second",
+		"Generation speed of predictions, measured after the first token.",
+		metrics.ExponentialBuckets(1, 2, 10), "model")
+	metricQueueWait = metricsRegistry.NewHistogram("llm_api_queue_wait_seconds",
+		"Time requests waited in the queue for the model.",
+		metrics.ExponentialBuckets(0.01, 4, 10), "model")
+	metricModelLoad = metricsRegistry.NewHistogram("llm_api_model_load_seconds",
+		"Time it took to load models.",
+		metrics.ExponentialBuckets(0.5, 2, 10), "model")
+)
+
+// registers the metrics that are collected from the state of the models.
+func registerModelMetrics(manager *ModelManager) {
+	metricsRegistry.NewGaugeFunc("llm_api_queue_length", "Number of requests waiting in the queue of the model.", func(set func(float64, ...string)) {
+		for _, model := range manager.Models() {
+			set(float64(model.Queue.Len()), model.Name)
+		}
+	}, "model")
+	metricsRegistry.NewGaugeFunc("llm_api_model_loaded", "1 if the model is loaded, 0 otherwise.", func(set func(float64, ...string)) {
+		for _, model := range manager.Models() {
+			loaded := 0.0
+			if model.loaded() {
+				loaded = 1
+			}
+			set(loaded, model.Name)
+		}
+	}, "model")
+}
+
+// records the metrics of a prediction.
+// firstToken is when the first token was generated, or zero if no token was generated.
+func observePrediction(model string, start time.Time, firstToken time.Time, result predictionResult, err error) {
+	metricPromptTokens.Add(float64(result.PromptTokens), model)
+	metricCompletionTokens.Add(float64(result.CompletionTokens), model)
+	if err != nil {
+		metricPredictions.Inc(model, "error")
+	} else {
+		metricPredictions.Inc(model, result.FinishReason)
+	}
+	if firstToken.IsZero() {
+		return
+	}
+	metricTimeToFirstToken.Observe(firstToken.Sub(start).Seconds(), model)
+	if generation := time.Since(firstToken).Seconds(); result.CompletionTokens > 1 && generation > 0 {
+		metricTokensPerSecond.Observe(float64(result.CompletionTokens-1)/generation, model)
+	}
+}
+
+// status code recorded for requests that the client cancelled before the response started, as nginx does.
+// It's never sent, because the client is gone.
+const statusClientClosedRequest = 499
+
+// statusRecorder records the status code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+// returns the status code of the response to r, after the handler returned.
+// If the response didn't start, it's 200, which net/http sends,
+// unless the request was cancelled (e.g. the client disconnected), so the handler didn't respond.
+func (sr *statusRecorder) status(r *http.Request) int {
+	if sr.statusCode != 0 {
+		return sr.statusCode
+	}
+	if r.Context().Err() != nil {
+		return statusClientClosedRequest
+	}
+	return http.StatusOK
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	if sr.statusCode == 0 {
+		sr.statusCode = statusCode
+	}
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.statusCode == 0 {
+		sr.statusCode = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// needed for streaming responses
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		if sr.statusCode == 0 {
+			sr.statusCode = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// counts the requests to the endpoint by status code.
+func instrumentHandler(endpoint string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			metricHTTPRequests.Inc(endpoint, strconv.Itoa(sr.status(r)))
+		}()
+		h.ServeHTTP(sr, r)
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInstrumentHandlerStatus(t *testing.T) {
+	for _, test := range []struct {
+		endpoint string
+		handler  http.HandlerFunc
+		// true if the client disconnected
+		cancelled bool
+		code      string
+	}{
+		{"/test-ok", func(w http.ResponseWriter, r *http.Request) {}, false, "200"},
+		{"/test-error", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadRequest) }, false, "400"},
+		// the handler returns without responding, because the client is gone
+		{"/test-cancelled", func(w http.ResponseWriter, r *http.Request) {}, true, "499"},
+		// the response started before the client disconnected
+		{"/test-cancelled-stream", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("a")) }, true, "200"},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancelled {
+			cancel()
+		}
+		r := httptest.NewRequest("GET", test.endpoint, nil).WithContext(ctx)
+		instrumentHandler(test.endpoint, test.handler).ServeHTTP(httptest.NewRecorder(), r)
+		cancel()
+		var sb strings.Builder
+		metricsRegistry.WriteText(&sb)
+		expected := fmt.Sprintf(`llm_api_http_requests_total{endpoint="%s",code="%s"} 1`, test.endpoint, test.code)
+		if !strings.Contains(sb.String(), expected+"\n") {
+			fmt.Printf("the metrics don't contain %s\n", expected)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,1024 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+
+	"cmitsakis/llm-api/internal/llm/conversation"
+	"cmitsakis/llm-api/internal/llm/gguf"
+	"cmitsakis/llm-api/internal/llm/grammar"
+	"cmitsakis/llm-api/internal/llm/jsonschema"
+	"cmitsakis/llm-api/internal/llm/predictor"
+	"cmitsakis/llm-api/internal/llm/stop"
+	"cmitsakis/llm-api/internal/queue"
+)
+
+// Model is a model the server serves, together with its configuration.
+// The configuration of a Model doesn't change. When the configuration is reloaded, new Models replace the old ones.
+type Model struct {
+	Name            string
+	PromptTemplate  conversation.PromptTemplate
+	SystemPrompt    string
+	StopRegex       *regexp.Regexp
+	Stop            []string
+	SamplingLimits  SamplingLimits
+	SamplingPresets SamplingPresets
+	// seed used if the request doesn't set one (-1 = random)
+	Seed int
+	// named grammars that requests can use with the parameter grammarName
+	Grammars map[string]string
+	// true if the tokenizer of the model adds the beginning-of-sequence token to the prompt,
+	// so it's removed from the text the prompt template generates
+	AddsBOS bool
+	*modelInstance
+}
+
+// modelInstance is the model file loaded in memory.
+// The model is loaded when it's needed, and it can be unloaded when it's idle.
+// If the configuration is reloaded but the model file and its settings didn't change,
+// the new Model uses the same modelInstance.
+type modelInstance struct {
+	name           string
+	config         NamedModelConfig
+	predictOptions []llama.PredictOption
+	manager        *ModelManager
+	Queue          *RequestQueue
+
+	// the following fields are guarded by mu
+	mu sync.Mutex
+	// nil if the model is not loaded
+	predictor *predictor.Predictor
+	// number of requests that use the predictor
+	inUse        int
+	memory       int64
+	loadedAt     time.Time
+	loadDuration time.Duration
+	lastUsed     time.Time
+	idleTimer    *time.Timer
+	// true if the instance was replaced after a reload. It's unloaded as soon as it's not in use.
+	retired bool
+}
+
+// returns a matcher of the stop sequences of the model and the stop sequences of the request.
+func (m *Model) stopMatcher(literals []string, regexps ...*regexp.Regexp) *stop.Matcher {
+	return stop.New(append(m.Stop[:len(m.Stop):len(m.Stop)], literals...), append(regexps, m.StopRegex))
+}
+
+// drops the oldest messages of the conversation, so the prompt and the tokens to predict (set by opts) fit in the context of the model.
+// If the tokens to predict are not limited, the prompt can use the whole context.
+// prompt returns the prompt of the text the prompt template generated.
+// It returns the number of dropped messages and the number of tokens of the prompt.
+func (m *Model) fitConversation(p predictor.Predictor, conv *conversation.Conversation, opts []llama.PredictOption, prompt func(generated string) string) (int, int, error) {
+	budget := m.config.ContextSize - p.Options(opts...).Tokens
+	return conv.Fit(m.PromptTemplate, budget, func(generated string) (int, error) {
+		return p.CountTokens(prompt(generated))
+	})
+}
+
+// Models are the models the server serves. The first one is the default model.
+type Models []*Model
+
+var errModelNotFound = errors.New("model not found")
+
+// returns the model with the given name, or the default model if name is empty.
+func (models Models) Get(name string) (*Model, error) {
+	if name == "" {
+		return models[0], nil
+	}
+	for _, model := range models {
+		if model.Name == name {
+			return model, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: '%s'", errModelNotFound, name)
+}
+
+// waits in the queue of the model, and loads the model if it's not loaded.
+// It returns the predictor of the model, and a function that must be called when the predictor is no longer used.
+func (m *modelInstance) acquire(w http.ResponseWriter, r *http.Request, onPosition func(position int)) (predictor.Predictor, func(), error) {
+	start := time.Now()
+	releaseQueue, err := m.Queue.acquire(w, r, onPosition)
+	if err != nil {
+		return predictor.Predictor{}, nil, err
+	}
+	metricQueueWait.Observe(time.Since(start).Seconds(), m.name)
+	p, err := m.use()
+	if err != nil {
+		releaseQueue()
+		return predictor.Predictor{}, nil, err
+	}
+	return p, func() {
+		m.unuse()
+		releaseQueue()
+	}, nil
+}
+
+// handles an error returned by acquire().
+func (m *modelInstance) handleError(w http.ResponseWriter, err error, writeError func(statusCode int, message string)) {
+	var loadErr modelLoadError
+	if !errors.As(err, &loadErr) {
+		switch {
+		case errors.Is(err, queue.ErrFull):
+			metricRejectedRequests.Inc(m.name, "queue_full")
+		case errors.Is(err, queue.ErrTimeout):
+			metricRejectedRequests.Inc(m.name, "queue_timeout")
+		case errors.Is(err, errRequestTimeout):
+			metricRejectedRequests.Inc(m.name, "request_timeout")
+		}
+		m.Queue.handleError(w, err, writeError)
+		return
+	}
+	log.Printf("failed to load model '%s': %s\n", m.name, err)
+	if errors.Is(err, errMemoryBudgetExceeded) {
+		metricRejectedRequests.Inc(m.name, "memory_budget")
+		writeError(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeError(http.StatusInternalServerError, err.Error())
+}
+
+// marks the predictor as used, loading it if necessary.
+func (m *modelInstance) use() (predictor.Predictor, error) {
+	m.mu.Lock()
+	if m.predictor != nil {
+		m.inUse++
+		m.lastUsed = time.Now()
+		p := *m.predictor
+		m.mu.Unlock()
+		return p, nil
+	}
+	m.mu.Unlock()
+	// the model has to be loaded.
+	// Loading is done while holding the lock of the manager, so models are loaded one at a time,
+	// and the memory budget is not exceeded.
+	m.manager.mu.Lock()
+	defer m.manager.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.predictor == nil {
+		err := m.manager.loadLocked(m)
+		if err != nil {
+			return predictor.Predictor{}, modelLoadError{err}
+		}
+	}
+	m.inUse++
+	m.lastUsed = time.Now()
+	return *m.predictor, nil
+}
+
+// returns true if the model is loaded.
+func (m *modelInstance) loaded() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.predictor != nil
+}
+
+func (m *modelInstance) unuse() {
+	m.mu.Lock()
+	m.inUse--
+	m.lastUsed = time.Now()
+	if m.inUse > 0 {
+		m.mu.Unlock()
+		return
+	}
+	if m.retired {
+		m.mu.Unlock()
+		m.manager.unloadIfIdle(m)
+		return
+	}
+	defer m.mu.Unlock()
+	m.armIdleTimerLocked()
+}
+
+// starts the timer that unloads the model if it's not used for the idle timeout.
+// The caller must hold m.mu.
+func (m *modelInstance) armIdleTimerLocked() {
+	if m.manager.idleTimeout <= 0 {
+		return
+	}
+	if m.idleTimer == nil {
+		m.idleTimer = time.AfterFunc(m.manager.idleTimeout, func() {
+			m.manager.unloadIfIdle(m)
+		})
+	} else {
+		m.idleTimer.Reset(m.manager.idleTimeout)
+	}
+}
+
+type modelLoadError struct {
+	err error
+}
+
+func (e modelLoadError) Error() string {
+	return e.err.Error()
+}
+
+func (e modelLoadError) Unwrap() error {
+	return e.err
+}
+
+var errMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+type modelEvent struct {
+	Time  time.Time `json:"time"`
+	Model string    `json:"model"`
+	Event string    `json:"event"`
+	Error string    `json:"error,omitempty"`
+}
+
+// maximum number of events kept for the status endpoint
+const maxModelEvents = 100
+
+// ModelManager holds the models the server serves,
+// and loads and unloads them, so that the memory they use doesn't exceed the memory budget.
+type ModelManager struct {
+	models atomic.Pointer[Models]
+	// maximum memory the loaded models can use (0 = no limit)
+	memoryBudget int64
+	// models that are not used for this duration are unloaded (0 = never)
+	idleTimeout time.Duration
+	// creates the predictor of a model. It can be replaced in tests, so models can be loaded without model files.
+	newPredictor func(m *modelInstance) (predictor.Predictor, error)
+
+	// guarded by mu
+	mu        sync.Mutex
+	instances []*modelInstance
+	// models that were replaced by SetModels but are still loaded, because requests use them.
+	// They are unloaded when the last request that uses them finishes.
+	draining    []*modelInstance
+	memoryInUse int64
+
+	eventsMu sync.Mutex
+	events   []modelEvent
+}
+
+func NewModelManager(memoryBudget int64, idleTimeout time.Duration) *ModelManager {
+	mm := &ModelManager{
+		memoryBudget: memoryBudget,
+		idleTimeout:  idleTimeout,
+		newPredictor: func(m *modelInstance) (predictor.Predictor, error) {
+			return predictor.New(m.config.Path, modelOptions(m.config.ModelConfig), m.predictOptions)
+		},
+	}
+	mm.models.Store(&Models{})
+	return mm
+}
+
+// returns the models the server serves.
+func (mm *ModelManager) Models() Models {
+	return *mm.models.Load()
+}
+
+// replaces the models the server serves.
+// Models that use the same model file with the same settings as before keep the loaded model,
+// and the rest of the old models are unloaded after the requests that use them finish.
+// models must have been created with newModel() and this manager.
+func (mm *ModelManager) SetModels(models Models) {
+	mm.mu.Lock()
+	oldModels := mm.Models()
+	var instances []*modelInstance
+	for _, model := range models {
+		for _, oldModel := range oldModels {
+			if oldModel.name == model.name && oldModel.config.sameModel(model.config) {
+				// reuse the loaded model
+				model.modelInstance = oldModel.modelInstance
+				break
+			}
+		}
+		instances = append(instances, model.modelInstance)
+	}
+	var retired []*modelInstance
+	for _, instance := range mm.instances {
+		if slices.Contains(instances, instance) {
+			continue
+		}
+		retired = append(retired, instance)
+		instance.mu.Lock()
+		instance.retired = true
+		if instance.idleTimer != nil {
+			instance.idleTimer.Stop()
+		}
+		if instance.predictor != nil {
+			// it's still counted in the memory in use, and it can be evicted or freed, until it's unloaded
+			mm.draining = append(mm.draining, instance)
+		}
+		instance.mu.Unlock()
+	}
+	mm.instances = instances
+	mm.models.Store(&models)
+	mm.mu.Unlock()
+
+	for _, instance := range retired {
+		mm.logEvent(instance.name, "replaced", nil)
+		// if it's not in use, it's unloaded now, otherwise when the last request that uses it finishes
+		mm.unloadIfIdle(instance)
+	}
+}
+
+func (mm *ModelManager) logEvent(model string, event string, err error) {
+	e := modelEvent{Time: time.Now(), Model: model, Event: event}
+	if err != nil {
+		e.Error = err.Error()
+		log.Printf("model '%s': %s failed: %s\n", model, event, err)
+	} else {
+		log.Printf("model '%s': %s\n", model, event)
+	}
+	mm.eventsMu.Lock()
+	defer mm.eventsMu.Unlock()
+	mm.events = append(mm.events, e)
+	if len(mm.events) > maxModelEvents {
+		mm.events = mm.events[len(mm.events)-maxModelEvents:]
+	}
+}
+
+// loads the model, evicting the least recently used models if the memory budget would be exceeded.
+// The caller must hold mm.mu and m.mu.
+func (mm *ModelManager) loadLocked(m *modelInstance) error {
+	// the size of the file is an estimation of the memory the model needs
+	fileInfo, err := os.Stat(m.config.Path)
+	if err != nil {
+		mm.logEvent(m.name, "load", err)
+		return err
+	}
+	memory := fileInfo.Size()
+	if mm.memoryBudget > 0 {
+		if memory > mm.memoryBudget {
+			err := fmt.Errorf("%w: the model needs %d bytes, the budget is %d bytes", errMemoryBudgetExceeded, memory, mm.memoryBudget)
+			mm.logEvent(m.name, "load", err)
+			return err
+		}
+		for mm.memoryInUse+memory > mm.memoryBudget {
+			if !mm.evictLocked(m) {
+				err := fmt.Errorf("%w: the other loaded models are in use", errMemoryBudgetExceeded)
+				mm.logEvent(m.name, "load", err)
+				return err
+			}
+		}
+	}
+	mm.logEvent(m.name, "loading", nil)
+	start := time.Now()
+	p, err := mm.newPredictor(m)
+	if err != nil {
+		err = fmt.Errorf("predictor.New() failed: %s", err)
+		mm.logEvent(m.name, "load", err)
+		return err
+	}
+	m.predictor = &p
+	m.memory = memory
+	m.loadedAt = time.Now()
+	m.loadDuration = m.loadedAt.Sub(start)
+	metricModelLoad.Observe(m.loadDuration.Seconds(), m.name)
+	mm.memoryInUse += memory
+	mm.logEvent(m.name, fmt.Sprintf("loaded in %s", m.loadDuration.Round(time.Millisecond)), nil)
+	if m.retired {
+		// a request that got the model before it was replaced loaded it
+		mm.draining = append(mm.draining, m)
+	}
+	if m.inUse == 0 {
+		// the model is loaded before it's used (e.g. at startup), so it's unloaded if it's never used
+		m.armIdleTimerLocked()
+	}
+	return nil
+}
+
+// unloads the least recently used model that is loaded and not in use, except for the model exclude.
+// Returns false if there is no such model.
+// The caller must hold mm.mu.
+func (mm *ModelManager) evictLocked(exclude *modelInstance) bool {
+	var lru *modelInstance
+	var lruLastUsed time.Time
+	for _, instance := range mm.allInstancesLocked() {
+		if instance == exclude {
+			continue
+		}
+		instance.mu.Lock()
+		if instance.predictor != nil && instance.inUse == 0 && (lru == nil || instance.lastUsed.Before(lruLastUsed)) {
+			lru = instance
+			lruLastUsed = instance.lastUsed
+		}
+		instance.mu.Unlock()
+	}
+	if lru == nil {
+		return false
+	}
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	if lru.inUse > 0 {
+		// it started being used after it was selected
+		return mm.evictLocked(exclude)
+	}
+	mm.unloadLocked(lru, "unloaded to free memory")
+	return true
+}
+
+// The caller must hold mm.mu and m.mu.
+func (mm *ModelManager) unloadLocked(m *modelInstance, reason string) {
+	m.predictor.Free()
+	m.predictor = nil
+	mm.memoryInUse -= m.memory
+	m.memory = 0
+	mm.draining = slices.DeleteFunc(mm.draining, func(instance *modelInstance) bool { return instance == m })
+	mm.logEvent(m.name, reason, nil)
+}
+
+// returns the models the server serves and the replaced models that are still loaded.
+// The caller must hold mm.mu.
+func (mm *ModelManager) allInstancesLocked() []*modelInstance {
+	return append(slices.Clip(mm.instances), mm.draining...)
+}
+
+func (mm *ModelManager) unloadIfIdle(m *modelInstance) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.predictor == nil || m.inUse > 0 {
+		return
+	}
+	if m.retired {
+		mm.unloadLocked(m, "unloaded because it was replaced")
+		return
+	}
+	if time.Since(m.lastUsed) < mm.idleTimeout {
+		return
+	}
+	mm.unloadLocked(m, "unloaded because it was idle")
+}
+
+// loads the model, if it's not loaded.
+func (mm *ModelManager) Load(m *Model) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.predictor != nil {
+		return nil
+	}
+	m.lastUsed = time.Now()
+	return mm.loadLocked(m.modelInstance)
+}
+
+// unloads all models. Models must not be used after this call.
+func (mm *ModelManager) Free() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	for _, m := range mm.allInstancesLocked() {
+		m.mu.Lock()
+		if m.idleTimer != nil {
+			m.idleTimer.Stop()
+		}
+		if m.predictor != nil {
+			mm.unloadLocked(m, "unloaded")
+		}
+		m.mu.Unlock()
+	}
+}
+
+type modelStatus struct {
+	Name         string     `json:"name"`
+	Loaded       bool       `json:"loaded"`
+	InUse        bool       `json:"inUse"`
+	Memory       int64      `json:"memory"`
+	LoadedAt     *time.Time `json:"loadedAt,omitempty"`
+	LoadDuration string     `json:"loadDuration,omitempty"`
+	LastUsed     *time.Time `json:"lastUsed,omitempty"`
+	QueueLength  int        `json:"queueLength"`
+}
+
+type managerStatus struct {
+	MemoryBudget int64         `json:"memoryBudget"`
+	MemoryInUse  int64         `json:"memoryInUse"`
+	IdleTimeout  string        `json:"idleTimeout"`
+	Models       []modelStatus `json:"models"`
+	Events       []modelEvent  `json:"events"`
+}
+
+func (mm *ModelManager) status() managerStatus {
+	mm.mu.Lock()
+	status := managerStatus{
+		MemoryBudget: mm.memoryBudget,
+		MemoryInUse:  mm.memoryInUse,
+		IdleTimeout:  mm.idleTimeout.String(),
+	}
+	mm.mu.Unlock()
+	for _, m := range mm.Models() {
+		m.mu.Lock()
+		ms := modelStatus{
+			Name:        m.Name,
+			Loaded:      m.predictor != nil,
+			InUse:       m.inUse > 0,
+			Memory:      m.memory,
+			QueueLength: m.Queue.Len(),
+		}
+		if m.predictor != nil {
+			loadedAt := m.loadedAt
+			ms.LoadedAt = &loadedAt
+			ms.LoadDuration = m.loadDuration.String()
+		}
+		if !m.lastUsed.IsZero() {
+			lastUsed := m.lastUsed
+			ms.LastUsed = &lastUsed
+		}
+		m.mu.Unlock()
+		status.Models = append(status.Models, ms)
+	}
+	mm.eventsMu.Lock()
+	status.Events = append([]modelEvent{}, mm.events...)
+	mm.eventsMu.Unlock()
+	return status
+}
+
+// StatusHandler implements the /status endpoint, that shows which models are loaded.
+type StatusHandler struct {
+	Manager *ModelManager
+}
+
+func (h StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "only GET method supported")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Manager.status())
+}
+
+// NamedModelConfig is the configuration of one of the models the server serves.
+type NamedModelConfig struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	ModelConfig
+	SystemPrompt         string `json:"systemPrompt"`
+	SystemPromptFilePath string `json:"systemPromptFile"`
+	// strings that stop prediction
+	Stop []string `json:"stop,omitempty"`
+	// limits of the sampling parameters that requests can set
+	SamplingLimits SamplingLimits `json:"samplingLimits,omitempty"`
+	// sampling presets requests can select
+	SamplingPresets SamplingPresets `json:"presets,omitempty"`
+}
+
+// returns true if both configurations load the same model file with the same settings,
+// so a loaded model can be reused.
+func (c NamedModelConfig) sameModel(other NamedModelConfig) bool {
+	return c.Path == other.Path &&
+		c.GpuLayers == other.GpuLayers &&
+		c.ContextSize == other.ContextSize &&
+		c.RopeFreqBase == other.RopeFreqBase &&
+		c.RopeFreqScale == other.RopeFreqScale
+}
+
+// FileConfig is the content of the file set with the flag -config-file.
+type FileConfig struct {
+	Models []NamedModelConfig `json:"models"`
+	// limits of the sampling parameters for all models. Models can override them.
+	SamplingLimits SamplingLimits `json:"samplingLimits"`
+	// sampling presets of all models. Models can add their own presets or override them.
+	SamplingPresets SamplingPresets `json:"presets"`
+}
+
+// reads the config file.
+// Settings of the models that are not set in the config file take their values from defaults.
+func readFileConfig(filePath string, defaults NamedModelConfig) (FileConfig, error) {
+	configFileBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return FileConfig{}, fmt.Errorf("failed to read config file: %s", err)
+	}
+	var raw struct {
+		Models          []json.RawMessage `json:"models"`
+		SamplingLimits  SamplingLimits    `json:"samplingLimits"`
+		SamplingPresets SamplingPresets   `json:"presets"`
+	}
+	err = json.Unmarshal(configFileBytes, &raw)
+	if err != nil {
+		return FileConfig{}, fmt.Errorf("failed to parse config file: %s", err)
+	}
+	fileConfig := FileConfig{SamplingLimits: raw.SamplingLimits, SamplingPresets: raw.SamplingPresets}
+	defaults.SamplingLimits = raw.SamplingLimits
+	defaults.SamplingPresets = raw.SamplingPresets
+	for i, modelJSON := range raw.Models {
+		modelConfig := defaults
+		// the limits of the model are added to a copy of the limits of the top level
+		modelConfig.SamplingLimits = maps.Clone(defaults.SamplingLimits)
+		modelConfig.SamplingPresets = maps.Clone(defaults.SamplingPresets)
+		err = json.Unmarshal(modelJSON, &modelConfig)
+		if err != nil {
+			return FileConfig{}, fmt.Errorf("failed to parse models[%d] of config file: %s", i, err)
+		}
+		fileConfig.Models = append(fileConfig.Models, modelConfig)
+	}
+	return fileConfig, nil
+}
+
+// parses a command line argument of the form "name=path" or "path".
+// If the name is omitted, it is the file name of the model without the extension.
+func parseModelArg(arg string) (name string, path string) {
+	name, path, found := strings.Cut(arg, "=")
+	if !found {
+		path = arg
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return name, path
+}
+
+// returns the system prompt set either directly or from a file.
+func readSystemPrompt(systemPrompt string, systemPromptFilePath string) (string, error) {
+	if systemPrompt != "" && systemPromptFilePath != "" {
+		return "", errors.New("cannot set both system prompt and system prompt file")
+	}
+	if systemPromptFilePath != "" {
+		systemPromptBytes, err := os.ReadFile(systemPromptFilePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read system prompt from file: %s", err)
+		}
+		return strings.TrimSpace(string(systemPromptBytes)), nil
+	}
+	return systemPrompt, nil
+}
+
+// reads the GBNF grammars of the directory. Every file with extension .gbnf is a grammar,
+// named after the file without the extension. Invalid grammars are an error.
+func readGrammars(dir string) (map[string]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.gbnf"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list grammars: %s", err)
+	}
+	grammars := make(map[string]string, len(paths))
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read grammar: %s", err)
+		}
+		_, err = grammar.Parse(string(src))
+		if err != nil {
+			return nil, fmt.Errorf("invalid grammar %s: %s", path, err)
+		}
+		grammars[strings.TrimSuffix(filepath.Base(path), ".gbnf")] = string(src)
+	}
+	return grammars, nil
+}
+
+// returns the option that constrains the prediction to the grammar of the request, which is one of:
+// the GBNF grammar of the parameter grammar, the name of one of the grammars of the model,
+// or the JSON Schema of the parameter jsonSchema, which is also returned so the response can be validated.
+// Returns a nil option if the request doesn't set a grammar.
+func (m *Model) grammarOption(form url.Values) (llama.PredictOption, *jsonschema.Schema, error) {
+	src, name, schemaText := form.Get("grammar"), form.Get("grammarName"), form.Get("jsonSchema")
+	set := 0
+	for _, value := range []string{src, name, schemaText} {
+		if value != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, nil, errors.New("only one of grammar, grammarName and jsonSchema can be set")
+	}
+	var schema *jsonschema.Schema
+	switch {
+	case name != "":
+		var ok bool
+		src, ok = m.Grammars[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown grammar '%s'", name)
+		}
+	case schemaText != "":
+		var err error
+		schema, err = jsonschema.Parse([]byte(schemaText))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid jsonSchema: %s", err)
+		}
+		src = schema.Grammar()
+	case src == "":
+		return nil, nil, nil
+	}
+	opt, err := predictor.WithGrammar(src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid grammar: %s", err)
+	}
+	return opt, schema, nil
+}
+
+// returns the prompt template set by one of the prompt template settings.
+// If none is set, the returned template is zero.
+func newPromptTemplate(config ModelConfig) (conversation.PromptTemplate, error) {
+	// make sure only one of the -prompt-template* flags is set
+	if config.PromptTemplate != "" && config.PromptTemplateType != "" {
+		return conversation.PromptTemplate{}, errors.New("conflicting flags: -prompt-template -prompt-template-type")
+	}
+	if config.PromptTemplate != "" && config.PromptTemplateFilePath != "" {
+		return conversation.PromptTemplate{}, errors.New("conflicting flags: -prompt-template -prompt-template-file")
+	}
+	if config.PromptTemplateType != "" && config.PromptTemplateFilePath != "" {
+		return conversation.PromptTemplate{}, errors.New("conflicting flags: -prompt-template-type -prompt-template-file")
+	}
+	syntax := config.PromptTemplateSyntax
+	switch syntax {
+	case "":
+		syntax = promptTemplateSyntaxGo
+		if ext := filepath.Ext(config.PromptTemplateFilePath); ext == ".jinja" || ext == ".j2" {
+			syntax = promptTemplateSyntaxJinja
+		}
+	case promptTemplateSyntaxGo, promptTemplateSyntaxJinja:
+	default:
+		return conversation.PromptTemplate{}, fmt.Errorf("invalid value of prompt_template_syntax: '%s'. valid values: %s, %s", syntax, promptTemplateSyntaxGo, promptTemplateSyntaxJinja)
+	}
+	if config.PromptTemplate != "" {
+		promptTemplate, err := parsePromptTemplate(config.PromptTemplate, syntax)
+		if err != nil {
+			return conversation.PromptTemplate{}, fmt.Errorf("failed to create prompt template: %s", err)
+		}
+		return promptTemplate, nil
+	}
+	if config.PromptTemplateType != "" {
+		promptTemplate, ok := conversation.LookupPromptTemplate(config.PromptTemplateType)
+		if !ok {
+			return conversation.PromptTemplate{}, fmt.Errorf("invalid value of prompt_template_type: '%s'. valid values: %s", config.PromptTemplateType, strings.Join(conversation.PromptTemplateNames(), ", "))
+		}
+		return promptTemplate, nil
+	}
+	if config.PromptTemplateFilePath != "" {
+		promptTemplateFileBytes, err := os.ReadFile(config.PromptTemplateFilePath)
+		if err != nil {
+			return conversation.PromptTemplate{}, fmt.Errorf("failed to read prompt template file '%s': %s", config.PromptTemplateFilePath, err)
+		}
+		// the template is created like the templates of the other settings, so it can use the tool templates
+		promptTemplate, err := parsePromptTemplate(string(promptTemplateFileBytes), syntax)
+		if err != nil {
+			return conversation.PromptTemplate{}, fmt.Errorf("failed to parse prompt template file: %s", err)
+		}
+		return promptTemplate, nil
+	}
+	return conversation.PromptTemplate{}, nil
+}
+
+// syntaxes of prompt templates
+const (
+	promptTemplateSyntaxGo    = "go"
+	promptTemplateSyntaxJinja = "jinja"
+)
+
+// parses a prompt template of the given syntax.
+func parsePromptTemplate(src string, syntax string) (conversation.PromptTemplate, error) {
+	if syntax == promptTemplateSyntaxJinja {
+		return conversation.NewJinjaPromptTemplate(src)
+	}
+	return conversation.NewPromptTemplate(src)
+}
+
+// returns the built-in prompt template that matches the chat template or the architecture in the metadata of the model file.
+// If no built-in prompt template matches, the chat template of the model file is used as a Jinja prompt template.
+// If the metadata can't be read or there is no usable template, the returned template is zero.
+func detectPromptTemplate(config NamedModelConfig, systemPrompt string) conversation.PromptTemplate {
+	metadata, err := gguf.ReadFile(config.Path)
+	if err != nil {
+		log.Printf("model '%s': failed to read the metadata of the model file to detect the prompt template: %s\n", config.Name, err)
+		return conversation.PromptTemplate{}
+	}
+	name, ok := conversation.DetectPromptTemplate(metadata.ChatTemplate(), metadata.Architecture())
+	if !ok && metadata.ChatTemplate() != "" {
+		// the chat template of the model file is used as it is
+		promptTemplate, err := conversation.NewJinjaPromptTemplate(metadata.ChatTemplate())
+		if err != nil {
+			log.Printf("model '%s': no built-in prompt template matches the metadata of the model file, and its chat template is not supported: %s\n", config.Name, err)
+			return conversation.PromptTemplate{}
+		}
+		promptTemplate.BOSToken, promptTemplate.EOSToken = metadata.BOSToken(), metadata.EOSToken()
+		log.Printf("model '%s': using the Jinja chat template of the model file as the prompt template\n", config.Name)
+		return promptTemplate
+	}
+	if !ok {
+		log.Printf("model '%s': no built-in prompt template matches the metadata of the model file (architecture '%s')\n", config.Name, metadata.Architecture())
+		return conversation.PromptTemplate{}
+	}
+	promptTemplate, _ := conversation.LookupPromptTemplate(name)
+	if systemPrompt == "" && promptTemplate.RequiresSystemPrompt {
+		log.Printf("model '%s': the prompt template '%s' matches the metadata of the model file, but it's not used because it requires a system prompt\n", config.Name, name)
+		return conversation.PromptTemplate{}
+	}
+	log.Printf("model '%s': using the prompt template '%s' that matches the metadata of the model file\n", config.Name, name)
+	return promptTemplate
+}
+
+// TemplatesHandler lists the built-in prompt templates, with the prompt each one generates for an example conversation.
+type TemplatesHandler struct{}
+
+func (h TemplatesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "only GET method supported")
+		return
+	}
+	conv := conversation.NewConversation("You are a helpful assistant.")
+	conv.AddMessageUser("Hello!")
+	conv.AddMessageAssistant("Hello! How can I help you?")
+	conv.AddMessageUser("Who are you?")
+	type promptTemplate struct {
+		Name    string   `json:"name"`
+		Example string   `json:"example"`
+		Stop    []string `json:"stop"`
+	}
+	templates := []promptTemplate{}
+	for _, name := range conversation.PromptTemplateNames() {
+		t, _ := conversation.LookupPromptTemplate(name)
+		example, err := conv.GeneratePrompt(t)
+		if err != nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "conv.GeneratePrompt() failed: %s", err)
+			return
+		}
+		templates = append(templates, promptTemplate{Name: name, Example: example, Stop: t.StopSequences()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Templates []promptTemplate `json:"templates"`
+	}{templates})
+}
+
+func modelOptions(config ModelConfig) []llama.ModelOption {
+	modelOptions := []llama.ModelOption{
+		llama.SetContext(config.ContextSize),
+		llama.SetGPULayers(config.GpuLayers),
+	}
+	if config.RopeFreqBase != 0 {
+		modelOptions = append(modelOptions, llama.WithRopeFreqBase(float32(config.RopeFreqBase)))
+	}
+	if config.RopeFreqScale != 0 {
+		modelOptions = append(modelOptions, llama.WithRopeFreqScale(float32(config.RopeFreqScale)))
+	}
+	return modelOptions
+}
+
+func predictOptions(config PredictConfig) []llama.PredictOption {
+	return []llama.PredictOption{
+		llama.SetTokens(config.Tokens),
+		llama.SetThreads(config.Threads),
+		llama.SetNKeep(config.NKeep),
+		llama.SetTopK(config.TopK),
+		llama.SetTopP(float32(config.TopP)),
+		llama.SetTemperature(float32(config.Temperature)),
+		llama.SetTailFreeSamplingZ(float32(config.TailFreeSamplingZ)),
+		llama.SetPenalty(float32(config.RepetitionPenalty)),
+		llama.SetFrequencyPenalty(float32(config.FrequencyPenalty)),
+		llama.SetPresencePenalty(float32(config.PresencePenalty)),
+		llama.SetMirostat(config.Mirostat),
+		llama.SetMirostatTAU(float32(config.MirostatTau)),
+		llama.SetMirostatETA(float32(config.MirostatEta)),
+		llama.SetPenalizeNL(false),
+		llama.SetSeed(config.Seed),
+	}
+}
+
+// prepares the prompt template and the system prompt of the model.
+// The model is loaded later by the manager.
+func newModel(config NamedModelConfig, predictConfig PredictConfig, stopRegex *regexp.Regexp, grammars map[string]string, requestQueue *RequestQueue, manager *ModelManager) (*Model, error) {
+	systemPrompt, err := readSystemPrompt(config.SystemPrompt, config.SystemPromptFilePath)
+	if err != nil {
+		return nil, err
+	}
+	promptTemplate, err := newPromptTemplate(config.ModelConfig)
+	if err != nil {
+		return nil, err
+	}
+	if promptTemplate.IsZero() {
+		// the prompt template settings take priority over the metadata of the model file
+		promptTemplate = detectPromptTemplate(config, systemPrompt)
+	} else if promptTemplate.IsJinja() {
+		// the variables bos_token and eos_token of Jinja templates are the tokens of the model,
+		// unless the front matter of the template sets them
+		if promptTemplate.BOSToken == "" || promptTemplate.EOSToken == "" {
+			metadata, err := gguf.ReadFile(config.Path)
+			if err != nil {
+				log.Printf("model '%s': failed to read the metadata of the model file, so bos_token and eos_token of the prompt template are empty: %s\n", config.Name, err)
+			}
+			if promptTemplate.BOSToken == "" {
+				promptTemplate.BOSToken = metadata.BOSToken()
+			}
+			if promptTemplate.EOSToken == "" {
+				promptTemplate.EOSToken = metadata.EOSToken()
+			}
+		}
+	}
+	// fail if system prompt is not set and it is required
+	if systemPrompt == "" && promptTemplate.RequiresSystemPrompt {
+		return nil, errors.New("system prompt not set but the prompt template requires one")
+	}
+	return &Model{
+		Name:            config.Name,
+		PromptTemplate:  promptTemplate,
+		SystemPrompt:    systemPrompt,
+		StopRegex:       stopRegex,
+		Stop:            config.Stop,
+		SamplingLimits:  config.SamplingLimits,
+		SamplingPresets: config.SamplingPresets,
+		Seed:            predictConfig.Seed,
+		Grammars:        grammars,
+		AddsBOS:         promptTemplate.BOSToken != "" && tokenizerAddsBOS(config),
+		modelInstance: &modelInstance{
+			name:           config.Name,
+			config:         config,
+			predictOptions: predictOptions(predictConfig),
+			manager:        manager,
+			Queue:          requestQueue,
+		},
+	}, nil
+}
+
+// returns true if the tokenizer of the model adds the beginning-of-sequence token to the prompt.
+// If the metadata of the model file can't be read, it's assumed that it does, as llama.cpp does for most models.
+func tokenizerAddsBOS(config NamedModelConfig) bool {
+	metadata, err := gguf.ReadFile(config.Path)
+	if err != nil {
+		log.Printf("model '%s': failed to read the metadata of the model file, so the tokenizer is assumed to add the beginning-of-sequence token: %s\n", config.Name, err)
+		return true
+	}
+	return metadata.AddsBOS()
+}
+
+// stringList is a flag.Value for flags that can be set multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parses sizes like "512MiB", "8GB" or "1073741824" to number of bytes.
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"B", 1},
+	}
+	s = strings.TrimSpace(s)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: '%s'", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// byteSize is a flag.Value of a size in bytes, that can be set with units (e.g. "8GiB").
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+// returns the requested model.
+// If it doesn't exist, it writes an error with HTTP 404 and returns nil.
+func getModelOrFail(w http.ResponseWriter, manager *ModelManager, name string) *Model {
+	model, err := manager.Models().Get(name)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return nil
+	}
+	return model
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cmitsakis/llm-api/internal/llm/predictor"
+	"cmitsakis/llm-api/internal/queue"
+)
+
+// returns a manager that loads models without model files.
+func newTestModelManager(memoryBudget int64, idleTimeout time.Duration) *ModelManager {
+	mm := NewModelManager(memoryBudget, idleTimeout)
+	mm.newPredictor = func(m *modelInstance) (predictor.Predictor, error) {
+		return predictor.Predictor{}, nil
+	}
+	return mm
+}
+
+// returns a model whose file has the given size, which is the memory the model needs.
+func newTestModel(t *testing.T, mm *ModelManager, name string, size int64) *Model {
+	path := filepath.Join(t.TempDir(), name+".gguf")
+	err := os.WriteFile(path, make([]byte, size), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NamedModelConfig{Name: name, Path: path}
+	return &Model{
+		Name: name,
+		modelInstance: &modelInstance{
+			name:    name,
+			config:  config,
+			manager: mm,
+			Queue:   &RequestQueue{Queue: queue.New(1, 0)},
+		},
+	}
+}
+
+// waits until the model is loaded or unloaded.
+func waitLoaded(m *Model, loaded bool) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if m.loaded() == loaded {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIdleUnloadOfUnusedModel(t *testing.T) {
+	mm := newTestModelManager(0, 20*time.Millisecond)
+	model := newTestModel(t, mm, "a", 10)
+	mm.SetModels(Models{model})
+	// the model is loaded at startup, and never used
+	err := mm.Load(model)
+	if err != nil {
+		fmt.Printf("Load() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	if !waitLoaded(model, false) {
+		fmt.Printf("the model that was never used is not unloaded after the idle timeout\n")
+		t.Fail()
+	}
+	if mm.status().MemoryInUse != 0 {
+		fmt.Printf("memory in use = %d, expected 0\n", mm.status().MemoryInUse)
+		t.Fail()
+	}
+}
+
+func TestReloadWhileModelIsUsed(t *testing.T) {
+	mm := newTestModelManager(20, 0)
+	oldModel := newTestModel(t, mm, "a", 10)
+	mm.SetModels(Models{oldModel})
+	// a request is using the model when the models are reloaded
+	_, err := oldModel.use()
+	if err != nil {
+		fmt.Printf("use() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	newModel := newTestModel(t, mm, "a", 10)
+	mm.SetModels(Models{newModel})
+	if !oldModel.loaded() {
+		fmt.Printf("the replaced model is unloaded while it's used\n")
+		t.Fail()
+	}
+	if mm.status().MemoryInUse != 10 {
+		fmt.Printf("memory in use = %d, expected 10\n", mm.status().MemoryInUse)
+		t.Fail()
+	}
+	err = mm.Load(newModel)
+	if err != nil {
+		fmt.Printf("Load() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	// the budget is exceeded, and the replaced model can't be evicted because it's used
+	otherModel := newTestModel(t, mm, "b", 10)
+	mm.SetModels(Models{newModel, otherModel})
+	err = mm.Load(otherModel)
+	if err != nil {
+		fmt.Printf("Load() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	if !oldModel.loaded() || newModel.loaded() {
+		fmt.Printf("the model that is not used should be evicted instead of the replaced model that is used\n")
+		t.Fail()
+	}
+	oldModel.unuse()
+	if oldModel.loaded() {
+		fmt.Printf("the replaced model is not unloaded after the request that used it finished\n")
+		t.Fail()
+	}
+	if mm.status().MemoryInUse != 10 {
+		fmt.Printf("memory in use = %d, expected 10\n", mm.status().MemoryInUse)
+		t.Fail()
+	}
+}
+
+func TestFreeReplacedModel(t *testing.T) {
+	mm := newTestModelManager(0, 0)
+	oldModel := newTestModel(t, mm, "a", 10)
+	mm.SetModels(Models{oldModel})
+	_, err := oldModel.use()
+	if err != nil {
+		fmt.Printf("use() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	mm.SetModels(Models{newTestModel(t, mm, "a", 10)})
+	mm.Free()
+	if oldModel.loaded() {
+		fmt.Printf("Free() didn't unload the replaced model\n")
+		t.Fail()
+	}
+	if mm.status().MemoryInUse != 0 {
+		fmt.Printf("memory in use = %d, expected 0\n", mm.status().MemoryInUse)
+		t.Fail()
+	}
+}
+
+func TestModelSelection(t *testing.T) {
+	mm := NewModelManager(0, 0)
+	// every model replies with its name
+	mm.newPredictor = func(m *modelInstance) (predictor.Predictor, error) {
+		return predictor.NewFromLLM(fakeLLM{tokens: []string{"model " + m.name}}, nil), nil
+	}
+	mm.SetModels(Models{newTestModel(t, mm, "a", 10), newTestModel(t, mm, "b", 10)})
+	for _, test := range []struct {
+		model      string
+		statusCode int
+		body       string
+	}{
+		// the first model is the default
+		{"", http.StatusOK, "model a"},
+		{"a", http.StatusOK, "model a"},
+		{"b", http.StatusOK, "model b"},
+		{"c", http.StatusNotFound, "model not found: 'c'"},
+	} {
+		form := url.Values{"model": {test.model}, "prompt": {"hello"}}
+		r := httptest.NewRequest("POST", "/predict", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		PredictHandler{Manager: mm}.ServeHTTP(w, r)
+		if w.Code != test.statusCode || w.Body.String() != test.body {
+			fmt.Printf("model %q: response = %d %q, expected %d %q\n", test.model, w.Code, w.Body.String(), test.statusCode, test.body)
+			t.Fail()
+		}
+	}
+
+	w := httptest.NewRecorder()
+	ModelsHandler{Manager: mm}.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models", nil))
+	var list struct {
+		Data []openAIModel `json:"data"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &list)
+	if err != nil {
+		fmt.Printf("failed to parse the list of models: %s\n", err)
+		t.FailNow()
+	}
+	var names []string
+	for _, model := range list.Data {
+		names = append(names, model.ID)
+	}
+	if fmt.Sprint(names) != "[a b]" {
+		fmt.Printf("/v1/models lists the models %v, expected [a b]\n", names)
+		t.Fail()
+	}
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+
+	"cmitsakis/llm-api/internal/llm/conversation"
+)
+
+// This file implements a subset of the OpenAI API,
+// so that clients of the OpenAI API can use llm-api by changing only the base URL.
+
+type openAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+func writeOpenAIError(w http.ResponseWriter, statusCode int, message string) {
+	errorType := "invalid_request_error"
+	if statusCode >= 500 {
+		errorType = "server_error"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(struct {
+		Error openAIError `json:"error"`
+	}{
+		Error: openAIError{Message: message, Type: errorType},
+	})
+}
+
+// returns a function that writes an error in the format of the OpenAI API. It can be passed to Model.handleError().
+func openAIErrorWriter(w http.ResponseWriter) func(statusCode int, message string) {
+	return func(statusCode int, message string) {
+		writeOpenAIError(w, statusCode, message)
+	}
+}
+
+// returns the requested model.
+// If it doesn't exist, it writes an error with HTTP 404 and returns nil.
+func getOpenAIModelOrFail(w http.ResponseWriter, manager *ModelManager, name string) *Model {
+	model, err := manager.Models().Get(name)
+	if err != nil {
+		writeOpenAIError(w, http.StatusNotFound, err.Error())
+		return nil
+	}
+	return model
+}
+
+// the "stop" field can be either a string or an array of strings.
+type openAIStop []string
+
+func (s *openAIStop) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*s = openAIStop{str}
+		return nil
+	}
+	var strs []string
+	if err := json.Unmarshal(data, &strs); err != nil {
+		return errors.New("stop must be a string or an array of strings")
+	}
+	*s = strs
+	return nil
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func newOpenAIUsage(promptTokens int, completionTokens int) openAIUsage {
+	return openAIUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+// returns the sampling parameters that correspond to the sampling fields of OpenAI requests.
+// The limits of the sampling parameters set by the operator are applied, and the seed is always set.
+func openAISamplingParams(model *Model, temperature *float64, topP *float64, maxTokens *int, seed *int) (SamplingParams, error) {
+	if temperature != nil && (*temperature < 0 || *temperature > 2) {
+		return SamplingParams{}, fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if topP != nil && (*topP < 0 || *topP > 1) {
+		return SamplingParams{}, fmt.Errorf("top_p must be between 0 and 1")
+	}
+	if maxTokens != nil && *maxTokens < 0 {
+		return SamplingParams{}, fmt.Errorf("max_tokens must not be negative")
+	}
+	if seed != nil && (*seed < -1 || *seed > math.MaxInt32) {
+		return SamplingParams{}, fmt.Errorf("seed must be between -1 and %d", math.MaxInt32)
+	}
+	samplingParams := SamplingParams{
+		Temperature: temperature,
+		TopP:        topP,
+		Tokens:      maxTokens,
+		Seed:        seed,
+	}
+	err := samplingParams.applyLimits(model.SamplingLimits)
+	if err != nil {
+		return SamplingParams{}, err
+	}
+	samplingParams.resolveSeed(model.Seed)
+	return samplingParams, nil
+}
+
+// maps the reasons a prediction finished to the values of the "finish_reason" field.
+func openAIFinishReason(finishReason string) *string {
+	switch finishReason {
+	case finishReasonLength:
+		finishReason = "length"
+	default:
+		finishReason = "stop"
+	}
+	return &finishReason
+}
+
+func newOpenAIID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// message content can be either a string or an array of content parts.
+type openAIContent string
+
+func (c *openAIContent) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*c = openAIContent(str)
+		return nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New("content must be a string or an array of content parts")
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type != "text" {
+			return fmt.Errorf("unsupported content part type: '%s'", part.Type)
+		}
+		texts = append(texts, part.Text)
+	}
+	*c = openAIContent(strings.Join(texts, "\n"))
+	return nil
+}
+
+type openAIChatMessage struct {
+	Role       string           `json:"role"`
+	Content    openAIContent    `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIFunctionCall struct {
+	Name string `json:"name"`
+	// JSON object
+	Arguments string `json:"arguments"`
+}
+
+type openAIToolCall struct {
+	ID       string             `json:"id"`
+	Type     string             `json:"type"`
+	Function openAIFunctionCall `json:"function"`
+}
+
+type openAIToolCallDelta struct {
+	Index int `json:"index"`
+	openAIToolCall
+}
+
+func newOpenAIToolCalls(calls []conversation.ToolCall) []openAIToolCall {
+	var toolCalls []openAIToolCall
+	for _, call := range calls {
+		toolCalls = append(toolCalls, openAIToolCall{
+			ID:       call.ID,
+			Type:     "function",
+			Function: openAIFunctionCall{Name: call.Name, Arguments: call.Arguments},
+		})
+	}
+	return toolCalls
+}
+
+// returns whether the tools are rendered in the prompt, according to the "tool_choice" field.
+// Only the values "auto" and "none" are supported, because the model can't be forced to call a tool.
+func openAIToolChoice(toolChoice json.RawMessage) (bool, error) {
+	if toolChoice == nil {
+		return true, nil
+	}
+	var choice string
+	if json.Unmarshal(toolChoice, &choice) == nil {
+		switch choice {
+		case "auto":
+			return true, nil
+		case "none":
+			return false, nil
+		}
+	}
+	return false, errors.New(`unsupported tool_choice: only "auto" and "none" are supported`)
+}
+
+type openAIChatCompletionRequest struct {
+	Model       string              `json:"model"`
+	Messages    []openAIChatMessage `json:"messages"`
+	Temperature *float64            `json:"temperature"`
+	TopP        *float64            `json:"top_p"`
+	MaxTokens   *int                `json:"max_tokens"`
+	Seed        *int                `json:"seed"`
+	Stop        openAIStop          `json:"stop"`
+	Stream      bool                `json:"stream"`
+	Tools       []toolDefinition    `json:"tools"`
+	ToolChoice  json.RawMessage     `json:"tool_choice"`
+}
+
+type openAIChatCompletionChoice struct {
+	Index        int               `json:"index"`
+	Message      openAIChatMessage `json:"message"`
+	FinishReason string            `json:"finish_reason"`
+}
+
+type openAIChatCompletion struct {
+	ID      string                       `json:"id"`
+	Object  string                       `json:"object"`
+	Created int64                        `json:"created"`
+	Model   string                       `json:"model"`
+	Choices []openAIChatCompletionChoice `json:"choices"`
+	Usage   openAIUsage                  `json:"usage"`
+}
+
+type openAIChatCompletionDelta struct {
+	Role      string                `json:"role,omitempty"`
+	Content   string                `json:"content,omitempty"`
+	ToolCalls []openAIToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+type openAIChatCompletionChunkChoice struct {
+	Index        int                       `json:"index"`
+	Delta        openAIChatCompletionDelta `json:"delta"`
+	FinishReason *string                   `json:"finish_reason"`
+}
+
+type openAIChatCompletionChunk struct {
+	ID      string                            `json:"id"`
+	Object  string                            `json:"object"`
+	Created int64                             `json:"created"`
+	Model   string                            `json:"model"`
+	Choices []openAIChatCompletionChunkChoice `json:"choices"`
+}
+
+// ChatCompletionsHandler implements the /v1/chat/completions endpoint of the OpenAI API.
+type ChatCompletionsHandler struct {
+	Manager *ModelManager
+}
+
+func (h ChatCompletionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "only POST method supported")
+		return
+	}
+	var req openAIChatCompletionRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxJSONBodySize)).Decode(&req)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("failed to parse request body: %s", err))
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeOpenAIError(w, http.StatusBadRequest, "messages must not be empty")
+		return
+	}
+	model := getOpenAIModelOrFail(w, h.Manager, req.Model)
+	if model == nil {
+		return
+	}
+	if model.PromptTemplate.IsZero() {
+		writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("the prompt template of model '%s' is not set", model.Name))
+		return
+	}
+	var systemPrompts []string
+	for i, message := range req.Messages {
+		switch conversation.Role(message.Role) {
+		case conversation.RoleSystem:
+			systemPrompts = append(systemPrompts, string(message.Content))
+		case conversation.RoleUser, conversation.RoleAssistant, conversation.RoleTool:
+		default:
+			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("messages[%d]: unsupported role: '%s'", i, message.Role))
+			return
+		}
+	}
+	systemPrompt := model.SystemPrompt
+	if len(systemPrompts) > 0 {
+		systemPrompt = strings.Join(systemPrompts, "\n")
+	}
+	conv := conversation.NewConversation(systemPrompt)
+	tools, err := newTools(req.Tools)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	renderTools, err := openAIToolChoice(req.ToolChoice)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if renderTools && len(tools) > 0 {
+		conv.Tools = tools
+	}
+	for i, message := range req.Messages {
+		if conversation.Role(message.Role) == conversation.RoleSystem {
+			// the system messages are the system prompt
+			continue
+		}
+		m := conversation.Message{Role: conversation.Role(message.Role), Text: string(message.Content), ToolCallID: message.ToolCallID}
+		for _, call := range message.ToolCalls {
+			m.ToolCalls = append(m.ToolCalls, conversation.ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments})
+		}
+		// the API allows consecutive messages with the same role
+		err := conv.Append(m, conversation.MergeConsecutive)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("messages[%d]: %s", i, err))
+			return
+		}
+	}
+	samplingParams, err := openAISamplingParams(model, req.Temperature, req.TopP, req.MaxTokens, req.Seed)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts := samplingParams.predictOptions()
+	// the seed is returned, so the prediction can be repeated
+	w.Header().Set("X-Seed", strconv.Itoa(*samplingParams.Seed))
+	id := newOpenAIID("chatcmpl-")
+	created := time.Now().Unix()
+	p, release, err := model.acquire(w, r, nil)
+	if err != nil {
+		model.handleError(w, err, openAIErrorWriter(w))
+		return
+	}
+	defer release()
+	prompt := predictionPrompt{chat: &chatPrompt{conv: conv}}
+	generated, err := prompt.generate(model, p, opts)
+	if err != nil {
+		prompt.handleError(err, openAIErrorWriter(w))
+		return
+	}
+	prompt.setHeader(w, generated)
+	stopLiterals := append(req.Stop[:len(req.Stop):len(req.Stop)], model.PromptTemplate.StopSequences()...)
+	if len(conv.Tools) > 0 {
+		// the model must wait for the results of the tool calls
+		stopLiterals = append(stopLiterals, toolResultStop)
+	}
+	stops := model.stopMatcher(stopLiterals)
+
+	if !req.Stream || len(conv.Tools) > 0 {
+		// the tool calls are parsed after the prediction ends, so a response with tools is sent at once, even if it's streamed
+		result, err := predict(r.Context(), model.Name, p, generated, opts, stops, func(string) bool { return true })
+		if err != nil {
+			handlePredictionError(err, openAIErrorWriter(w))
+			return
+		}
+		text, calls := result.Text, []conversation.ToolCall(nil)
+		if len(conv.Tools) > 0 {
+			text, calls = parseToolCalls(r.Context(), result.Text)
+		}
+		finishReason := openAIFinishReason(result.FinishReason)
+		if len(calls) > 0 {
+			*finishReason = "tool_calls"
+		}
+		if req.Stream {
+			ew := newSSEWriter(w)
+			chunk := openAIChatCompletionChunk{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   model.Name,
+			}
+			delta := openAIChatCompletionDelta{Role: string(conversation.RoleAssistant), Content: text}
+			for i, call := range newOpenAIToolCalls(calls) {
+				delta.ToolCalls = append(delta.ToolCalls, openAIToolCallDelta{Index: i, openAIToolCall: call})
+			}
+			chunk.Choices = []openAIChatCompletionChunkChoice{{Delta: delta}}
+			ew.writeEvent("", chunk)
+			chunk.Choices = []openAIChatCompletionChunkChoice{{FinishReason: finishReason}}
+			ew.writeEvent("", chunk)
+			ew.writeRawEvent("", []byte("[DONE]"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(openAIChatCompletion{
+			ID:      id,
+			Object:  "chat.completion",
+			Created: created,
+			Model:   model.Name,
+			Choices: []openAIChatCompletionChoice{{
+				Message: openAIChatMessage{
+					Role:      string(conversation.RoleAssistant),
+					Content:   openAIContent(text),
+					ToolCalls: newOpenAIToolCalls(calls),
+				},
+				FinishReason: *finishReason,
+			}},
+			Usage: newOpenAIUsage(result.PromptTokens, result.CompletionTokens),
+		})
+		return
+	}
+
+	// streaming
+	var ew sseWriter
+	chunk := func(delta openAIChatCompletionDelta, finishReason *string) openAIChatCompletionChunk {
+		return openAIChatCompletionChunk{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model.Name,
+			Choices: []openAIChatCompletionChunkChoice{{Delta: delta, FinishReason: finishReason}},
+		}
+	}
+	result, err := predict(r.Context(), model.Name, p, generated, opts, stops, func(token string) bool {
+		if ew.w == nil {
+			// first token
+			ew = newSSEWriter(w)
+			if ew.writeEvent("", chunk(openAIChatCompletionDelta{Role: string(conversation.RoleAssistant)}, nil)) != nil {
+				return false
+			}
+		}
+		if token == "" {
+			return true
+		}
+		return ew.writeEvent("", chunk(openAIChatCompletionDelta{Content: token}, nil)) == nil
+	})
+	if err != nil {
+		if ew.w == nil {
+			handlePredictionError(err, openAIErrorWriter(w))
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+	if ew.w == nil {
+		ew = newSSEWriter(w)
+		ew.writeEvent("", chunk(openAIChatCompletionDelta{Role: string(conversation.RoleAssistant)}, nil))
+	}
+	ew.writeEvent("", chunk(openAIChatCompletionDelta{}, openAIFinishReason(result.FinishReason)))
+	ew.writeRawEvent("", []byte("[DONE]"))
+}
+
+// the "prompt" field can be either a string or an array of strings.
+type openAIPrompt []string
+
+func (p *openAIPrompt) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*p = openAIPrompt{str}
+		return nil
+	}
+	var strs []string
+	if err := json.Unmarshal(data, &strs); err != nil {
+		return errors.New("prompt must be a string or an array of strings")
+	}
+	*p = strs
+	return nil
+}
+
+type openAICompletionRequest struct {
+	Model       string       `json:"model"`
+	Prompt      openAIPrompt `json:"prompt"`
+	MaxTokens   *int         `json:"max_tokens"`
+	Temperature *float64     `json:"temperature"`
+	TopP        *float64     `json:"top_p"`
+	Seed        *int         `json:"seed"`
+	Stop        openAIStop   `json:"stop"`
+	Echo        bool         `json:"echo"`
+	Stream      bool         `json:"stream"`
+	N           *int         `json:"n"`
+	Logprobs    *int         `json:"logprobs"`
+}
+
+type openAICompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type openAICompletion struct {
+	ID      string                   `json:"id"`
+	Object  string                   `json:"object"`
+	Created int64                    `json:"created"`
+	Model   string                   `json:"model"`
+	Choices []openAICompletionChoice `json:"choices"`
+	Usage   *openAIUsage             `json:"usage,omitempty"`
+}
+
+// returns the seed of the choice with index i, which is the seed plus i.
+// Seeds are 32-bit, so it wraps around to 0 after math.MaxInt32.
+func choiceSeed(seed int, i int) int {
+	return int((int64(seed) + int64(i)) % (math.MaxInt32 + 1))
+}
+
+// CompletionsHandler implements the legacy /v1/completions endpoint of the OpenAI API.
+type CompletionsHandler struct {
+	Manager *ModelManager
+}
+
+func (h CompletionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "only POST method supported")
+		return
+	}
+	var req openAICompletionRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxJSONBodySize)).Decode(&req)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("failed to parse request body: %s", err))
+		return
+	}
+	if len(req.Prompt) == 0 {
+		writeOpenAIError(w, http.StatusBadRequest, "prompt must not be empty")
+		return
+	}
+	model := getOpenAIModelOrFail(w, h.Manager, req.Model)
+	if model == nil {
+		return
+	}
+	if req.Logprobs != nil && *req.Logprobs > 0 {
+		writeOpenAIError(w, http.StatusBadRequest, "logprobs is not supported")
+		return
+	}
+	n := 1
+	if req.N != nil {
+		if *req.N < 1 || *req.N > 128 {
+			writeOpenAIError(w, http.StatusBadRequest, "n must be between 1 and 128")
+			return
+		}
+		n = *req.N
+	}
+	samplingParams, err := openAISamplingParams(model, req.Temperature, req.TopP, req.MaxTokens, req.Seed)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts := samplingParams.predictOptions()
+	// the seed is returned, so the prediction can be repeated
+	w.Header().Set("X-Seed", strconv.Itoa(*samplingParams.Seed))
+	completion := openAICompletion{
+		ID:      newOpenAIID("cmpl-"),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   model.Name,
+	}
+	p, release, err := model.acquire(w, r, nil)
+	if err != nil {
+		model.handleError(w, err, openAIErrorWriter(w))
+		return
+	}
+	defer release()
+	var ew sseWriter
+	if req.Stream {
+		ew = newSSEWriter(w)
+	}
+	// writes a streaming chunk that contains only the given choice
+	writeChunk := func(choice openAICompletionChoice) bool {
+		chunk := completion
+		chunk.Choices = []openAICompletionChoice{choice}
+		return ew.writeEvent("", chunk) == nil
+	}
+	streaming := false
+	var promptTokens, completionTokens int
+	for i, prompt := range req.Prompt {
+		generated, err := predictionPrompt{text: prompt}.generate(model, p, opts)
+		if err != nil && !streaming {
+			writeOpenAIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		for j := 0; j < n; j++ {
+			index := i*n + j
+			if req.Stream && req.Echo {
+				streaming = true
+				if !writeChunk(openAICompletionChoice{Text: prompt, Index: index}) {
+					return
+				}
+			}
+			// every choice of the prompt uses a different seed, otherwise the choices would be the same
+			choiceOpts := append(opts[:len(opts):len(opts)], llama.SetSeed(choiceSeed(*samplingParams.Seed, j)))
+			result, err := predict(r.Context(), model.Name, p, generated, choiceOpts, model.stopMatcher(req.Stop), func(token string) bool {
+				if !req.Stream || token == "" {
+					return true
+				}
+				streaming = true
+				return writeChunk(openAICompletionChoice{Text: token, Index: index})
+			})
+			if err != nil && !streaming {
+				handlePredictionError(err, openAIErrorWriter(w))
+				return
+			}
+			if err != nil {
+				panic(http.ErrAbortHandler)
+			}
+			if r.Context().Err() != nil {
+				return
+			}
+			if j == 0 {
+				// the prompt is counted once, even if it's used for n choices
+				promptTokens += result.PromptTokens
+			}
+			completionTokens += result.CompletionTokens
+			if req.Stream {
+				streaming = true
+				if !writeChunk(openAICompletionChoice{Index: index, FinishReason: openAIFinishReason(result.FinishReason)}) {
+					return
+				}
+				continue
+			}
+			text := result.Text
+			if req.Echo {
+				text = prompt + text
+			}
+			completion.Choices = append(completion.Choices, openAICompletionChoice{
+				Text:         text,
+				Index:        index,
+				FinishReason: openAIFinishReason(result.FinishReason),
+			})
+		}
+	}
+	if req.Stream {
+		ew.writeRawEvent("", []byte("[DONE]"))
+		return
+	}
+	usage := newOpenAIUsage(promptTokens, completionTokens)
+	completion.Usage = &usage
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(completion)
+}
+
+type openAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// ModelsHandler implements the /v1/models endpoint of the OpenAI API, that lists the models.
+type ModelsHandler struct {
+	Manager *ModelManager
+}
+
+func (h ModelsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "only GET method supported")
+		return
+	}
+	list := struct {
+		Object string        `json:"object"`
+		Data   []openAIModel `json:"data"`
+	}{
+		Object: "list",
+		Data:   []openAIModel{},
+	}
+	for _, model := range h.Manager.Models() {
+		list.Data = append(list.Data, openAIModel{
+			ID:      model.Name,
+			Object:  "model",
+			OwnedBy: "llm-api",
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
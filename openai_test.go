@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"cmitsakis/llm-api/internal/llm/conversation"
+	llama "github.com/go-skynet/go-llama.cpp"
+)
+
+// seedLLM is a model that predicts the seed it's given, so tests can check which seed a prediction used.
+type seedLLM struct {
+	fakeLLM
+}
+
+func (l seedLLM) Predict(text string, opts ...llama.PredictOption) (string, error) {
+	return fakeLLM{tokens: []string{strconv.Itoa(llama.NewPredictOptions(opts...).Seed)}}.Predict(text, opts...)
+}
+
+// sends the request body to the handler, and returns the response.
+func serveOpenAI(h http.Handler, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/v1/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCompletionsHandler(t *testing.T) {
+	mm, _ := newTestModelWithLLM(t, seedLLM{})
+	for _, test := range []struct {
+		body  string
+		texts []string
+	}{
+		{`{"model": "a", "prompt": "hi", "seed": 5}`, []string{"5"}},
+		// every choice has a different seed, and the seeds wrap around at the 32-bit limit
+		{`{"model": "a", "prompt": "hi", "seed": 2147483646, "n": 3}`, []string{"2147483646", "2147483647", "0"}},
+		// the choices of every prompt use the same seeds
+		{`{"model": "a", "prompt": ["hi", "hello"], "seed": 5, "n": 2}`, []string{"5", "6", "5", "6"}},
+		{`{"model": "a", "prompt": "hi", "seed": 5, "echo": true}`, []string{"hi5"}},
+	} {
+		w := serveOpenAI(CompletionsHandler{Manager: mm}, test.body)
+		if w.Code != http.StatusOK {
+			fmt.Printf("%s: status code = %d: %s\n", test.body, w.Code, w.Body.String())
+			t.Fail()
+			continue
+		}
+		var completion openAICompletion
+		err := json.Unmarshal(w.Body.Bytes(), &completion)
+		if err != nil {
+			fmt.Printf("%s: failed to parse response: %s\n", test.body, err)
+			t.Fail()
+			continue
+		}
+		var texts []string
+		for i, choice := range completion.Choices {
+			if choice.Index != i {
+				fmt.Printf("%s: index of choice %d = %d\n", test.body, i, choice.Index)
+				t.Fail()
+			}
+			texts = append(texts, choice.Text)
+		}
+		if fmt.Sprint(texts) != fmt.Sprint(test.texts) {
+			fmt.Printf("%s: texts of the choices = %q, expected %q\n", test.body, texts, test.texts)
+			t.Fail()
+		}
+		if seed := w.Header().Get("X-Seed"); seed != strings.TrimPrefix(test.texts[0], "hi") {
+			fmt.Printf("%s: X-Seed = %s, expected the seed of the first choice\n", test.body, seed)
+			t.Fail()
+		}
+	}
+}
+
+func TestCompletionsHandlerStream(t *testing.T) {
+	mm, _ := newTestModelWithLLM(t, seedLLM{})
+	w := serveOpenAI(CompletionsHandler{Manager: mm}, `{"model": "a", "prompt": "hi", "seed": 2147483647, "n": 2, "stream": true}`)
+	body := w.Body.String()
+	for _, expected := range []string{`"choices":[{"text":"2147483647","index":0,`, `"choices":[{"text":"0","index":1,`, `"choices":[{"text":"","index":1,"logprobs":null,"finish_reason":"stop"}]`} {
+		if !strings.Contains(body, expected) {
+			fmt.Printf("the streamed response doesn't contain %s:\n%s\n", expected, body)
+			t.Fail()
+		}
+	}
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		fmt.Printf("the streamed response doesn't end with [DONE]:\n%s\n", body)
+		t.Fail()
+	}
+}
+
+func TestCompletionsHandlerErrors(t *testing.T) {
+	mm, _ := newTestModelWithLLM(t, seedLLM{})
+	for _, test := range []struct {
+		body       string
+		statusCode int
+		message    string
+	}{
+		{`{"model": "a", "prompt": []}`, http.StatusBadRequest, "prompt must not be empty"},
+		{`{"model": "a", "prompt": 1}`, http.StatusBadRequest, "prompt must be a string or an array of strings"},
+		{`{"model": "a", "prompt": "hi", "n": 0}`, http.StatusBadRequest, "n must be between 1 and 128"},
+		{`{"model": "a", "prompt": "hi", "n": 129}`, http.StatusBadRequest, "n must be between 1 and 128"},
+		{`{"model": "a", "prompt": "hi", "logprobs": 1}`, http.StatusBadRequest, "logprobs is not supported"},
+		{`{"model": "a", "prompt": "hi", "seed": 2147483648}`, http.StatusBadRequest, "seed must be between -1 and 2147483647"},
+		{`{"model": "b", "prompt": "hi"}`, http.StatusNotFound, "model not found"},
+	} {
+		w := serveOpenAI(CompletionsHandler{Manager: mm}, test.body)
+		if w.Code != test.statusCode || !strings.Contains(w.Body.String(), test.message) {
+			fmt.Printf("%s: response = %d %s, expected %d %q\n", test.body, w.Code, w.Body.String(), test.statusCode, test.message)
+			t.Fail()
+		}
+	}
+}
+
+func TestChatCompletionsHandler(t *testing.T) {
+	mm, model := newTestModelWithLLM(t, seedLLM{})
+	model.PromptTemplate = conversation.PromptTemplateChatML
+	w := serveOpenAI(ChatCompletionsHandler{Manager: mm}, `{"model": "a", "messages": [{"role": "system", "content": "be nice"}, {"role": "user", "content": "hi"}], "seed": 7}`)
+	if w.Code != http.StatusOK {
+		fmt.Printf("status code = %d: %s\n", w.Code, w.Body.String())
+		t.FailNow()
+	}
+	var completion openAIChatCompletion
+	err := json.Unmarshal(w.Body.Bytes(), &completion)
+	if err != nil {
+		fmt.Printf("failed to parse response: %s\n", err)
+		t.FailNow()
+	}
+	if len(completion.Choices) != 1 {
+		fmt.Printf("%d choices, expected 1\n", len(completion.Choices))
+		t.FailNow()
+	}
+	choice := completion.Choices[0]
+	if choice.Message.Role != "assistant" || choice.Message.Content != "7" || choice.FinishReason != "stop" {
+		fmt.Printf("choice = %+v, expected the assistant to reply with the seed 7\n", choice)
+		t.Fail()
+	}
+	if completion.Usage.CompletionTokens != 1 {
+		fmt.Printf("completion tokens = %d, expected 1\n", completion.Usage.CompletionTokens)
+		t.Fail()
+	}
+
+	w = serveOpenAI(ChatCompletionsHandler{Manager: mm}, `{"model": "a", "messages": [{"role": "user", "content": "hi"}], "seed": 7, "stream": true}`)
+	body := w.Body.String()
+	for _, expected := range []string{`"delta":{"role":"assistant"}`, `"delta":{"content":"7"}`, `"finish_reason":"stop"`} {
+		if !strings.Contains(body, expected) {
+			fmt.Printf("the streamed response doesn't contain %s:\n%s\n", expected, body)
+			t.Fail()
+		}
+	}
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		fmt.Printf("the streamed response doesn't end with [DONE]:\n%s\n", body)
+		t.Fail()
+	}
+}
+
+func TestChatCompletionsHandlerMessages(t *testing.T) {
+	mm, model := newTestModelWithLLM(t, seedLLM{})
+	model.PromptTemplate = conversation.PromptTemplateChatML
+	for _, test := range []struct {
+		body       string
+		statusCode int
+		message    string
+	}{
+		{`{"model": "a", "messages": []}`, http.StatusBadRequest, "messages must not be empty"},
+		{`{"model": "a", "messages": [{"role": "robot", "content": "hi"}]}`, http.StatusBadRequest, "messages[0]: unsupported role: 'robot'"},
+		{`{"model": "a", "messages": [{"role": "user", "content": "hi"}], "temperature": 3}`, http.StatusBadRequest, "temperature must be between 0 and 2"},
+		{`{"model": "b", "messages": [{"role": "user", "content": "hi"}]}`, http.StatusNotFound, "model not found"},
+		{`{"model": "a", "messages": [{"role": "user", "content": "hi"}, {"role": "tool", "content": "12:00", "tool_call_id": "call_1"}]}`,
+			http.StatusBadRequest, "messages[1]: a tool message must follow an assistant message with tool calls"},
+		{`{"model": "a", "messages": [{"role": "user", "content": "hi"}, {"role": "assistant", "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_time", "arguments": "{}"}}]}, {"role": "tool", "content": "12:00", "tool_call_id": "call_2"}]}`,
+			http.StatusBadRequest, "messages[2]: the previous assistant message has no tool call with ID 'call_2'"},
+		{`{"model": "a", "messages": [{"role": "user", "content": "hi", "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_time", "arguments": "{}"}}]}]}`,
+			http.StatusBadRequest, "messages[0]: only assistant messages can have tool calls"},
+		{`{"model": "a", "messages": [{"role": "user", "content": "hi", "tool_call_id": "call_1"}]}`,
+			http.StatusBadRequest, "messages[0]: only tool messages can have a tool call ID"},
+		{`{"model": "a", "messages": [{"role": "user", "content": ""}]}`, http.StatusBadRequest, "messages[0]: the content is empty"},
+		{`{"model": "a", "messages": [{"role": "user", "content": "hi"}, {"role": "assistant", "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_time", "arguments": "{}"}}]}, {"role": "tool", "content": "12:00", "tool_call_id": "call_1"}]}`,
+			http.StatusOK, `"content":"0"`},
+		// consecutive messages with the same role are merged
+		{`{"model": "a", "messages": [{"role": "user", "content": "hi"}, {"role": "user", "content": "there"}]}`, http.StatusOK, `"content":"0"`},
+	} {
+		w := serveOpenAI(ChatCompletionsHandler{Manager: mm}, test.body)
+		if w.Code != test.statusCode || !strings.Contains(w.Body.String(), test.message) {
+			fmt.Printf("%s: response = %d %s, expected %d %q\n", test.body, w.Code, w.Body.String(), test.statusCode, test.message)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"cmitsakis/llm-api/internal/queue"
+)
+
+// RequestQueue is the queue of requests waiting for the predictor.
+type RequestQueue struct {
+	*queue.Queue
+	// name of the HTTP header that identifies the client.
+	// If empty, the client is identified by its IP address.
+	ClientHeader string
+}
+
+func (q *RequestQueue) clientID(r *http.Request) string {
+	if q.ClientHeader != "" {
+		if id := r.Header.Get(q.ClientHeader); id != "" {
+			return id
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// waits in the queue until the predictor is available, and returns a function that must be called to release it.
+// If the request waits, onPosition (if not nil) is called with the initial position in the queue, and every time the position changes,
+// so a streamed response can report the position while the request waits.
+// The initial position is also set in the header X-Queue-Position, which is sent only when the response starts,
+// after the request leaves the queue.
+func (q *RequestQueue) acquire(w http.ResponseWriter, r *http.Request, onPosition func(position int)) (func(), error) {
+	positionReported := false
+	release, err := q.Acquire(r.Context(), q.clientID(r), func(position int) {
+		if !positionReported {
+			w.Header().Set("X-Queue-Position", strconv.Itoa(position))
+			positionReported = true
+		}
+		if onPosition != nil {
+			onPosition(position)
+		}
+	})
+	if err != nil {
+		if timeoutErr := requestTimeoutError(r.Context()); timeoutErr != nil {
+			return nil, timeoutErr
+		}
+		return nil, err
+	}
+	if !positionReported {
+		w.Header().Set("X-Queue-Position", "0")
+	}
+	return release, nil
+}
+
+// handles an error returned by acquire().
+// If the queue is full or the request waited too long (in the queue, or in total), writeError is called with HTTP 503 and the Retry-After header is set.
+func (q *RequestQueue) handleError(w http.ResponseWriter, err error, writeError func(statusCode int, message string)) {
+	if errors.Is(err, queue.ErrFull) || errors.Is(err, queue.ErrTimeout) || errors.Is(err, errRequestTimeout) {
+		retryAfter := int(math.Ceil(q.EstimatedWait().Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		log.Printf("sending HTTP error: %v. %s", http.StatusText(http.StatusServiceUnavailable), err)
+		writeError(http.StatusServiceUnavailable, fmt.Sprintf("server is busy: %s", err))
+		return
+	}
+	// the client went away while waiting, so there is nobody to send the error to
+	log.Printf("request cancelled while waiting in queue: %s", err)
+}
+
+// returns a function that writes an error in plain text. It can be passed to Model.handleError().
+func plainTextError(w http.ResponseWriter) func(statusCode int, message string) {
+	return func(statusCode int, message string) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(statusCode)
+		fmt.Fprint(w, message)
+	}
+}
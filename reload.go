@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Reloader reloads the configuration of the models while the server is running.
+// It re-reads the model config file, the config file, the system prompt files and the prompt template files.
+// Other options (e.g. the address the server listens to) require a restart.
+type Reloader struct {
+	// command line arguments the server was started with
+	Arguments []string
+	Manager   *ModelManager
+
+	mu sync.Mutex
+}
+
+// reloads the configuration. If the new configuration is not valid, the old one is kept.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	err := rl.reload()
+	if err != nil {
+		log.Printf("reload failed, keeping the previous configuration: %s\n", err)
+		return err
+	}
+	log.Println("reload succeeded")
+	return nil
+}
+
+func (rl *Reloader) reload() error {
+	config, args, err := parseConfig(rl.Arguments, flag.ContinueOnError)
+	if err != nil {
+		return err
+	}
+	modelConfigs, err := modelConfigsFromConfig(config, args)
+	if err != nil {
+		return err
+	}
+	// all models are validated before any of them is replaced
+	models, err := newModels(config, modelConfigs, rl.Manager)
+	if err != nil {
+		return err
+	}
+	rl.Manager.SetModels(models)
+	if !config.LazyLoad {
+		// SetModels() kept the instances that are already loaded, so only the changed models are loaded
+		return loadModels(rl.Manager, rl.Manager.Models())
+	}
+	return nil
+}
+
+// ReloadHandler reloads the configuration on POST requests authenticated with the admin token.
+type ReloadHandler struct {
+	Reloader *Reloader
+	Token    string
+}
+
+func (h ReloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "invalid admin token")
+		return
+	}
+	err := h.Reloader.Reload()
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "reload failed: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "configuration reloaded")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sends a request to /admin/reload, and returns the response.
+func serveReload(h ReloadHandler, method string, authorization string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/admin/reload", nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestReloadHandlerAuth(t *testing.T) {
+	// the configuration has no models, so a request that is authenticated fails with HTTP 422
+	h := ReloadHandler{Reloader: &Reloader{Manager: newTestModelManager(0, 0)}, Token: "secret"}
+	for _, test := range []struct {
+		method        string
+		authorization string
+		statusCode    int
+	}{
+		{"GET", "Bearer secret", http.StatusMethodNotAllowed},
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "Bearer wrong", http.StatusUnauthorized},
+		{"POST", "Bearer secret2", http.StatusUnauthorized},
+		{"POST", "Bearer ", http.StatusUnauthorized},
+		{"POST", "secret", http.StatusUnauthorized},
+		{"POST", "Basic secret", http.StatusUnauthorized},
+		{"POST", "Bearer secret", http.StatusUnprocessableEntity},
+	} {
+		w := serveReload(h, test.method, test.authorization)
+		if w.Code != test.statusCode {
+			fmt.Printf("%s with Authorization %q: status code = %d, expected %d\n", test.method, test.authorization, w.Code, test.statusCode)
+			t.Fail()
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			fmt.Printf("%s with Authorization %q: the header WWW-Authenticate is not set\n", test.method, test.authorization)
+			t.Fail()
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.gguf")
+	err := os.WriteFile(path, make([]byte, 10), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := newTestModelManager(0, 0)
+	reloader := &Reloader{Arguments: []string{"-lazy-load", "-system-prompt", "be nice", path}, Manager: mm}
+	h := ReloadHandler{Reloader: reloader, Token: "secret"}
+	w := serveReload(h, "POST", "Bearer secret")
+	if w.Code != http.StatusOK {
+		fmt.Printf("reload failed: %d %s\n", w.Code, w.Body.String())
+		t.FailNow()
+	}
+	models := mm.Models()
+	if len(models) != 1 || models[0].Name != "a" || models[0].SystemPrompt != "be nice" {
+		fmt.Printf("the models are not the ones of the configuration after reload\n")
+		t.FailNow()
+	}
+	for _, test := range []struct {
+		arguments []string
+		err       string
+	}{
+		{[]string{"-lazy-load", "-stop-regex", "(", path}, "failed to parse regex of flag -stop-regex"},
+		{[]string{"-lazy-load", "-system-prompt", "a", "-system-prompt-file", path, path}, "cannot use flags -system-prompt and -system-prompt-file at the same time"},
+		{[]string{"-lazy-load", "-config-file", filepath.Join(dir, "missing.json"), path}, "missing.json"},
+	} {
+		reloader.Arguments = test.arguments
+		w := serveReload(h, "POST", "Bearer secret")
+		if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), test.err) {
+			fmt.Printf("reload with %q: response = %d %s, expected %d %q\n", test.arguments, w.Code, w.Body.String(), http.StatusUnprocessableEntity, test.err)
+			t.Fail()
+		}
+		// the previous configuration is kept
+		if current := mm.Models(); len(current) != 1 || current[0] != models[0] {
+			fmt.Printf("reload with %q replaced the models, although it failed\n", test.arguments)
+			t.Fail()
+		}
+	}
+}
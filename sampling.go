@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+)
+
+// SamplingParams are the sampling options of PredictConfig that a request can override.
+// Nil fields are not overridden.
+type SamplingParams struct {
+	Tokens            *int     `json:"tokens,omitempty"`
+	NKeep             *int     `json:"nKeep,omitempty"`
+	TopK              *int     `json:"topK,omitempty"`
+	TopP              *float64 `json:"topP,omitempty"`
+	Temperature       *float64 `json:"temperature,omitempty"`
+	TailFreeSamplingZ *float64 `json:"tailFreeSamplingZ,omitempty"`
+	RepetitionPenalty *float64 `json:"repetitionPenalty,omitempty"`
+	FrequencyPenalty  *float64 `json:"frequencyPenalty,omitempty"`
+	PresencePenalty   *float64 `json:"presencePenalty,omitempty"`
+	Mirostat          *int     `json:"mirostat,omitempty"`
+	MirostatTau       *float64 `json:"mirostatTau,omitempty"`
+	MirostatEta       *float64 `json:"mirostatEta,omitempty"`
+	// seed of the random number generator of the sampler (-1 = random)
+	Seed *int `json:"seed,omitempty"`
+}
+
+// samplingField is one of the fields of SamplingParams, with the range of its valid values.
+// Exactly one of intValue and floatValue is set.
+type samplingField struct {
+	name       string
+	intValue   **int
+	floatValue **float64
+	min        float64
+	max        float64
+}
+
+func (s *SamplingParams) fields() []samplingField {
+	inf := math.Inf(1)
+	return []samplingField{
+		{name: "tokens", intValue: &s.Tokens, min: 0, max: math.MaxInt32},
+		{name: "nKeep", intValue: &s.NKeep, min: 0, max: math.MaxInt32},
+		{name: "topK", intValue: &s.TopK, min: 0, max: math.MaxInt32},
+		{name: "topP", floatValue: &s.TopP, min: 0, max: 1},
+		{name: "temperature", floatValue: &s.Temperature, min: 0, max: inf},
+		{name: "tailFreeSamplingZ", floatValue: &s.TailFreeSamplingZ, min: 0, max: 1},
+		{name: "repetitionPenalty", floatValue: &s.RepetitionPenalty, min: 0, max: inf},
+		{name: "frequencyPenalty", floatValue: &s.FrequencyPenalty, min: -2, max: 2},
+		{name: "presencePenalty", floatValue: &s.PresencePenalty, min: -2, max: 2},
+		{name: "mirostat", intValue: &s.Mirostat, min: 0, max: 2},
+		{name: "mirostatTau", floatValue: &s.MirostatTau, min: 0, max: inf},
+		{name: "mirostatEta", floatValue: &s.MirostatEta, min: 0, max: inf},
+		{name: "seed", intValue: &s.Seed, min: -1, max: math.MaxInt32},
+	}
+}
+
+// returns true if the field is set.
+func (f samplingField) isSet() bool {
+	if f.intValue != nil {
+		return *f.intValue != nil
+	}
+	return *f.floatValue != nil
+}
+
+func (f samplingField) value() float64 {
+	if f.intValue != nil {
+		return float64(**f.intValue)
+	}
+	return **f.floatValue
+}
+
+func (f samplingField) setValue(v float64) {
+	if f.intValue != nil {
+		i := int(v)
+		*f.intValue = &i
+		return
+	}
+	*f.floatValue = &v
+}
+
+func (f samplingField) validRange() string {
+	if math.IsInf(f.max, 1) {
+		return fmt.Sprintf("must be at least %v", f.min)
+	}
+	return fmt.Sprintf("must be between %v and %v", f.min, f.max)
+}
+
+// parses the sampling parameters of the form. Parameters that are not in the form are not set.
+func parseSamplingParams(form url.Values) (SamplingParams, error) {
+	var s SamplingParams
+	for _, f := range s.fields() {
+		str := form.Get(f.name)
+		if str == "" {
+			continue
+		}
+		if f.intValue != nil {
+			v, err := strconv.Atoi(str)
+			if err != nil {
+				return SamplingParams{}, fmt.Errorf("failed to parse value '%s' %s: must be an integer", f.name, str)
+			}
+			*f.intValue = &v
+		} else {
+			v, err := strconv.ParseFloat(str, 64)
+			if err != nil || math.IsNaN(v) {
+				return SamplingParams{}, fmt.Errorf("failed to parse value '%s' %s: must be a number", f.name, str)
+			}
+			*f.floatValue = &v
+		}
+	}
+	return s, s.validate()
+}
+
+// returns an error if a parameter is outside the range of valid values.
+func (s *SamplingParams) validate() error {
+	for _, f := range s.fields() {
+		if !f.isSet() {
+			continue
+		}
+		if v := f.value(); v < f.min || v > f.max {
+			return fmt.Errorf("invalid value of '%s' %v: %s", f.name, v, f.validRange())
+		}
+	}
+	return nil
+}
+
+// applies the limits the operator has set: forbidden parameters cause an error,
+// and values outside the allowed range are clamped to it.
+func (s *SamplingParams) applyLimits(limits SamplingLimits) error {
+	for _, f := range s.fields() {
+		limit, ok := limits[f.name]
+		if ok && limit.Forbidden && f.isSet() {
+			return fmt.Errorf("parameter '%s' cannot be set by requests", f.name)
+		}
+	}
+	s.clamp(limits)
+	return nil
+}
+
+// clamps the values outside the range the limits allow.
+func (s *SamplingParams) clamp(limits SamplingLimits) {
+	for _, f := range s.fields() {
+		limit, ok := limits[f.name]
+		if !ok || !f.isSet() {
+			continue
+		}
+		v := f.value()
+		if limit.Min != nil && v < *limit.Min {
+			v = *limit.Min
+		}
+		if limit.Max != nil && v > *limit.Max {
+			v = *limit.Max
+		}
+		f.setValue(v)
+	}
+}
+
+// returns the predict options that override the defaults of the model.
+func (s *SamplingParams) predictOptions() []llama.PredictOption {
+	var opts []llama.PredictOption
+	if s.Tokens != nil {
+		opts = append(opts, llama.SetTokens(*s.Tokens))
+	}
+	if s.NKeep != nil {
+		opts = append(opts, llama.SetNKeep(*s.NKeep))
+	}
+	if s.TopK != nil {
+		opts = append(opts, llama.SetTopK(*s.TopK))
+	}
+	if s.TopP != nil {
+		opts = append(opts, llama.SetTopP(float32(*s.TopP)))
+	}
+	if s.Temperature != nil {
+		opts = append(opts, llama.SetTemperature(float32(*s.Temperature)))
+	}
+	if s.TailFreeSamplingZ != nil {
+		opts = append(opts, llama.SetTailFreeSamplingZ(float32(*s.TailFreeSamplingZ)))
+	}
+	if s.RepetitionPenalty != nil {
+		opts = append(opts, llama.SetPenalty(float32(*s.RepetitionPenalty)))
+	}
+	if s.FrequencyPenalty != nil {
+		opts = append(opts, llama.SetFrequencyPenalty(float32(*s.FrequencyPenalty)))
+	}
+	if s.PresencePenalty != nil {
+		opts = append(opts, llama.SetPresencePenalty(float32(*s.PresencePenalty)))
+	}
+	if s.Mirostat != nil {
+		opts = append(opts, llama.SetMirostat(*s.Mirostat))
+	}
+	if s.MirostatTau != nil {
+		opts = append(opts, llama.SetMirostatTAU(float32(*s.MirostatTau)))
+	}
+	if s.MirostatEta != nil {
+		opts = append(opts, llama.SetMirostatETA(float32(*s.MirostatEta)))
+	}
+	if s.Seed != nil {
+		opts = append(opts, llama.SetSeed(*s.Seed))
+	}
+	return opts
+}
+
+// sets the seed if it's not set or if it's random (-1), and returns it.
+// The seed is chosen here instead of by llama.cpp, so it can be returned to the client, and the prediction can be repeated.
+func (s *SamplingParams) resolveSeed(defaultSeed int) int {
+	seed := defaultSeed
+	if s.Seed != nil {
+		seed = *s.Seed
+	}
+	if seed < 0 {
+		seed = int(rand.Int31n(math.MaxInt32)) + 1
+	}
+	s.Seed = &seed
+	return seed
+}
+
+// SamplingLimit restricts how requests can override a sampling parameter.
+type SamplingLimit struct {
+	// values lower than Min are raised to Min
+	Min *float64 `json:"min,omitempty"`
+	// values higher than Max are lowered to Max
+	Max *float64 `json:"max,omitempty"`
+	// requests that set the parameter are rejected
+	Forbidden bool `json:"forbidden,omitempty"`
+}
+
+// SamplingLimits are the limits of the sampling parameters, by parameter name.
+type SamplingLimits map[string]SamplingLimit
+
+func (limits *SamplingLimits) UnmarshalJSON(data []byte) error {
+	var m map[string]SamplingLimit
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return err
+	}
+	var s SamplingParams
+	fields := s.fields()
+	for name, limit := range m {
+		i := slices.IndexFunc(fields, func(f samplingField) bool { return f.name == name })
+		if i < 0 {
+			return fmt.Errorf("unknown sampling parameter '%s'", name)
+		}
+		// the values of integer parameters are clamped to the limits, so the limits must be integers too
+		if fields[i].intValue != nil {
+			for _, bound := range []struct {
+				name  string
+				value *float64
+			}{{"min", limit.Min}, {"max", limit.Max}} {
+				if bound.value != nil && (*bound.value != math.Trunc(*bound.value) || *bound.value < math.MinInt32 || *bound.value > math.MaxInt32) {
+					return fmt.Errorf("%s of sampling parameter '%s' must be a 32-bit integer", bound.name, name)
+				}
+			}
+		}
+		if limit.Min != nil && limit.Max != nil && *limit.Min > *limit.Max {
+			return fmt.Errorf("min of sampling parameter '%s' is greater than max", name)
+		}
+	}
+	// entries are added to the existing limits, so models can override the limits of the top level of the config file
+	if *limits == nil {
+		*limits = make(SamplingLimits)
+	}
+	for name, limit := range m {
+		(*limits)[name] = limit
+	}
+	return nil
+}
+
+// returns the parameters of s overridden by the parameters that are set in override.
+func (s SamplingParams) merge(override SamplingParams) SamplingParams {
+	merged := s
+	mergedFields := merged.fields()
+	for i, f := range override.fields() {
+		if f.isSet() {
+			mergedFields[i].setValue(f.value())
+		}
+	}
+	return merged
+}
+
+// SamplingPresets are named sets of sampling parameters that requests select with the parameter "preset".
+type SamplingPresets map[string]SamplingParams
+
+func (presets *SamplingPresets) UnmarshalJSON(data []byte) error {
+	var m map[string]json.RawMessage
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return err
+	}
+	// presets are added to the existing presets, so models can add presets to the presets of the top level of the config file
+	if *presets == nil {
+		*presets = make(SamplingPresets)
+	}
+	for name, presetJSON := range m {
+		var preset SamplingParams
+		decoder := json.NewDecoder(bytes.NewReader(presetJSON))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&preset)
+		if err != nil {
+			return fmt.Errorf("failed to parse preset '%s': %s", name, err)
+		}
+		err = preset.validate()
+		if err != nil {
+			return fmt.Errorf("invalid preset '%s': %s", name, err)
+		}
+		(*presets)[name] = preset
+	}
+	return nil
+}
+
+// returns the sampling parameters of the request: the parameters of the preset selected with the parameter "preset",
+// overridden by the sampling parameters of the form, which are restricted by the limits of the model.
+// The values of the preset are clamped by the limits too.
+// The seed is always set.
+func requestSamplingParams(form url.Values, model *Model) (SamplingParams, error) {
+	samplingParams, err := parseSamplingParams(form)
+	if err != nil {
+		return SamplingParams{}, err
+	}
+	err = samplingParams.applyLimits(model.SamplingLimits)
+	if err != nil {
+		return SamplingParams{}, err
+	}
+	presetName := form.Get("preset")
+	if presetName != "" {
+		preset, ok := model.SamplingPresets[presetName]
+		if !ok {
+			return SamplingParams{}, fmt.Errorf("preset '%s' not found", presetName)
+		}
+		samplingParams = preset.merge(samplingParams)
+		// the operator can set forbidden parameters in presets, but the values of the presets are still clamped
+		samplingParams.clamp(model.SamplingLimits)
+	}
+	samplingParams.resolveSeed(model.Seed)
+	return samplingParams, nil
+}
+
+// PresetsHandler lists the sampling presets of a model.
+type PresetsHandler struct {
+	Manager *ModelManager
+}
+
+func (h PresetsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "only GET method supported")
+		return
+	}
+	model := getModelOrFail(w, h.Manager, r.URL.Query().Get("model"))
+	if model == nil {
+		return
+	}
+	presets := model.SamplingPresets
+	if presets == nil {
+		presets = SamplingPresets{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Model   string          `json:"model"`
+		Presets SamplingPresets `json:"presets"`
+	}{model.Name, presets})
+}
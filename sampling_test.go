@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func TestRequestSamplingParamsPresetLimits(t *testing.T) {
+	maxTemperature := 1.0
+	temperature := 1.5
+	topK := 100
+	model := &Model{
+		SamplingLimits: SamplingLimits{
+			"temperature": {Max: &maxTemperature},
+			"topK":        {Forbidden: true},
+		},
+		SamplingPresets: SamplingPresets{
+			"creative": {Temperature: &temperature, TopK: &topK},
+		},
+	}
+	samplingParams, err := requestSamplingParams(url.Values{"preset": {"creative"}}, model)
+	if err != nil {
+		fmt.Printf("requestSamplingParams() failed: %s\n", err)
+		t.Fail()
+		return
+	}
+	if *samplingParams.Temperature != maxTemperature {
+		fmt.Printf("temperature of the preset = %v, expected to be clamped to %v\n", *samplingParams.Temperature, maxTemperature)
+		t.Fail()
+	}
+	// presets can set parameters that requests can't
+	if *samplingParams.TopK != topK {
+		fmt.Printf("top-k of the preset = %v, expected %v\n", *samplingParams.TopK, topK)
+		t.Fail()
+	}
+	_, err = requestSamplingParams(url.Values{"preset": {"creative"}, "topK": {"10"}}, model)
+	if err == nil {
+		fmt.Printf("requestSamplingParams() didn't fail for a forbidden parameter of the request\n")
+		t.Fail()
+	}
+}
+
+func TestSamplingLimitsOfIntegerParameters(t *testing.T) {
+	for _, test := range []struct {
+		json string
+		err  string
+	}{
+		{`{"tokens": {"min": 1, "max": 512}, "temperature": {"min": 0.1, "max": 1.5}}`, ""},
+		{`{"tokens": {"max": 512.0}}`, ""},
+		{`{"tokens": {"max": 1.5}}`, "max of sampling parameter 'tokens' must be a 32-bit integer"},
+		{`{"topK": {"min": 0.5}}`, "min of sampling parameter 'topK' must be a 32-bit integer"},
+		{`{"seed": {"max": 1e30}}`, "max of sampling parameter 'seed' must be a 32-bit integer"},
+		{`{"tokens": {"min": 10, "max": 1}}`, "min of sampling parameter 'tokens' is greater than max"},
+		{`{"foo": {"min": 1}}`, "unknown sampling parameter 'foo'"},
+	} {
+		var limits SamplingLimits
+		err := json.Unmarshal([]byte(test.json), &limits)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			fmt.Printf("parsing the limits %s: error = %v, expected %q\n", test.json, err, test.err)
+			t.Fail()
+		}
+	}
+}
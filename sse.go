@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// writes Server-Sent Events to the client, and flushes after every event.
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	return sseWriter{w: w, flusher: flusher}
+}
+
+// writes an event with the given data encoded in JSON.
+// If event is the empty string, the event field is omitted.
+func (sw sseWriter) writeEvent(event string, data any) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return sw.writeRawEvent(event, dataJSON)
+}
+
+// writes an event with the given data. data must not contain newlines.
+func (sw sseWriter) writeRawEvent(event string, data []byte) error {
+	var err error
+	if event != "" {
+		_, err = fmt.Fprintf(sw.w, "event: %s\ndata: %s\n\n", event, data)
+	} else {
+		_, err = fmt.Fprintf(sw.w, "data: %s\n\n", data)
+	}
+	if err != nil {
+		return err
+	}
+	if sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+	return nil
+}
+
+// returns true if the client requested the response as Server-Sent Events,
+// either with the "stream" parameter or with the Accept header.
+// r.ParseForm() must have been called before.
+func wantsEventStream(r *http.Request) bool {
+	switch r.Form.Get("stream") {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, _ := strings.Cut(mediaRange, ";")
+			if strings.TrimSpace(mediaType) == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type sseToken struct {
+	Token string `json:"token"`
+}
+
+type sseQueue struct {
+	Position int `json:"position"`
+}
+
+type sseDone struct {
+	FinishReason     string `json:"finishReason"`
+	PromptTokens     int    `json:"promptTokens"`
+	CompletionTokens int    `json:"completionTokens"`
+	// the stop sequence that matched, if the finish reason is "stop"
+	StopSequence string `json:"stopSequence,omitempty"`
+	// seed of the sampler, so the prediction can be repeated
+	Seed int `json:"seed"`
+	// number of the oldest messages of the conversation of /chat that were dropped, so the prompt fits in the context
+	DroppedMessages int `json:"droppedMessages,omitempty"`
+}
+
+type sseError struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"cmitsakis/llm-api/internal/llm/conversation"
+)
+
+// the model generates it when it expects the result of a tool call, so the prediction stops there
+const toolResultStop = "<tool_response>"
+
+// toolDefinition is the definition of a tool in a request, in the format of the OpenAI API.
+type toolDefinition struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+	} `json:"function"`
+}
+
+// returns the tools of the definitions, after validating them.
+func newTools(definitions []toolDefinition) ([]conversation.Tool, error) {
+	tools := make([]conversation.Tool, 0, len(definitions))
+	names := make(map[string]bool, len(definitions))
+	for i, definition := range definitions {
+		if definition.Type != "function" {
+			return nil, fmt.Errorf("tools[%d]: unsupported type: '%s'", i, definition.Type)
+		}
+		name := definition.Function.Name
+		if !validToolName(name) {
+			return nil, fmt.Errorf("tools[%d]: the name must have 1 to 64 letters, digits, underscores or dashes", i)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("tools[%d]: duplicate name: '%s'", i, name)
+		}
+		names[name] = true
+		var parameters map[string]json.RawMessage
+		if definition.Function.Parameters != nil && json.Unmarshal(definition.Function.Parameters, &parameters) != nil {
+			return nil, fmt.Errorf("tools[%d]: the parameters must be a JSON Schema object", i)
+		}
+		tools = append(tools, conversation.Tool{
+			Name:        name,
+			Description: definition.Function.Description,
+			Parameters:  definition.Function.Parameters,
+		})
+	}
+	return tools, nil
+}
+
+func validToolName(name string) bool {
+	if len(name) == 0 || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// parses the tool calls of the response of the model, and gives them IDs.
+// If the tool calls are invalid, the whole response is returned as text, because the model didn't follow the instructions.
+func parseToolCalls(ctx context.Context, response string) (string, []conversation.ToolCall) {
+	text, calls, err := conversation.ParseToolCalls(response)
+	if err != nil {
+		requestLogger(ctx).Warn("failed to parse tool calls", slog.String("error", err.Error()))
+		return response, nil
+	}
+	for i := range calls {
+		calls[i].ID = newOpenAIID("call_")
+	}
+	return text, calls
+}
+
+// chatToolCall is a tool call in the response of /chat.
+type chatToolCall struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// JSON object
+	Arguments string `json:"arguments"`
+}
+
+// toolsResponse is the response of /chat if the request sets tools.
+type toolsResponse struct {
+	Text             string         `json:"text"`
+	ToolCalls        []chatToolCall `json:"toolCalls"`
+	FinishReason     string         `json:"finishReason"`
+	PromptTokens     int            `json:"promptTokens"`
+	CompletionTokens int            `json:"completionTokens"`
+	Seed             int            `json:"seed"`
+	// number of the oldest messages of the conversation that were dropped, so the prompt fits in the context
+	DroppedMessages int `json:"droppedMessages,omitempty"`
+}
+
+// returns the response of a prediction of a conversation with tools.
+func toolsPredictionResponse(ctx context.Context, seed int) func(result predictionResult) (any, error) {
+	return func(result predictionResult) (any, error) {
+		text, calls := parseToolCalls(ctx, result.Text)
+		response := toolsResponse{
+			Text:             text,
+			ToolCalls:        []chatToolCall{},
+			FinishReason:     result.FinishReason,
+			PromptTokens:     result.PromptTokens,
+			CompletionTokens: result.CompletionTokens,
+			Seed:             seed,
+			DroppedMessages:  result.DroppedMessages,
+		}
+		for _, call := range calls {
+			response.ToolCalls = append(response.ToolCalls, chatToolCall{ID: call.ID, Name: call.Name, Arguments: call.Arguments})
+		}
+		return response, nil
+	}
+}